@@ -0,0 +1,265 @@
+package backend
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"firebase.google.com/go/v4/auth"
+)
+
+// Identity is who signed the bearer token, firebase uids are the unik
+// part of down4 ids, so "hashirama" is the uid of hashirama-america-1
+type Identity struct {
+	UID    string
+	Claims map[string]interface{}
+}
+
+type TokenVerifier interface {
+	Verify(ctx context.Context, token string) (*Identity, error)
+}
+
+const (
+	codeUnauthenticated = "unauthenticated"
+	codeForbidden       = "forbidden"
+)
+
+type identityKey struct{}
+
+func withIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+func identityFrom(ctx context.Context) (*Identity, error) {
+	if id, ok := ctx.Value(identityKey{}).(*Identity); ok && id != nil {
+		return id, nil
+	}
+	return nil, unauthenticated("missing identity", nil)
+}
+
+func unauthenticated(msg string, err error) *Error {
+	return &Error{Status: http.StatusUnauthorized, Code: codeUnauthenticated, Message: msg, Err: err}
+}
+
+func forbidden(msg string) *Error {
+	return &Error{Status: http.StatusForbidden, Code: codeForbidden, Message: msg}
+}
+
+// RequireAuth verifies the "Authorization: Bearer <id token>" header and
+// hands the identity to next through the request context
+func RequireAuth(v TokenVerifier, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if v == nil {
+			WriteError(w, internal(codeInternal, "no token verifier configured", nil))
+			return
+		}
+		h := r.Header.Get("Authorization")
+		token, ok := strings.CutPrefix(h, "Bearer ")
+		if !ok || len(token) == 0 {
+			WriteError(w, unauthenticated("missing bearer token", nil))
+			return
+		}
+		id, err := v.Verify(r.Context(), token)
+		if err != nil {
+			WriteError(w, unauthenticated("invalid id token", err))
+			return
+		}
+		next(w, r.WithContext(withIdentity(r.Context(), id)))
+	}
+}
+
+// is reports if a down4 id (unik-region-shard...) belongs to the identity
+func (id *Identity) is(down4Id string) bool {
+	cp, err := parseUserId(down4Id)
+	return err == nil && cp.Unik == id.UID
+}
+
+// rootMembers are the uniks of who is in the root, its ids, and for single
+// roots, the members their node lists like the app writes group nodes,
+// {"members": ["unik-region-shard", ...]}
+func (s *Server) rootMembers(ctx context.Context, roots []*ComposedId) (map[string]bool, error) {
+	members := map[string]bool{}
+	for _, cp := range roots {
+		members[cp.Unik] = true
+	}
+	if len(roots) != 1 {
+		return members, nil
+	}
+	shrd, err := s.ServerShard(roots[0])
+	if err != nil {
+		// nobody else is a member of a root on a shard we don't have
+		return members, nil
+	}
+	var node struct {
+		Members []string `json:"members"`
+	}
+	if err := shrd.RealtimeDB.NewRef("roots/"+roots[0].Unik+"/node").Get(ctx, &node); err != nil {
+		return nil, err
+	}
+	for _, m := range node.Members {
+		if cp, err := parseUserId(m); err == nil {
+			members[cp.Unik] = true
+		}
+	}
+	return members, nil
+}
+
+type firebaseVerifier struct {
+	c *auth.Client
+}
+
+func (f firebaseVerifier) Verify(ctx context.Context, token string) (*Identity, error) {
+	t, err := f.c.VerifyIDToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{UID: t.UID, Claims: t.Claims}, nil
+}
+
+// KeySetVerifier checks RS256 id tokens against a local key set instead of
+// google's, for emulators and tests. Keys are in the same kid -> PEM json
+// as https://www.googleapis.com/robot/v1/metadata/x509/securetoken@system.gserviceaccount.com
+type KeySetVerifier struct {
+	ProjectID string
+	Keys      map[string]*rsa.PublicKey
+	Now       func() time.Time
+}
+
+const tokenClockSkew = 5 * time.Minute
+
+func NewKeySetVerifier(projectID string, pems map[string]string) (*KeySetVerifier, error) {
+	keys := make(map[string]*rsa.PublicKey, len(pems))
+	for kid, p := range pems {
+		k, err := parseRSAPublicKey([]byte(p))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing key %s: %v", kid, err)
+		}
+		keys[kid] = k
+	}
+	return &KeySetVerifier{ProjectID: projectID, Keys: keys, Now: time.Now}, nil
+}
+
+func LoadKeySet(path, projectID string) (*KeySetVerifier, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key set %s: %v", path, err)
+	}
+	var pems map[string]string
+	if err := json.Unmarshal(raw, &pems); err != nil {
+		return nil, fmt.Errorf("error decoding key set %s: %v", path, err)
+	}
+	return NewKeySetVerifier(projectID, pems)
+}
+
+func parseRSAPublicKey(raw []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New("no pem block")
+	}
+	var pub interface{}
+	var err error
+	switch block.Type {
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			pub = cert.PublicKey
+		}
+	case "PUBLIC KEY":
+		pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		pub, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		err = fmt.Errorf("unexpected pem block %s", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	k, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("expected a rsa key, got %T", pub)
+	}
+	return k, nil
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type tokenClaims struct {
+	Issuer   string `json:"iss"`
+	Audience string `json:"aud"`
+	Subject  string `json:"sub"`
+	Expires  int64  `json:"exp"`
+	IssuedAt int64  `json:"iat"`
+}
+
+func (k *KeySetVerifier) Verify(ctx context.Context, token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var hdr tokenHeader
+	if err := decodeSegment(parts[0], &hdr); err != nil {
+		return nil, fmt.Errorf("error decoding token header: %v", err)
+	}
+	if hdr.Alg != "RS256" {
+		return nil, fmt.Errorf("unexpected token alg %s", hdr.Alg)
+	}
+	key, ok := k.Keys[hdr.Kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown token kid %s", hdr.Kid)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("error decoding token signature: %v", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, fmt.Errorf("invalid token signature: %v", err)
+	}
+
+	var claims tokenClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("error decoding token claims: %v", err)
+	}
+	var all map[string]interface{}
+	decodeSegment(parts[1], &all)
+
+	now := k.Now()
+	switch {
+	case claims.Audience != k.ProjectID:
+		return nil, fmt.Errorf("unexpected token audience %s", claims.Audience)
+	case claims.Issuer != "https://securetoken.google.com/"+k.ProjectID:
+		return nil, fmt.Errorf("unexpected token issuer %s", claims.Issuer)
+	case len(claims.Subject) == 0 || len(claims.Subject) > 128:
+		return nil, errors.New("invalid token subject")
+	case now.After(time.Unix(claims.Expires, 0).Add(tokenClockSkew)):
+		return nil, errors.New("token expired")
+	case now.Add(tokenClockSkew).Before(time.Unix(claims.IssuedAt, 0)):
+		return nil, errors.New("token issued in the future")
+	}
+
+	return &Identity{UID: claims.Subject, Claims: all}, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
@@ -0,0 +1,300 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testKid       = "test-kid"
+	testProjectID = "down4-26ee1"
+)
+
+func asUser(r *http.Request, uid string) *http.Request {
+	return r.WithContext(withIdentity(r.Context(), &Identity{UID: uid}))
+}
+
+// withTestKeySet makes c trust tokens signed by the returned key
+func withTestKeySet(c *Server) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	c.Verifier = &KeySetVerifier{
+		ProjectID: testProjectID,
+		Keys:      map[string]*rsa.PublicKey{testKid: &key.PublicKey},
+		Now:       time.Now,
+	}
+	return key
+}
+
+func testClaims(uid string, now time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"iss": "https://securetoken.google.com/" + testProjectID,
+		"aud": testProjectID,
+		"sub": uid,
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}
+}
+
+func signToken(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	seg := func(v interface{}) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := seg(map[string]string{"alg": "RS256", "kid": kid}) + "." + seg(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("error signing token: %v\n", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestKeySetVerifier(t *testing.T) {
+	ctx := context.Background()
+	c := newTestServer(t)
+	key := withTestKeySet(c)
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	now := time.Now()
+
+	// the key set file is loaded the same way google's is
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	pems := map[string]string{testKid: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))}
+	raw, _ := json.Marshal(pems)
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := os.WriteFile(path, raw, 0600); err != nil {
+		t.Fatalf("error writing key set: %v\n", err)
+	}
+	v, err := (AuthConfig{ProjectID: testProjectID, KeySetFile: path}).KeySet()
+	if err != nil {
+		t.Fatalf("error loading key set: %v\n", err)
+	}
+
+	id, err := v.Verify(ctx, signToken(t, key, testKid, testClaims("jones", now)))
+	if err != nil || id.UID != "jones" || id.Claims["aud"] != testProjectID {
+		t.Fatalf("unexpected identity %+v: %v\n", id, err)
+	}
+
+	with := func(k, val string) map[string]interface{} {
+		cl := testClaims("jones", now)
+		cl[k] = val
+		return cl
+	}
+	expired := testClaims("jones", now.Add(-2*time.Hour))
+	invalids := map[string]string{
+		"expired":      signToken(t, key, testKid, expired),
+		"audience":     signToken(t, key, testKid, with("aud", "someone-else")),
+		"issuer":       signToken(t, key, testKid, with("iss", "https://evil.io")),
+		"no subject":   signToken(t, key, testKid, with("sub", "")),
+		"unknown kid":  signToken(t, key, "rotated", testClaims("jones", now)),
+		"other key":    signToken(t, other, testKid, testClaims("jones", now)),
+		"not a jwt":    "jones",
+		"unsigned alg": base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"test-kid"}`)) + ".e30.",
+	}
+	for name, token := range invalids {
+		if _, err := v.Verify(ctx, token); err == nil {
+			t.Errorf("%s: expected an error\n", name)
+		}
+	}
+
+	cfg, _ := ParseConfig(defaultConfig)
+	cfg.Auth.KeySetFile = path
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected an error for a key set without projectId")
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	c := newTestServer(t)
+	h := c.Handler(DefaultMaxBodyBytes)
+
+	call := func(auth string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/nodes", strings.NewReader(""))
+		if len(auth) > 0 {
+			r.Header.Set("Authorization", auth)
+		}
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// no verifier, nothing gets through
+	if w := call("Bearer whatever"); w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500 without a verifier, got %d\n", w.Code)
+	}
+
+	key := withTestKeySet(c)
+	h = c.Handler(DefaultMaxBodyBytes)
+	for _, auth := range []string{"", "jones", "Bearer ", "Bearer nope", "Basic am9uZXM6cHc="} {
+		w := call(auth)
+		if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), codeUnauthenticated) {
+			t.Fatalf("%q: expected 401, got %d %s\n", auth, w.Code, w.Body.String())
+		}
+	}
+	if w := call("Bearer " + signToken(t, key, testKid, testClaims("jones", time.Now()))); w.Code != 200 {
+		t.Fatalf("expected 200 with a token, got %d %s\n", w.Code, w.Body.String())
+	}
+
+	// handlers called without the middleware still refuse anonymous writes
+	w := httptest.NewRecorder()
+	c.ProcessMessage(w, httptest.NewRequest("POST", "/", strings.NewReader("[]")))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without identity, got %d\n", w.Code)
+	}
+}
+
+func TestMessageAuth(t *testing.T) {
+	ctx := context.Background()
+	c := newTestServer(t)
+
+	const dual = "scammer-america-0-hashirama-america-1-r"
+	const group = "cafe-europe-1-r"
+	chat := func(sender, root string) *MessageRequest {
+		return &MessageRequest{
+			Msg: map[string]string{
+				"id":       "ABCDEFG-" + root + "-c",
+				"type":     "chat",
+				"senderId": sender,
+				"txt":      "gm",
+			},
+			Sender: sender,
+			Root:   root,
+		}
+	}
+	push := func(sender, root, target string) *MessageRequest {
+		return &MessageRequest{
+			Push: "gm", Sender: sender, Root: root,
+			Targets: []*MessageTarget{{UserId: target, DeviceId: "phone", DoPush: true}},
+		}
+	}
+	// hashirama is in the group, the node of its root lists them
+	cafe := map[string]interface{}{"name": "Cafe", "members": []string{"cafe-europe-1", "hashirama-america-1"}}
+	c.Shards["europe"][1].RealtimeDB.NewRef("roots/cafe/node").Set(ctx, cafe)
+
+	cases := []struct {
+		name   string
+		caller string
+		mrs    []*MessageRequest
+		status int
+	}{
+		{"impersonated sender", "scammer", []*MessageRequest{chat("hashirama-america-1", dual)}, 403},
+		{"impersonated msg sender", "scammer", []*MessageRequest{func() *MessageRequest {
+			mr := chat("scammer-america-0", dual)
+			mr.Msg["senderId"] = "hashirama-america-1"
+			return mr
+		}()}, 403},
+		{"outsider", "jones", []*MessageRequest{chat("jones-america-1", dual)}, 403},
+		{"non member", "scammer", []*MessageRequest{chat("scammer-america-0", group)}, 403},
+		{"reaction outsider", "jones", []*MessageRequest{{
+			Msg: map[string]string{
+				"id":        "-Nreact",
+				"type":      "reaction",
+				"senderId":  "jones-america-1",
+				"messageId": "0000000000000-" + dual + "-c",
+			},
+			Sender: "jones-america-1",
+		}}, 403},
+		{"bad message id", "scammer", []*MessageRequest{chat("scammer-america-0", "scammer-america-zero-r")}, 400},
+		{"bad target", "scammer", []*MessageRequest{func() *MessageRequest {
+			mr := chat("scammer-america-0", dual)
+			mr.Targets = []*MessageTarget{{UserId: "hashirama", DoPush: true}}
+			return mr
+		}()}, 400},
+		{"chat pushed out of the group", "hashirama", []*MessageRequest{func() *MessageRequest {
+			mr := chat("hashirama-america-1", group)
+			mr.Targets = []*MessageTarget{{UserId: "cafe-europe-1", DeviceId: "phone", DoPush: true}, {UserId: "jones-america-1", DeviceId: "phone", DoPush: true}}
+			return mr
+		}()}, 403},
+		{"push outsider", "jones", []*MessageRequest{push("jones-america-1", dual, "hashirama-america-1")}, 403},
+		{"push out of the root", "scammer", []*MessageRequest{push("scammer-america-0", dual, "jones-america-1")}, 403},
+		{"push non member", "scammer", []*MessageRequest{push("scammer-america-0", group, "hashirama-america-1")}, 403},
+		{"push no root", "scammer", []*MessageRequest{push("scammer-america-0", "", "hashirama-america-1")}, 400},
+		// the second request is refused so the first must not be written either
+		{"partly forbidden batch", "scammer", []*MessageRequest{
+			chat("scammer-america-0", dual), chat("hashirama-america-1", dual),
+		}, 403},
+	}
+
+	for _, tc := range cases {
+		js, _ := json.Marshal(tc.mrs)
+		w := httptest.NewRecorder()
+		c.ProcessMessage(w, asUser(httptest.NewRequest("POST", "/", bytes.NewReader(js)), tc.caller))
+		if w.Code != tc.status {
+			t.Errorf("%s: expected %d, got %d %s\n", tc.name, tc.status, w.Code, w.Body.String())
+		}
+	}
+
+	var chats map[string]interface{}
+	c.Shards["america"][0].RealtimeDB.NewRef("roots/scammer-hashirama/chats").Get(ctx, &chats)
+	if len(chats) != 0 {
+		t.Fatalf("expected no chats after refused requests, got %v\n", chats)
+	}
+
+	for _, caller := range []string{"cafe", "hashirama"} {
+		sender := caller + "-europe-1"
+		if caller == "hashirama" {
+			sender = "hashirama-america-1"
+		}
+		js, _ := json.Marshal([]*MessageRequest{chat(sender, group)})
+		w := httptest.NewRecorder()
+		c.ProcessMessage(w, asUser(httptest.NewRequest("POST", "/", bytes.NewReader(js)), caller))
+		if w.Code != 200 {
+			t.Fatalf("%s: expected 200 in the group, got %d %s\n", caller, w.Code, w.Body.String())
+		}
+	}
+	c.Shards["europe"][1].RealtimeDB.NewRef("roots/cafe/chats").Get(ctx, &chats)
+	if len(chats) != 2 {
+		t.Fatalf("expected 2 group chats, got %v\n", chats)
+	}
+
+	var queue map[string]interface{}
+	c.Shards["america"][1].RealtimeDB.NewRef("roots/hashirama/queues/phone").Get(ctx, &queue)
+	if len(queue) != 0 {
+		t.Fatalf("expected no refused push in the queue, got %v\n", queue)
+	}
+	for _, root := range []string{dual, group} {
+		sender, caller := "scammer-america-0", "scammer"
+		if root == group {
+			sender, caller = "cafe-europe-1", "cafe"
+		}
+		js, _ := json.Marshal([]*MessageRequest{push(sender, root, "hashirama-america-1")})
+		w := httptest.NewRecorder()
+		c.ProcessMessage(w, asUser(httptest.NewRequest("POST", "/", bytes.NewReader(js)), caller))
+		if w.Code != 200 {
+			t.Fatalf("%s: expected the push, got %d %s\n", root, w.Code, w.Body.String())
+		}
+	}
+	c.Shards["america"][1].RealtimeDB.NewRef("roots/hashirama/queues/phone").Get(ctx, &queue)
+	if len(queue) != 2 {
+		t.Fatalf("expected 2 pushes, got %v\n", queue)
+	}
+}
+
+func TestBoostAuth(t *testing.T) {
+	c := newTestServer(t)
+	b, _ := json.Marshal(testBoostRequest())
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/", bytes.NewReader(b))
+	c.HandleBoostRequest(w, asUser(r, "scammer"))
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), codeForbidden) {
+		t.Fatalf("expected 403 boosting as someone else, got %d %s\n", w.Code, w.Body.String())
+	}
+}
@@ -2,12 +2,20 @@ package backend
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
 	"net/http/httptest"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/mmcloughlin/geohash"
+	"google.golang.org/api/iterator"
 )
 
 type boostd struct {
@@ -15,127 +23,192 @@ type boostd struct {
 	perim  []latlon
 }
 
+func newTestServer(t *testing.T) *Server {
+	cfg, err := ParseConfig(defaultConfig)
+	if err != nil {
+		t.Fatalf("error parsing default config: %v\n", err)
+	}
+	c := NewMemoryServer(cfg)
+	// the partial tx of testBoostRequest spends 49049 sats
+	tx, _ := ParseTx(testPartialTx(t))
+	c.UTXOs.(*MemoryUTXOs).Add(tx.txins[0].txid, tx.txins[0].utxoIndex, p2pkhPrevout(t, tx.txins[0], 49049))
+	return c
+}
+
+func chatTargets() []*MessageTarget {
+	return []*MessageTarget{{
+		UserId:    "hashirama-america-1",
+		DeviceId:  "HKobPYpVoR1RxfXJt2CsJ64JuCX",
+		Token:     "e7blxHf6SHKTcjc-mF6La1:APA91bEmqrp1EOVvibwbdBf9QJ4fLQJzGApKbigTqrsiYPR7KZZMPW0MEUoWQeuqOG9xQOBqswww8uamb-wE5yMGD-mR_A7h9CgHJuNvVc71NA-tdexF-r97FAf1UW0kiTin2-10ouHB",
+		ShowNotif: true,
+		DoPush:    true,
+	}, {
+		UserId:    "scammer-america-0",
+		DeviceId:  "2VvkskVWSteL5duLxkyFmtBZXnHT",
+		Token:     "frZb09J2Sdm_kTbV8BCCrL:APA91bEJ4XVOglMtOV7-x2qgVJWhQGQmk3uIl6v0vtlak0XTpPiACS9LznYno--76tZTCvsnBjc0mYLDrzfhGCzMwN7daBiG0OHYZ7mDXze7PPbBuEacbe4kI-GZhSMKIeijERW68pof",
+		ShowNotif: true,
+		DoPush:    true,
+	}}
+}
+
 func TestProcessMessage(t *testing.T) {
+	ctx := context.Background()
+	c := newTestServer(t)
+
+	const root = "scammer-america-0-hashirama-america-1-r"
 	mqs := []*MessageRequest{{
-		Targets: []MessageTarget{{
-			UserId:    "hashirama-america-0r",
-			DeviceId:  "HKobPYpVoR1RxfXJt2CsJ64JuCX",
-			Token:     "e7blxHf6SHKTcjc-mF6La1:APA91bEmqrp1EOVvibwbdBf9QJ4fLQJzGApKbigTqrsiYPR7KZZMPW0MEUoWQeuqOG9xQOBqswww8uamb-wE5yMGD-mR_A7h9CgHJuNvVc71NA-tdexF-r97FAf1UW0kiTin2-10ouHB",
-			ShowNotif: true,
-			DoPush:    true,
-		}, {
-			UserId:    "scammer-america-0r",
-			DeviceId:  "2VvkskVWSteL5duLxkyFmtBZXnHT",
-			Token:     "frZb09J2Sdm_kTbV8BCCrL:APA91bEJ4XVOglMtOV7-x2qgVJWhQGQmk3uIl6v0vtlak0XTpPiACS9LznYno--76tZTCvsnBjc0mYLDrzfhGCzMwN7daBiG0OHYZ7mDXze7PPbBuEacbe4kI-GZhSMKIeijERW68pof",
-			ShowNotif: true,
-			DoPush:    true,
-		}},
+		Targets: chatTargets(),
 		Msg: map[string]string{
-			"id":        "ABCDEFG@scammer-america-0r^hashirama-america-0rc",
+			"id":        "ABCDEFG-" + root + "-c",
 			"type":      "chat",
-			"senderId":  "scammer-america-0r",
+			"senderId":  "scammer-america-0",
 			"tag":       "YmwogGuHRYW",
 			"txt":       "Holy molly, are you guys READY? WE NEED A NEW KING",
 			"timestamp": strconv.FormatInt(UnixMilli(), 10),
 		},
-		Push:   "",
 		Header: "Scammer",
 		Body:   "I will tell you right away: you can't talk before me",
-		Sender: "scammer-america-0r",
-		Root:   "scammer-america-0r^hashirama-america-0r",
-	},
-		{
-			Targets: []MessageTarget{{
-				UserId:    "hashirama-america-0r",
-				DeviceId:  "HKobPYpVoR1RxfXJt2CsJ64JuCX",
-				Token:     "e7blxHf6SHKTcjc-mF6La1:APA91bEmqrp1EOVvibwbdBf9QJ4fLQJzGApKbigTqrsiYPR7KZZMPW0MEUoWQeuqOG9xQOBqswww8uamb-wE5yMGD-mR_A7h9CgHJuNvVc71NA-tdexF-r97FAf1UW0kiTin2-10ouHB",
-				ShowNotif: true,
-				DoPush:    true,
-			}, {
-				UserId:    "scammer-america-0r",
-				DeviceId:  "2VvkskVWSteL5duLxkyFmtBZXnHT",
-				Token:     "frZb09J2Sdm_kTbV8BCCrL:APA91bEJ4XVOglMtOV7-x2qgVJWhQGQmk3uIl6v0vtlak0XTpPiACS9LznYno--76tZTCvsnBjc0mYLDrzfhGCzMwN7daBiG0OHYZ7mDXze7PPbBuEacbe4kI-GZhSMKIeijERW68pof",
-				ShowNotif: true,
-				DoPush:    true,
-			}},
-			Msg: map[string]string{
-				"id":        "jlkasdf@scammer-america-0r^hashirama-america-0rc",
-				"type":      "chat",
-				"senderId":  "hashirama-america-0r",
-				"tag":       "YmwogGuHRYW",
-				"txt":       "That is still the case: Listening to Flavour Trip ^_^",
-				"timestamp": strconv.FormatInt(UnixMilli(), 10),
-			},
-			Push:   "",
-			Header: "Hashirama",
-			Body:   "Degrowth is a scam",
-			Sender: "scammer-america-0r",
-			Root:   "scammer-america-0r^hashirama-america-0r",
+		Sender: "scammer-america-0",
+		Root:   root,
+	}, {
+		Targets: chatTargets(),
+		Msg: map[string]string{
+			"id":        "jlkasdf-" + root + "-c",
+			"type":      "chat",
+			"senderId":  "hashirama-america-1",
+			"tag":       "YmwogGuHRYW",
+			"txt":       "That is still the case: Listening to Flavour Trip ^_^",
+			"timestamp": strconv.FormatInt(UnixMilli(), 10),
 		},
-		{
-			Targets: []MessageTarget{{
-				UserId:    "hashirama-america-0r",
-				DeviceId:  "HKobPYpVoR1RxfXJt2CsJ64JuCX",
-				Token:     "e7blxHf6SHKTcjc-mF6La1:APA91bEmqrp1EOVvibwbdBf9QJ4fLQJzGApKbigTqrsiYPR7KZZMPW0MEUoWQeuqOG9xQOBqswww8uamb-wE5yMGD-mR_A7h9CgHJuNvVc71NA-tdexF-r97FAf1UW0kiTin2-10ouHB",
-				ShowNotif: true,
-				DoPush:    true,
-			}, {
-				UserId:    "scammer-america-0r",
-				DeviceId:  "2VvkskVWSteL5duLxkyFmtBZXnHT",
-				Token:     "frZb09J2Sdm_kTbV8BCCrL:APA91bEJ4XVOglMtOV7-x2qgVJWhQGQmk3uIl6v0vtlak0XTpPiACS9LznYno--76tZTCvsnBjc0mYLDrzfhGCzMwN7daBiG0OHYZ7mDXze7PPbBuEacbe4kI-GZhSMKIeijERW68pof",
-				ShowNotif: true,
-				DoPush:    true,
-			}},
-			Msg: map[string]string{
-				"id":        "jlkasdf@scammer-america-0r^hashirama-america-0rc",
-				"type":      "chat",
-				"senderId":  "hashirama-america-0r",
-				"tag":       "YmwogGuHRYW",
-				"txt":       "SCHIZO TIMELINE",
-				"timestamp": strconv.FormatInt(UnixMilli(), 10),
-			},
-			Push:   "",
-			Header: "Hashirama",
-			Body:   "There are actually 0 studies proving this",
-			Sender: "scammer-america-0r",
-			Root:   "scammer-america-0r^hashirama-america-0r",
+		Header: "Hashirama",
+		Body:   "Degrowth is a scam",
+		Sender: "hashirama-america-1",
+		Root:   root,
+	}, {
+		Targets: chatTargets(),
+		Msg: map[string]string{
+			"id":        "jlkasdf-" + root + "-c",
+			"type":      "chat",
+			"senderId":  "hashirama-america-1",
+			"tag":       "YmwogGuHRYW",
+			"txt":       "SCHIZO TIMELINE",
+			"timestamp": strconv.FormatInt(UnixMilli(), 10),
 		},
-	}
+		Header: "Hashirama",
+		Body:   "There are actually 0 studies proving this",
+		Sender: "hashirama-america-1",
+		Root:   root,
+	}}
 
-	// var wg sync.WaitGroup
 	for _, mq := range mqs {
-		//wg.Add(1)
-		//go func(mq_ *MessageRequest) {
-		//defer wg.Done()
-		js, _ := json.Marshal(mq)
+		js, _ := json.Marshal([]*MessageRequest{mq})
 		r := httptest.NewRequest("POST", "/", bytes.NewReader(js))
 		w := httptest.NewRecorder()
-		ProcessMessage(w, r)
-		//}(mq)
+		c.ProcessMessage(w, asUser(r, ParseRoot(mq.Sender)[0].Unik))
+		if w.Code != 200 {
+			t.Fatalf("unexpected response %d: %s\n", w.Code, w.Body.String())
+		}
+	}
+
+	rootRef := c.Shards["america"][0].RealtimeDB.NewRef("roots/scammer-hashirama")
+	var upper int
+	if err := rootRef.Child("connection/upperChat").Get(ctx, &upper); err != nil {
+		t.Fatalf("error getting upperChat: %v\n", err)
+	}
+	if upper != 2 {
+		t.Fatalf("expected upperChat=2, got %d\n", upper)
+	}
+
+	var chats map[string]map[string]string
+	if err := rootRef.Child("chats").Get(ctx, &chats); err != nil {
+		t.Fatalf("error getting chats: %v\n", err)
+	}
+	for i, mq := range mqs {
+		num := makeChatNumUnik(i)
+		chat, ok := chats[num]
+		if !ok {
+			t.Fatalf("missing chat #%s\n", num)
+		}
+		if chat["id"] != num+"-"+root+"-c" || chat["txt"] != mq.Msg["txt"] {
+			t.Fatalf("unexpected chat #%s: %v\n", num, chat)
+		}
+	}
+
+	// only the first chat of a root is pushed to the targets queues
+	var queue map[string]string
+	qpath := "roots/hashirama/queues/HKobPYpVoR1RxfXJt2CsJ64JuCX"
+	if err := c.Shards["america"][1].RealtimeDB.NewRef(qpath).Get(ctx, &queue); err != nil {
+		t.Fatalf("error getting queue: %v\n", err)
+	}
+	if len(queue) != 1 {
+		t.Fatalf("expected 1 push in hashirama's queue, got %v\n", queue)
+	}
+	for _, v := range queue {
+		if v != "m"+makeChatNumUnik(0)+"-"+root+"-c" {
+			t.Fatalf("unexpected push: %s\n", v)
+		}
+	}
+
+	sent := c.Messager.(*MemoryMessenger).Sent
+	if len(sent) != 2*len(mqs) {
+		t.Fatalf("expected %d notifications, got %d\n", 2*len(mqs), len(sent))
 	}
-	//	wg.Wait()
-	t.Log("We Are DONE")
 }
 
 func TestGetNodes(t *testing.T) {
-	uniques := "hashirama mafia scammer"
+	ctx := context.Background()
+	c := newTestServer(t)
 
+	docs := c.Firestore.(*MemoryDocs)
+	docs.Put("users", "hashirama", map[string]interface{}{"id": "hashirama-america-1"})
+	docs.Put("users", "scammer", map[string]interface{}{"id": "scammer-america-0"})
+
+	hashirama := map[string]interface{}{"name": "Hashirama", "mediaId": "pfp-america-1-m"}
+	if err := c.Shards["america"][1].RealtimeDB.NewRef("roots/hashirama/node").Set(ctx, hashirama); err != nil {
+		t.Fatalf("error setting node: %v\n", err)
+	}
+	scammer := map[string]interface{}{"name": "Scammer"}
+	if err := c.Shards["america"][0].RealtimeDB.NewRef("roots/scammer/node").Set(ctx, scammer); err != nil {
+		t.Fatalf("error setting node: %v\n", err)
+	}
+	wtr := c.Shards["america"][1].StaticBucket.NewWriter(ctx, "pfp", map[string]string{"ext": "png"})
+	wtr.Write([]byte("png"))
+	wtr.Close()
+
+	uniques := "hashirama mafia scammer"
 	body := bytes.NewReader([]byte(uniques))
 
 	r := httptest.NewRequest("POST", "/", body)
 	w := httptest.NewRecorder()
 
-	GetNodes(w, r)
+	c.GetNodes(w, r)
 
 	var rsp []map[string]interface{}
 	if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
 		t.Fatalf("error unmarshalling res: %v\n", err)
 	}
 
-	t.Logf("TestGetNodes: found %d nodes\n", len(rsp))
+	if len(rsp) != 2 {
+		t.Fatalf("expected 2 nodes, mafia doesn't exist, got %d\n", len(rsp))
+	}
 
-	for i, v := range rsp {
-		t.Logf("#%d -- node: %v\n", i, v)
+	for _, v := range rsp {
+		node := v["node"].(map[string]interface{})
+		switch node["name"] {
+		case "Hashirama":
+			if v["link"] != "memory://down4-26ee1-us2/pfp" {
+				t.Fatalf("unexpected link: %v\n", v["link"])
+			}
+			if md := v["metadata"].(map[string]interface{}); md["ext"] != "png" {
+				t.Fatalf("unexpected metadata: %v\n", md)
+			}
+		case "Scammer":
+			if _, ok := v["link"]; ok {
+				t.Fatalf("scammer has no media, got link: %v\n", v["link"])
+			}
+		default:
+			t.Fatalf("unexpected node: %v\n", node)
+		}
 	}
 }
 
@@ -151,8 +224,8 @@ func TestLayers(t *testing.T) {
 		Lon: -72.2507737118483,
 	}
 
-	jonesHash := geohash.EncodeWithPrecision(jonesPos.Lat, jonesPos.Lon, 4)
-	rugHash := geohash.EncodeWithPrecision(rugPos.Lat, rugPos.Lon, 4)
+	jonesHash := geohash.EncodeWithPrecision(jonesPos.Lat, jonesPos.Lon, maxPrecision)
+	rugHash := geohash.EncodeWithPrecision(rugPos.Lat, rugPos.Lon, maxPrecision)
 
 	t.Logf("jonesHash=%s\nrugHash=%s\n", jonesHash, rugHash)
 
@@ -163,76 +236,209 @@ func TestLayers(t *testing.T) {
 		},
 		Perim: []latlon{
 			{
-				Lat:     43.77231091565398,
-				Lon:     -72.2507737118483,
-				RefDist: 237.0617566126798,
+				Lat: 43.77231091565398,
+				Lon: -72.2507737118483,
 			},
 			{
-				Lat:     44.06251444297506,
-				Lon:     -73.7543096676021,
-				RefDist: 236.4707305606959,
+				Lat: 44.06251444297506,
+				Lon: -73.7543096676021,
 			},
 			{
-				Lat:     44.848147251478814,
-				Lon:     -74.85497437822046,
-				RefDist: 234.8581857803903,
+				Lat: 44.848147251478814,
+				Lon: -74.85497437822046,
 			},
 			{
-				Lat:     45.904258512242286,
-				Lon:     -75.25784562335588,
-				RefDist: 232.6615328018019,
+				Lat: 45.904258512242286,
+				Lon: -75.25784562335588,
 			},
 			{
-				Lat:     46.940654121329025,
-				Lon:     -74.85497437822046,
-				RefDist: 230.47345405250886,
+				Lat: 46.940654121329025,
+				Lon: -74.85497437822046,
 			},
 			{
-				Lat:     47.686868561809305,
-				Lon:     -73.7543096676021,
-				RefDist: 228.87801053290622,
+				Lat: 47.686868561809305,
+				Lon: -73.7543096676021,
 			},
 			{
-				Lat:     47.9573693727533,
-				Lon:     -72.2507737118483,
-				RefDist: 228.29551152766882,
+				Lat: 47.9573693727533,
+				Lon: -72.2507737118483,
 			},
 			{
-				Lat:     47.686868561809305,
-				Lon:     -70.74723775609455,
-				RefDist: 228.87801053290406,
+				Lat: 47.686868561809305,
+				Lon: -70.74723775609455,
 			},
 			{
-				Lat:     46.940654121329025,
-				Lon:     -69.64657304547613,
-				RefDist: 230.47345405250886,
+				Lat: 46.940654121329025,
+				Lon: -69.64657304547613,
 			},
 			{
-				Lat:     45.904258512242286,
-				Lon:     -69.24370180034076,
-				RefDist: 232.6615328017986,
+				Lat: 45.904258512242286,
+				Lon: -69.24370180034076,
 			},
 			{
-				Lat:     44.848147251478814,
-				Lon:     -69.64657304547613,
-				RefDist: 234.8581857803903,
+				Lat: 44.848147251478814,
+				Lon: -69.64657304547613,
 			},
 			{
-				Lat:     44.06251444297506,
-				Lon:     -70.74723775609453,
-				RefDist: 236.47073056069428,
+				Lat: 44.06251444297506,
+				Lon: -70.74723775609453,
 			},
 		},
 	}
-	layers := calcLayers2(a)
+	layers := cellPacks(a.cover(coverCells))
 	t.Logf("layers: %v\n", layers)
+	var flat []string
+	for _, l := range layers {
+		if len(l) > 10 {
+			t.Fatalf("expected packs of at most 10 cells, got %d\n", len(l))
+		}
+		for _, c := range l {
+			if len(c) != len(l[0]) {
+				t.Fatalf("expected packs of a single precision, got %v\n", l)
+			}
+		}
+		flat = append(flat, l...)
+	}
+	if len(flat) > coverCells {
+		t.Fatalf("expected at most %d cells, got %d\n", coverCells, len(flat))
+	}
+	covered := func(h string) bool {
+		return Any(flat, func(c string) bool { return strings.HasPrefix(h, c) })
+	}
+	if !covered(jonesHash) || !covered(rugHash) || !strings.HasPrefix(rugHash, flat[0]) {
+		t.Fatalf("expected %s first and %s in the cover, got %v\n", rugHash, jonesHash, flat)
+	}
+	if !a.contains(jonesPos) || !a.contains(rugPos) {
+		t.Fatal("expected jones and rug in the area")
+	}
+}
+
+func TestScanArea(t *testing.T) {
+	ctx := context.Background()
+	c := newTestServer(t)
+	docs := c.Firestore.(*MemoryDocs)
+
+	// more users than a page in a single cell, farther the higher i is
+	center := latlon{Lat: 48.8465, Lon: -67.5271}
+	n := queryPage*2 + 50
+	for i := 0; i < n; i++ {
+		lat := center.Lat + float64(i)*0.00001
+		doc := geohashes(lat, center.Lon)
+		doc["id"], doc["latitude"], doc["longitude"] = fmt.Sprintf("u%03d-america-0", i), lat, center.Lon
+		doc["age"], doc["gender"] = 20+i%10, []string{"male", "female"}[i%2]
+		docs.Put("users", fmt.Sprintf("u%03d", i), doc)
+	}
+	br := &boostRequest2{MinAge: 18, MaxAge: 39, Genders: []string{"male", "female"}, Limit: n}
+	a := area{Type: areaCircle, Center: center, RadiusKm: 5}
 
+	qs := br.planQueries(a.cover(coverCells))
+	if len(qs) != 2*len(cellPacks(a.cover(coverCells))) {
+		t.Fatalf("expected a query per pack and gender, got %d\n", len(qs))
+	}
+	for _, q := range qs {
+		if ins := len(Filter(q.Filters, func(f DocFilter) bool { return f.Op == "in" })); ins != 1 {
+			t.Fatalf("expected a single in filter, got %d\n", ins)
+		}
+	}
+	if len((&boostRequest2{}).planQueries([]string{"f2xv"})) != 1 {
+		t.Fatal("expected a single query for any gender")
+	}
+
+	users, left, err := c.scanArea(ctx, br, a, n, nil)
+	if err != nil || len(users) != n || left != 0 {
+		t.Fatalf("expected every %d users across pages, got %d\n", n, len(users))
+	}
+	lim := queryPage + 20
+	users, left, err = c.scanArea(ctx, br, a, lim, nil)
+	if err != nil || len(users) != lim || left != 0 {
+		t.Fatalf("expected %d users, got %d\n", lim, len(users))
+	}
+	for i, usr := range users {
+		if want := fmt.Sprintf("u%03d-america-0", i); usr.Id != want {
+			t.Fatalf("expected the nearest users first, got %s at %d\n", usr.Id, i)
+		}
+	}
+
+	// more queries than run at once, the nearest user is in the last one
+	genders := make([]string, queryParallelism+1)
+	for i := range genders {
+		genders[i] = "g" + strconv.Itoa(i)
+		lat := center.Lat
+		if i < queryParallelism {
+			lat += 0.0005 + float64(i)*0.00001
+		}
+		doc := geohashes(lat, center.Lon)
+		doc["id"], doc["latitude"], doc["longitude"] = genders[i]+"-america-0", lat, center.Lon
+		doc["age"], doc["gender"] = 20, genders[i]
+		docs.Put("users", genders[i], doc)
+	}
+	br.Genders = genders
+	if users, _, err := c.scanArea(ctx, br, a, 1, nil); err != nil || len(users) != 1 || users[0].Id != genders[queryParallelism]+"-america-0" {
+		t.Fatalf("expected the nearest user whatever query finds it, got %v: %v\n", users, err)
+	}
+
+	// queries are ordered by age, the nearest user is kept even when younger
+	// ones are in range
+	c2 := newTestServer(t)
+	for _, u := range []struct {
+		unik string
+		lat  float64
+		age  int
+	}{{"near", center.Lat, 30}, {"far", center.Lat + 0.003, 20}} {
+		doc := geohashes(u.lat, center.Lon)
+		doc["id"], doc["latitude"], doc["longitude"] = u.unik+"-america-0", u.lat, center.Lon
+		doc["age"], doc["gender"] = u.age, "male"
+		c2.Firestore.(*MemoryDocs).Put("users", u.unik, doc)
+	}
+	byAge := &boostRequest2{MinAge: 18, MaxAge: 39, Genders: []string{"male"}, Limit: 1}
+	if users, _, err := c2.scanArea(ctx, byAge, a, 1, nil); err != nil || len(users) != 1 || users[0].Id != "near-america-0" {
+		t.Fatalf("expected the nearest user over the youngest, got %v: %v\n", users, err)
+	}
+
+	// firestore takes a single in filter
+	q := br.buildQuery([]string{"f2xv"}, nil)
+	q.Filters = append(q.Filters, DocFilter{Path: "gender", Op: "in", Value: br.Genders})
+	if _, err := docs.Query(ctx, q).Next(); err == nil || err == iterator.Done {
+		t.Fatalf("expected two in filters to fail, got %v\n", err)
+	}
 }
 
-func TestBoostRequest(t *testing.T) {
-	br := &boostRequest2{
+// failingDocs fails every query
+type failingDocs struct{ DocumentStore }
+
+func (f failingDocs) Query(ctx context.Context, q *DocQuery) DocumentIterator {
+	return &memIter{err: errors.New("firestore is down")}
+}
+
+func TestBoostQueryFailure(t *testing.T) {
+	c := newTestServer(t)
+	seedBoostUsers(c.Firestore.(*MemoryDocs))
+	c.Firestore = failingDocs{c.Firestore}
+
+	b, _ := json.Marshal(testBoostRequest())
+	for _, path := range []string{"/boost", "/boost/dryrun"} {
+		w := httptest.NewRecorder()
+		r := asUser(httptest.NewRequest("POST", path, bytes.NewReader(b)), "jones")
+		if path == "/boost" {
+			c.HandleBoostRequest(w, r)
+		} else {
+			c.HandleBoostDryRun(w, r)
+		}
+		var res struct{ Error *Error }
+		json.Unmarshal(w.Body.Bytes(), &res)
+		if w.Code != http.StatusBadGateway || res.Error == nil || res.Error.Code != codeQueryFailed || !res.Error.Retryable {
+			t.Fatalf("%s: expected a retryable %s, got %d %s\n", path, codeQueryFailed, w.Code, w.Body.String())
+		}
+	}
+	if sent := c.Broadcaster.(*MockBroadcaster).Sent; len(sent) != 0 {
+		t.Fatalf("expected nothing broadcast, got %d txs\n", len(sent))
+	}
+}
+
+func testBoostRequest() *boostRequest2 {
+	return &boostRequest2{
 		Token:        "fTC-jAgkRGK95ie31zipgX:APA91bH3_I-g_diBliCsk9wX19E_p0Y02u2jkNqZI-RCVIMqX49xJr6pI5yykqsLvPbraVIhl_UMOIuH7MdR5KsCujK_LYLMgzZ3l-1K-bAVtP9FTjnGalHaqO7OtNEiskQ5K4CggVyj",
-		SenderID:     "jones~america~1",
+		SenderID:     "jones-america-1",
 		DeviceID:     "KrFECXUhBZA/rhCHFLIklw==",
 		Limit:        1000,
 		PricePerHead: 100,
@@ -255,74 +461,356 @@ func TestBoostRequest(t *testing.T) {
 				},
 				Perim: []latlon{
 					{
-						Lat:     48.819904753395235,
-						Lon:     -67.52709923696294,
-						RefDist: 2.960546488526211,
+						Lat: 48.819904753395235,
+						Lon: -67.52709923696294,
 					},
 					{
-						Lat:     48.82770445201567,
-						Lon:     -67.55570009028744,
-						RefDist: 2.9603160596871154,
+						Lat: 48.82770445201567,
+						Lon: -67.55570009028744,
 					},
 					{
-						Lat:     48.84652958761982,
-						Lon:     -67.5675469516299,
-						RefDist: 2.9597598031002152,
+						Lat: 48.84652958761982,
+						Lon: -67.5675469516299,
 					},
 					{
-						Lat:     48.86534764900105,
-						Lon:     -67.55570009028744,
-						RefDist: 2.9592036142658196,
+						Lat: 48.86534764900105,
+						Lon: -67.55570009028744,
 					},
 					{
-						Lat:     48.873140273399045,
-						Lon:     -67.52709923696294,
-						RefDist: 2.958973253182349,
+						Lat: 48.873140273399045,
+						Lon: -67.52709923696294,
 					},
 					{
-						Lat:     48.86534764900105,
-						Lon:     -67.49849838363843,
-						RefDist: 2.9592036142658196,
+						Lat: 48.86534764900105,
+						Lon: -67.49849838363843,
 					},
 					{
-						Lat:     48.84652958761982,
-						Lon:     -67.48665152229599,
-						RefDist: 2.9597598031002152,
+						Lat: 48.84652958761982,
+						Lon: -67.48665152229599,
 					},
 					{
-						Lat:     48.82770445201567,
-						Lon:     -67.49849838363843,
-						RefDist: 2.9603160596871154,
+						Lat: 48.82770445201567,
+						Lon: -67.49849838363843,
 					},
 				},
 			},
 		},
 		BoostMessage: map[string]interface{}{
-			"id":        "-Nnpq_X7qoB4XGPyXDqo~america~0",
+			"id":        "-Nnpq_X7qoB4XGPyXDqo-america-0",
 			"type":      "chat",
-			"senderID":  "jones~america~1",
+			"senderID":  "jones-america-1",
 			"root":      "boost",
 			"nodes":     "",
 			"txt":       "Bonne main d'applaudissement.",
 			"timestamp": "1704932605217",
 		},
 	}
+}
 
+// seeds users around the center of the testBoostRequest area, only the
+// returned ones are valid targets
+func seedBoostUsers(docs *MemoryDocs) []string {
+	type seed struct {
+		unik     string
+		lat, lon float64
+		age      int
+		gender   string
+	}
+	seeds := []seed{
+		{"rimouski-america-0", 48.8465, -67.5271, 25, "male"},
+		{"bic-america-1", 48.8500, -67.5300, 30, "female"},
+		{"cote-europe-0", 48.8400, -67.5200, 19, ""},
+		{"old-america-0", 48.8465, -67.5271, 50, "male"},      // too old
+		{"far-america-1", 48.9500, -67.5271, 25, "female"},    // ~11km north
+		{"robot-asia-0", 48.8465, -67.5271, 25, "non-binary"}, // gender
+	}
+	for _, s := range seeds {
+		doc := geohashes(s.lat, s.lon)
+		doc["id"], doc["latitude"], doc["longitude"] = s.unik, s.lat, s.lon
+		doc["age"], doc["gender"], doc["token"] = s.age, s.gender, "token-"+s.unik
+		docs.Put("users", ParseRoot(s.unik)[0].Unik, doc)
+	}
+	return []string{"rimouski-america-0", "bic-america-1", "cote-europe-0"}
+}
+
+func TestBoostRequest(t *testing.T) {
+	ctx := context.Background()
+	c := newTestServer(t)
+	targets := seedBoostUsers(c.Firestore.(*MemoryDocs))
+
+	// the targets are in both areas, they are boosted once
+	br := testBoostRequest()
+	br.Areas = append(br.Areas, area{Type: areaCircle, Center: br.Areas[0].Center, RadiusKm: 5})
 	b, _ := json.Marshal(br)
 	body := bytes.NewReader(b)
 	w := httptest.NewRecorder()
 	r := httptest.NewRequest("POST", "/", body)
 
-	HandleBoostRequest(w, r)
+	c.HandleBoostRequest(w, asUser(r, "jones"))
 
-	var rsp []map[string]interface{}
-	if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
-		t.Fatalf("error unmarshalling res: %v\n", err)
+	var res boostResult
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || w.Code != 200 {
+		t.Fatalf("unexpected response %d: %s\n", w.Code, w.Body.String())
+	}
+	if res.Targets != len(targets) {
+		t.Fatalf("expected %d targets, got %d\n", len(targets), res.Targets)
+	}
+
+	sent := c.Broadcaster.(*MockBroadcaster).Sent
+	if len(sent) != 1 {
+		t.Fatalf("expected 1 broadcasted tx, got %d\n", len(sent))
+	}
+	tx, err := ParseTx(sent[0])
+	if err != nil {
+		t.Fatalf("error parsing broadcasted tx: %v\n", err)
+	}
+	if len(tx.txouts) != len(targets)+1 {
+		t.Fatalf("expected %d outputs, got %d\n", len(targets)+1, len(tx.txouts))
+	}
+	if res.Txid != explorerTxid(tx.Txid()) {
+		t.Fatalf("expected txid %s, got %s\n", explorerTxid(tx.Txid()), res.Txid)
+	}
+
+	var status map[string]interface{}
+	shrd, _ := c.txShard(explorerTxid(tx.Txid()))
+	shrd.RealtimeDB.NewRef("txs/"+explorerTxid(tx.Txid())).Get(ctx, &status)
+	if status["sender"] != br.SenderID || status["status"] != TxSeen || status["provider"] != providerMock {
+		t.Fatalf("unexpected tx status %v\n", status)
+	}
+
+	// every target is queued its own output
+	outs := map[int]bool{}
+	for _, id := range targets {
+		cp := ParseRoot(id)[0]
+		var q map[string]int
+		ref := c.Shards[cp.Region][cp.Shard].RealtimeDB.NewRef("nodes/" + cp.Unik + "/queues/boost")
+		if err := ref.Get(ctx, &q); err != nil {
+			t.Fatalf("error getting boost queue: %v\n", err)
+		}
+		if len(q) != 1 {
+			t.Fatalf("expected 1 boost for %s, got %v\n", id, q)
+		}
+		for _, i := range q {
+			if i < 0 || i >= len(targets) || outs[i] {
+				t.Fatalf("unexpected output %d for %s\n", i, id)
+			}
+			outs[i] = true
+		}
+	}
+
+	var sq map[string]string
+	ref := c.Shards["america"][1].RealtimeDB.NewRef("roots/jones/queues/" + br.DeviceID)
+	if err := ref.Get(ctx, &sq); err != nil {
+		t.Fatalf("error getting sender queue: %v\n", err)
+	}
+	for _, v := range sq {
+		if v != tx.TxidHex()+"@"+strconv.Itoa(len(targets)) {
+			t.Fatalf("unexpected sender push: %s\n", v)
+		}
+	}
+	if len(sq) != 1 {
+		t.Fatalf("expected 1 push to sender, got %v\n", sq)
+	}
+
+	if sent := c.Messager.(*MemoryMessenger).Sent; len(sent) != 1 || sent[0].Token != br.Token {
+		t.Fatalf("expected 1 notification to sender, got %v\n", sent)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	cfg, err := ParseConfig(defaultConfig)
+	if err != nil {
+		t.Fatalf("error parsing default config: %v\n", err)
+	}
+	if len(cfg.Regions) != 3 || len(cfg.Regions["america"]) != 2 {
+		t.Fatalf("unexpected default topology: %v\n", cfg.Regions)
+	}
+
+	threeShards := `{"regions": {"america": [
+		{"databaseURL": "http://localhost:9000/?ns=us1", "tempBucket": "us1-tmp", "staticBucket": "us1"},
+		{"databaseURL": "http://localhost:9000/?ns=us2", "tempBucket": "us2-tmp", "staticBucket": "us2"},
+		{"databaseURL": "http://localhost:9000/?ns=us3", "tempBucket": "us3-tmp", "staticBucket": "us3"}
+	]}}`
+	cfg, err = ParseConfig([]byte(threeShards))
+	if err != nil {
+		t.Fatalf("error parsing three shard config: %v\n", err)
+	}
+	if len(cfg.Regions["america"]) != 3 {
+		t.Fatalf("expected 3 shards in america, got %d\n", len(cfg.Regions["america"]))
+	}
+
+	invalids := map[string]string{
+		"no regions":    `{"regions": {}}`,
+		"no shards":     `{"regions": {"america": []}}`,
+		"hyphen region": `{"regions": {"north-america": [{"databaseURL": "https://a.io", "tempBucket": "a-tmp", "staticBucket": "a"}]}}`,
+		"bad url":       `{"regions": {"america": [{"databaseURL": "a.io", "tempBucket": "a-tmp", "staticBucket": "a"}]}}`,
+		"no bucket":     `{"regions": {"america": [{"databaseURL": "https://a.io", "tempBucket": "a-tmp"}]}}`,
+		"dup bucket":    `{"regions": {"america": [{"databaseURL": "https://a.io", "tempBucket": "a", "staticBucket": "a"}]}}`,
+		"not json":      `regions: america`,
+		"negative ttl":  `{"boostTTLHours": -1, "regions": {"america": [{"databaseURL": "https://a.io", "tempBucket": "a-tmp", "staticBucket": "a"}]}}`,
 	}
+	for name, raw := range invalids {
+		if _, err := ParseConfig([]byte(raw)); err == nil {
+			t.Errorf("%s: expected an error\n", name)
+		}
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	ctx := context.Background()
+	if _, err := NewServer(ctx, nil); err == nil {
+		t.Fatal("expected an error for a nil config")
+	}
+	if _, err := NewServer(ctx, &Config{}); err == nil {
+		t.Fatal("expected an error for a config without regions")
+	}
+
+	// memory servers don't share state
+	a, b := newTestServer(t), newTestServer(t)
+	ref := "roots/hashirama/node"
+	a.Shards["america"][0].RealtimeDB.NewRef(ref).Set(ctx, map[string]string{"name": "a"})
+	var node map[string]string
+	b.Shards["america"][0].RealtimeDB.NewRef(ref).Get(ctx, &node)
+	if node != nil {
+		t.Fatalf("expected isolated servers, got %v\n", node)
+	}
+}
+
+type errReader struct{}
 
-	ids := Map(rsp, func(e map[string]interface{}) string {
-		return e["Id"].(string)
-	})
+func (errReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestHandlerErrors(t *testing.T) {
+	c := newTestServer(t)
+	seedBoostUsers(c.Firestore.(*MemoryDocs))
+
+	rejecting := func(reason string) Broadcaster {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(reason))
+		}))
+		t.Cleanup(srv.Close)
+		return &WhatsOnChainBroadcaster{BaseURL: srv.URL}
+	}
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	boostBody := func(f func(br *boostRequest2)) io.Reader {
+		br := testBoostRequest()
+		f(br)
+		b, _ := json.Marshal(br)
+		return bytes.NewReader(b)
+	}
+
+	cases := []struct {
+		name      string
+		handler   http.HandlerFunc
+		body      io.Reader
+		miner     Broadcaster
+		status    int
+		code      string
+		retryable bool
+	}{
+		{"boost bad json", c.HandleBoostRequest, strings.NewReader("{"), nil, 400, codeInvalidJson, false},
+		{"boost bad tx", c.HandleBoostRequest, boostBody(func(br *boostRequest2) {
+			br.PartialTx = "not base64"
+		}), nil, 400, codeInvalidRequest, false},
+		{"boost truncated tx", c.HandleBoostRequest, boostBody(func(br *boostRequest2) {
+			br.PartialTx = br.PartialTx[:40]
+		}), nil, 400, codeInvalidRequest, false},
+		{"boost bad change address", c.HandleBoostRequest, boostBody(func(br *boostRequest2) {
+			br.ChangeAddress = "AAEC"
+		}), nil, 400, codeInvalidAddress, false},
+		{"boost change address of mainnet", c.HandleBoostRequest, boostBody(func(br *boostRequest2) {
+			pkh, _ := Testnet.DecodeAddress(br.ChangeAddress)
+			br.ChangeAddress = Mainnet.EncodeAddress(pkh)
+		}), nil, 400, codeInvalidAddress, false},
+		{"boost no targets", c.HandleBoostRequest, boostBody(func(br *boostRequest2) {
+			br.MinAge, br.MaxAge = 90, 99
+		}), nil, 404, codeNoBoostTargets, false},
+		{"boost rejected", c.HandleBoostRequest, boostBody(func(*boostRequest2) {}),
+			rejecting("16: mandatory-script-verify-flag-failed"), 502, codeBroadcastFailed, false},
+		{"boost double spend", c.HandleBoostRequest, boostBody(func(*boostRequest2) {}),
+			rejecting("unexpected response code 500: 258: txn-mempool-conflict"), 409, codeDoubleSpend, false},
+		{"boost broadcaster down", c.HandleBoostRequest, boostBody(func(*boostRequest2) {}),
+			&WhatsOnChainBroadcaster{BaseURL: down.URL}, 502, codeBroadcastFailed, true},
+		{"message bad json", c.ProcessMessage, strings.NewReader(`{"msg": 1}`), nil, 400, codeInvalidJson, false},
+		{"nodes unreadable body", c.GetNodes, errReader{}, nil, 400, codeInvalidRequest, false},
+	}
 
-	t.Log(ids)
+	for _, tc := range cases {
+		c.Broadcaster = tc.miner
+		r := httptest.NewRequest("POST", "/", tc.body)
+		w := httptest.NewRecorder()
+		tc.handler(w, asUser(r, "jones"))
+
+		if w.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d\n", tc.name, tc.status, w.Code)
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: expected json content type, got %s\n", tc.name, ct)
+		}
+		var rsp struct {
+			Error Error `json:"error"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+			t.Errorf("%s: error decoding error response: %v\n", tc.name, err)
+			continue
+		}
+		if rsp.Error.Code != tc.code || rsp.Error.Retryable != tc.retryable || len(rsp.Error.Message) == 0 {
+			t.Errorf("%s: unexpected error: %+v\n", tc.name, rsp.Error)
+		}
+	}
+}
+
+func TestRouter(t *testing.T) {
+	c := newTestServer(t)
+	key := withTestKeySet(c)
+	token := signToken(t, key, testKid, testClaims("jones", time.Now()))
+	h := c.Handler(1024)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	var hl health
+	if err := json.Unmarshal(w.Body.Bytes(), &hl); err != nil || w.Code != 200 {
+		t.Fatalf("unexpected healthz %d: %s\n", w.Code, w.Body.String())
+	}
+	if hl.Status != "ok" || len(hl.Shards) != 6 {
+		t.Fatalf("unexpected health: %+v\n", hl)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/boost", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d\n", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	big := bytes.NewReader(bytes.Repeat([]byte(" "), 2048))
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/messages", big))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d\n", w.Code)
+	}
+
+	// no content length, the limit kicks in while decoding
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/messages", io.MultiReader(strings.NewReader("["), big))
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.ContentLength = -1
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 while streaming, got %d\n", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/nodes", strings.NewReader("nobody"))
+	r.Header.Set("Authorization", "Bearer "+token)
+	h.ServeHTTP(w, r)
+	if w.Code != 200 || strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Fatalf("unexpected nodes response %d: %s\n", w.Code, w.Body.String())
+	}
 }
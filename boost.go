@@ -10,33 +10,26 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"math"
 	"math/rand"
 	"net/http"
+	"sort"
 	"strconv"
+	"sync"
 
-	"cloud.google.com/go/firestore"
 	"github.com/btcsuite/btcd/btcutil/base58"
-	"github.com/mmcloughlin/geohash"
+	"google.golang.org/api/iterator"
 )
 
-const taal_api_key = "testnet_3860616b1cf1bb23110db44440f65899"
-
 type latlon struct {
-	Lat     float64 `json:"lat"`
-	Lon     float64 `json:"lon"`
-	RefDist float64 `json:"refDist"`
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
 }
 
+// precision of the geohash field older clients write, see geohashes
 const precision = 4
 
-func init() {
-	ctx := context.Background()
-	ServerInit(ctx)
-}
-
 func geoDist(ll1, ll2 latlon) float64 {
 	lat1, lon1, lat2, lon2 := ll1.Lat, ll1.Lon, ll2.Lat, ll2.Lon
 	R := 6371.0                   // Radius of the earth in km
@@ -77,115 +70,19 @@ func radToDeg(rad float64) float64 {
 	return rad * 180.0 / math.Pi
 }
 
-func closest(l []latlon, p latlon) latlon {
-	ix, smallDist := int(0), math.MaxFloat64
-	for i, x := range l {
-		dist := geoDist(x, p)
-		if dist < smallDist {
-			smallDist = dist
-			ix = i
-		}
-	}
-	return l[ix]
-}
-
-func closest2(l []latlon, p latlon) []latlon {
-	ix, smallDist := int(0), math.MaxFloat64
-	ix2, smallDist2 := int(0), math.MaxFloat64
-	for i, x := range l {
-		dist := geoDist(x, p)
-		if dist < smallDist {
-			smallDist = dist
-			ix = i
-		}
-		if dist > smallDist && dist < smallDist2 {
-			smallDist2 = dist
-			ix2 = i
-		}
-	}
-	return []latlon{l[ix], l[ix2]}
-}
-
-func validHash3(a area, hash string) bool {
-	box := geohash.BoundingBox(hash)
-	bclat, bclon := box.Center()
-	boxCenter := latlon{Lat: bclat, Lon: bclon}
-	bounds := []latlon{
-		{Lat: box.MaxLat, Lon: box.MaxLng},
-		{Lat: box.MaxLat, Lon: box.MinLng},
-		{Lat: box.MinLat, Lon: box.MaxLng},
-		{Lat: box.MinLat, Lon: box.MinLng},
-	}
-
-	twoClosest := closest2(a.Perim, boxCenter)
-	for _, b := range bounds {
-		valid := Any(twoClosest, func(ll latlon) bool {
-			return geoDist(b, a.Center) < ll.RefDist
-		})
-		if valid {
-			return true
-		}
-	}
-	return false
-}
-
-func calcLayers2(a area) [][]string {
-	clat, clon := a.Center.Lat, a.Center.Lon
-	centerHash := geohash.EncodeWithPrecision(clat, clon, precision)
-	layers := [][]string{{centerHash}}
-	flat := []string{centerHash}
-
-	var getLayers func([]string) [][]string
-	getLayers = func(l []string) [][]string {
-		curLayer := make([]string, 0)
-		for _, e := range l {
-			nbs := geohash.Neighbors(e)
-			for _, nb := range nbs {
-				if !Contains(nb, flat) && validHash3(a, nb) {
-					flat = append(flat, nb)
-					curLayer = append(curLayer, nb)
-				}
-			}
-		}
-
-		nValid := len(curLayer)
-		if nValid > 0 {
-			layers = append(layers, curLayer)
-		} else {
-			return layers
-		}
-
-		if nValid > len(l) {
-			return getLayers(curLayer)
-		} else {
-			return layers
-		}
-
-	}
-
-	getLayers(layers[0])
-
-	// required for firestore...
-	packOfTens, ilay := [][]string{{}}, int(0)
-	for _, ll := range layers {
-		for _, l := range ll {
-			if len(packOfTens[ilay]) < 10 {
-				packOfTens[ilay] = append(packOfTens[ilay], l)
-			} else {
-				packOfTens = append(packOfTens, []string{})
-				ilay++
-				packOfTens[ilay] = append(packOfTens[ilay], l)
-			}
+// cellPacks splits cells in packs of ten of the same precision, the most
+// a firestore in filter takes, in the order of their first cell
+func cellPacks(cells []string) [][]string {
+	packs, filling := [][]string{}, map[int]int{}
+	for _, c := range cells {
+		i, ok := filling[len(c)]
+		if !ok || len(packs[i]) == 10 {
+			i, filling[len(c)] = len(packs), len(packs)
+			packs = append(packs, make([]string, 0, 10))
 		}
+		packs[i] = append(packs[i], c)
 	}
-
-	return packOfTens
-
-}
-
-type area struct {
-	Center latlon   `json:"center"`
-	Perim  []latlon `json:"perim"`
+	return packs
 }
 
 type boostRequest2 struct {
@@ -207,29 +104,54 @@ type boostRequest2 struct {
 	MediaPayload  string                 `json:"mediaPayload"`
 }
 
-func (br *boostRequest2) buildQuery(c *firestore.Client, layer []string, lim int) *firestore.Query {
-	q := c.Collection("users").
-		Where("age", "<=", br.MaxAge).
-		Where("age", ">=", br.MinAge).
-		Where("gender", "in", br.Genders).
-		Where("geohash", "in", layer).
-		Limit(lim)
-	return &q
+// buildQuery finds the users of a pack of cells, of gender when it isn't
+// nil. They are ordered by age, the field of the range filter, and id so
+// pages of the query can start after the last user of the previous one
+func (br *boostRequest2) buildQuery(layer []string, gender *string) *DocQuery {
+	filters := []DocFilter{
+		{Path: "age", Op: "<=", Value: br.MaxAge},
+		{Path: "age", Op: ">=", Value: br.MinAge},
+		{Path: geohashField(len(layer[0])), Op: "in", Value: layer},
+	}
+	if gender != nil {
+		filters = append(filters, DocFilter{Path: "gender", Op: "==", Value: *gender})
+	}
+	return &DocQuery{Collection: "users", Filters: filters, OrderBy: []string{"age", "id"}}
+}
+
+// planQueries splits the users of cells in queries firestore takes. A query
+// has a single in filter, the one on cells, so a pack is queried once per
+// gender. No genders is any gender. Queries come in the order of the cells
+func (br *boostRequest2) planQueries(cells []string) []*DocQuery {
+	qs := make([]*DocQuery, 0)
+	for _, pack := range cellPacks(cells) {
+		if len(br.Genders) == 0 {
+			qs = append(qs, br.buildQuery(pack, nil))
+		}
+		for i := range br.Genders {
+			qs = append(qs, br.buildQuery(pack, &br.Genders[i]))
+		}
+	}
+	return qs
 }
 
 type user struct {
 	Lat    float64 `firestore:"latitude"`
 	Lon    float64 `firestore:"longitude"`
+	Age    int     `firestore:"age"`
 	Id     string  `firestore:"id"`
 	Token  string  `firestore:"token"`
 	Neuter string  `firestore:"neuter"`
 }
 
-func writeBoosts(ctx context.Context, users []*user, br *boostRequest2) ([]error, int) {
+// writeBoosts writes a boosts/<unik> node per pack of targets and queues it
+// to them, the packs come back in order with how many targets were reached.
+// users come from scanAreas once each, each is queued a single output
+func (s *Server) writeBoosts(ctx context.Context, users []*user, br *boostRequest2, campaignId string) []*CampaignPack {
 	const packSize int = 20000
 	nUsers := len(users)
 	nPacks := int(math.Ceil(float64(nUsers) / float64(packSize)))
-	ch, errs := make(chan error, nPacks), make([]error, nPacks)
+	ch, packs := make(chan struct{}, nPacks), make([]*CampaignPack, nPacks)
 	prfx := satsPrefix(br.PricePerHead)
 	var rawMedia []byte
 	if len(br.MediaPayload) > 0 {
@@ -238,6 +160,7 @@ func writeBoosts(ctx context.Context, users []*user, br *boostRequest2) ([]error
 
 	for i := 0; i < nPacks; i++ {
 		go func(j int) {
+			defer func() { ch <- struct{}{} }()
 			packStart := int64(j * packSize)
 			var packEnd int
 			if j == nPacks-1 {
@@ -246,22 +169,35 @@ func writeBoosts(ctx context.Context, users []*user, br *boostRequest2) ([]error
 				packEnd = (j + 1) * packSize
 			}
 
+			pack := &CampaignPack{Start: int(packStart), End: packEnd}
+			packs[j] = pack
+
+			// users of a region we don't serve are skipped when queueing
 			m := map[string]int{}
 			r := func(m map[string]int, u *user) map[string]int {
 				id := ParseRoot(u.Id)[0]
-				m[id.Region]++
+				if len(s.Shards[id.Region]) > 0 {
+					m[id.Region]++
+				}
 				return m
 
 			}
 
 			areaMap := Reduce(users[packStart:packEnd], m, r)
-			reg, ishrd := MaxKey(areaMap), rand.Int()%N_SHARD
+			reg := MaxKey(areaMap)
+			if len(s.Shards[reg]) == 0 {
+				pack.Error = "no shard for the regions of the targets"
+				log.Printf("error writing boost pack %d of campaign %s: %s\n", j, campaignId, pack.Error)
+				return
+			}
+			ishrd := rand.Intn(len(s.Shards[reg]))
 
-			shrd := Client.Shards[reg][ishrd]
+			shrd := s.Shards[reg][ishrd]
 			rbuf := RandomBytes(16)
 			unik := base58.Encode(rbuf)
 			boostId := ComposedId{Unik: unik, Region: reg, Shard: ishrd}
 			boostIdStr := boostId.ToString()
+			pack.BoostId = boostIdStr
 
 			payload := make(map[string]interface{})
 			CopyMap(br.BoostMessage, payload)
@@ -269,10 +205,12 @@ func writeBoosts(ctx context.Context, users []*user, br *boostRequest2) ([]error
 			payload["sats"] = br.PricePerHead
 			payload["packStart"] = packStart
 			payload["packEnd"] = packEnd
+			payload["sender"] = br.SenderID
+			payload["campaign"] = campaignId
 
 			err := shrd.RealtimeDB.NewRef("boosts/"+unik).Set(ctx, payload)
 			if err != nil {
-				ch <- err
+				pack.Error = err.Error()
 				return
 			}
 
@@ -280,43 +218,41 @@ func writeBoosts(ctx context.Context, users []*user, br *boostRequest2) ([]error
 				munik := base58.Encode(RandomBytes(16))
 				cpMid := ComposedId{Unik: munik, Region: reg, Shard: ishrd}
 				midStr := cpMid.ToString() + "m"
-				obj := shrd.TempBucket.Object(midStr)
 				mtdt := make(map[string]string, len(br.Media))
 				CopyMap(br.Media, mtdt)
 				mtdt["id"] = midStr
-				wtr := obj.NewWriter(ctx)
-				wtr.Metadata = mtdt
+				wtr := shrd.TempBucket.NewWriter(ctx, midStr, mtdt)
 				wtr.Write(rawMedia)
 				if err = wtr.Close(); err != nil {
 					log.Printf("error writing boost rawMedia: %v\n", err)
-					ch <- err
+					pack.Error = err.Error()
 					return
 				}
 			}
 
-			for _, usr := range users[j*packSize : packEnd] {
+			// the queue entry is the output of the user, what they claim
+			for k, usr := range users[j*packSize : packEnd] {
 				cp := ParseRoot(usr.Id)[0]
+				ushrd, err := s.ServerShard(cp)
 				if err != nil {
 					msg := fmt.Sprintf("invalid user root=%v", usr.Id)
 					NonFatal(err, msg)
 					continue
 				}
-				db := cp.ServerShard().RealtimeDB
-				k := prfx + "%" + boostIdStr
-				pth := "nodes/" + cp.Unik + "/queues/boost/" + k
-				err = db.NewRef(pth).Set(ctx, "")
-
+				pth := "nodes/" + cp.Unik + "/queues/boost/" + prfx + "%" + boostIdStr
+				if err = ushrd.RealtimeDB.NewRef(pth).Set(ctx, j*packSize+k); err != nil {
+					NonFatal(err, "error queueing boost to "+usr.Id)
+					continue
+				}
+				pack.Delivered++
 			}
-			ch <- nil
 		}(i)
 	}
 
 	for i := 0; i < nPacks; i++ {
-		if err := <-ch; err != nil {
-			errs = append(errs, err)
-		}
+		<-ch
 	}
-	return errs, nPacks
+	return packs
 }
 
 func satsPrefix(sats int) string {
@@ -335,154 +271,308 @@ func satsPrefix(sats int) string {
 	return prfx
 }
 
-func HandleBoostRequest(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
+// checkTargeting validates what both boosts and dry runs need
+func (br *boostRequest2) checkTargeting() error {
+	if br.PricePerHead <= 0 {
+		return badRequest(codeInvalidRequest, fmt.Sprintf("invalid price per head: %v", br.PricePerHead), nil)
+	}
+	if br.PricePerHead > math.MaxUint32 {
+		msg := fmt.Sprintf("price per head exceeds maximum amount of 42 bsv: %v", br.PricePerHead)
+		return badRequest(codeInvalidRequest, msg, nil)
+	}
+	if br.Limit <= 0 || br.Limit > maxBoostOutputs {
+		return badRequest(codeInvalidRequest, fmt.Sprintf("invalid limit: %v", br.Limit), nil)
+	}
+	if len(br.Areas) == 0 {
+		return badRequest(codeInvalidRequest, "no areas to boost", nil)
+	}
+	for i, a := range br.Areas {
+		if err := a.Validate(); err != nil {
+			return badRequest(codeInvalidRequest, fmt.Sprintf("invalid area %d", i), err)
+		}
+	}
+	return nil
+}
+
+type boostResult struct {
+	Txid     string `json:"txid"`
+	Targets  int    `json:"targets"`
+	Campaign string `json:"campaign"`
+}
+
+func (s *Server) HandleBoostRequest(w http.ResponseWriter, r *http.Request) {
+	res, err := s.handleBoostRequest(context.Background(), r)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	writeJson(w, res)
+}
 
+func (s *Server) handleBoostRequest(ctx context.Context, r *http.Request) (*boostResult, error) {
 	var br boostRequest2
-	err := json.NewDecoder(r.Body).Decode(&br)
-	Fatal(err, "error decoding boostRequest")
+	if err := json.NewDecoder(r.Body).Decode(&br); err != nil {
+		return nil, bodyError(codeInvalidJson, "error decoding boostRequest", err)
+	}
 
-	if br.PricePerHead > math.MaxUint32 {
-		log.Fatalf("price per head exceeds maximum amount of 42 bsv: %v\n", br.PricePerHead)
+	id, err := identityFrom(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	if !id.is(br.SenderID) {
+		return nil, forbidden("sender " + br.SenderID + " is not the caller")
+	}
+
+	if err := br.checkTargeting(); err != nil {
+		return nil, err
 	}
 
 	txbuf, err := base64.StdEncoding.DecodeString(br.PartialTx)
-	Fatal(err, "error decoding base64 partial tx")
+	if err != nil {
+		return nil, badRequest(codeInvalidRequest, "error decoding base64 partial tx", err)
+	}
 
 	s1, err := base64.StdEncoding.DecodeString(br.S1)
-	Fatal(err, "error decoding base64 s1")
+	if err != nil {
+		return nil, badRequest(codeInvalidRequest, "error decoding base64 s1", err)
+	}
 
-	addr, err := base64.StdEncoding.DecodeString(br.ChangeAddress)
-	Fatal(err, "error decoding base64 change address")
+	addr, err := s.Network.DecodeAddress(br.ChangeAddress)
+	if err != nil {
+		return nil, badRequest(codeInvalidAddress, "error decoding change address", err)
+	}
 
-	tx := TxFromRdr(bytes.NewReader(txbuf))
+	tx, err := ParseTx(txbuf)
+	if err != nil {
+		return nil, badRequest(codeInvalidRequest, "error parsing partial tx", err)
+	}
+	prevouts, inSats, err := resolvePrevouts(ctx, s.UTXOs, tx)
+	if errors.Is(err, errUnknownUTXO) {
+		return nil, badRequest(codeInvalidTx, "partial tx spends an unknown utxo", err)
+	} else if errors.Is(err, errDuplicateInput) {
+		return nil, badRequest(codeInvalidTx, "partial tx spends an output twice", err)
+	} else if err != nil {
+		return nil, badGateway(codeUTXOLookupFailed, "error looking up partial tx inputs", true, err)
+	}
+	if inSats != uint64(br.InputSats) {
+		msg := fmt.Sprintf("inputSats is %d but the partial tx spends %d", br.InputSats, inSats)
+		return nil, badRequest(codeInvalidTx, msg, nil)
+	}
+	if err := tx.VerifyInputs(prevouts); err != nil {
+		return nil, badRequest(codeInvalidTx, "partial tx isn't signed for its inputs", err)
+	}
 	log.Printf("tx pre boost\n%v", tx.Formatted())
 
-	lim := br.Limit
-	users := make([]*user, 0, lim)
-
-	for _, a := range br.Areas {
-		usrs, newlim := scanArea(ctx, &br, a, lim)
-		users = append(users, usrs...)
-		lim = newlim
-		if lim == 0 {
-			break
-		}
+	// an output per recipient, scanAreas finds each once
+	users, _, err := s.scanAreas(ctx, &br)
+	if err != nil {
+		return nil, badGateway(codeQueryFailed, "error finding boost targets", true, err)
 	}
-
-	nOuts := br.Limit - lim
+	nOuts := len(users)
 	if nOuts == 0 {
-		log.Fatalln("error, haven't found any people to boost")
+		return nil, notFound(codeNoBoostTargets, "haven't found any people to boost", nil)
 	}
 
-	rdyTx := BoostScript(tx, s1, nOuts, br.PricePerHead, br.InputSats, addr)
+	rdyTx, err := BoostScript(tx, s1, nOuts, br.PricePerHead, int(inSats), addr, s.FeePolicy(ctx))
+	if errors.Is(err, errUnderfunded) {
+		return nil, badRequest(codeUnderfunded, "inputs don't cover the boost", err)
+	} else if err != nil {
+		return nil, badRequest(codeInvalidRequest, "error building boost tx", err)
+	}
+	// a signature covering the outputs (sighash all) breaks once we add ours
+	if err := rdyTx.VerifyInputs(prevouts); err != nil {
+		return nil, badRequest(codeInvalidTx, "partial tx signature doesn't allow the boost outputs", err)
+	}
 	rawTx := rdyTx.Raw()
 	rawTxHex, txid := hex.EncodeToString(rawTx), Txid(rawTx)
 	txidHex := hex.EncodeToString(txid)
 	log.Printf("ready tx\n%v", rdyTx.Formatted())
-	// rawTxHex := hex.EncodeToString(rdyTx.Raw())
 	log.Printf("raw hex tx\n%v\n", rawTxHex)
-	// txHexRdr := strings.NewReader(rawTxHex)
-	txPayload := map[string]interface{}{"txhex": rawTxHex}
-	// txPayload := map[string]interface{}{"rawTx": rawTxHex}
-	// txPayload := map[string]interface{}{"raw": rawTxHex}
-	rawPayload, err := json.Marshal(txPayload)
-	Fatal(err, "err marshalling txPayload")
-	payloadRdr := bytes.NewReader(rawPayload)
-
-	// const url string = "https://test-api.bitails.io/tx/broadcast"
-	const url string = "https://api.whatsonchain.com/v1/bsv/test/tx/raw"
-	// const url string = "https://api.taal.com/api/v1/broadcast"
-	// req, err := http.NewRequest("POST", url, payloadRdr)
-	// req.Header = map[string][]string{
-	// 	"Content-Type": {"application/json"},
-	// 	"Authorization": {"Bearer " + taal_api_key},
-	// }
-	// rsp, err := http.DefaultClient.Do(req)
-
-	rsp, err := http.Post(url, "application/json", payloadRdr)
-	Fatal(err, "error posting tx to miners")
-	if rsp.StatusCode != 200 {
-		rbuf, err := io.ReadAll(rsp.Body)
-		Fatal(err, "error reading response buffer")
-		log.Fatalf("error broadcasting tx: %s\n", string(rbuf))
-	}
-
-	var rjson map[string]interface{}
-	err = json.NewDecoder(rsp.Body).Decode(&rjson)
-	Fatal(err, "error decoding response")
-	// txid := rjson["txid"].(string)
-	status, ok := rjson["status"].(int)
-	if !ok {
-		log.Fatalln("error finding response status")
-	}
-
-	if status != 200 {
-		title, detail := rjson["title"], rjson["detail"]
-		log.Fatalf("%s\n%d\n%s\n", title, status, detail)
-	}
-
-	errs, nPacks := writeBoosts(ctx, users, &br)
-	if len(errs) == nPacks {
-		log.Fatalf("every boost failed, err1=%v\n", errs[0])
+
+	// the campaign is written first, a tx out there always has one
+	camp := newCampaign(&br, explorerTxid(txid), nOuts, s.BoostTTL)
+	if err := s.createCampaign(ctx, camp); err != nil {
+		return nil, internal(codeWriteFailed, "error creating campaign", err)
+	}
+	advance := func(status string, packs []*CampaignPack) {
+		_, err := s.updateCampaign(ctx, camp.Sender, camp.Id, func(c *Campaign) error {
+			if packs != nil {
+				c.Packs = packs
+			}
+			return c.advance(status)
+		})
+		NonFatal(err, "error moving campaign "+camp.Id+" to "+status)
+	}
+
+	bres, err := s.Broadcaster.Broadcast(ctx, rawTx)
+	if err != nil {
+		advance(CampaignFailed, nil)
+		return nil, broadcastError(err)
+	}
+	advance(CampaignBroadcast, nil)
+	extra := map[string]interface{}{"sender": br.SenderID, "campaign": camp.Id}
+	if err := s.recordTxStatus(ctx, bres, extra); err != nil {
+		NonFatal(err, "error recording boost tx status")
+	}
+
+	packs := s.writeBoosts(ctx, users, &br, camp.Id)
+	if !Any(packs, func(p *CampaignPack) bool { return p.Delivered > 0 }) {
+		// it stays broadcast, with the errors of its packs
+		_, err := s.updateCampaign(ctx, camp.Sender, camp.Id, func(c *Campaign) error {
+			c.Packs = packs
+			return nil
+		})
+		NonFatal(err, "error saving packs of campaign "+camp.Id)
+		// the tx is out already, retrying would pay twice
+		e := internal(codeWriteFailed, "every boost failed", errors.New(packs[0].Error))
+		e.Retryable = false
+		return nil, e
 	}
+	advance(CampaignDelivered, packs)
 
 	// change index is -> nOuts + 1 - 1 -> nOuts
 	pushPayload := txidHex + "@" + strconv.FormatInt(int64(nOuts), 10)
-	rp := PushData(ctx, br.SenderID, br.DeviceID, pushPayload)
-	if rp != nil  {
-		Fatal(errors.New("error pushing data after boost request"), "")
+	if rp := s.PushData(ctx, br.SenderID, br.DeviceID, pushPayload); rp != nil {
+		log.Printf("not fatal, could not push boost result to sender %s\n", br.SenderID)
 	}
 
 	header, body := "Completed Boost", fmt.Sprintf("Found %v targets", nOuts)
-	err = PushNotification(ctx, br.Token, body, header, "", "")
+	err = s.PushNotification(ctx, br.Token, body, header, "", "")
 	if err != nil {
 		log.Printf("not fatal, could not push notification to receipient: %v\n", err)
 	}
+
+	return &boostResult{Txid: camp.Txid, Targets: nOuts, Campaign: camp.Id}, nil
 }
 
-func scanArea(ctx context.Context, b *boostRequest2, a area, lim int) ([]*user, int) {
-	layers := calcLayers2(a)
-	fmt.Printf("layers: %v\n", layers)
+// scanAreas finds up to b.Limit targets in the areas of b, in order and
+// once each, with how many each area gave. A user in overlapping areas is a target of the
+// first one only, later areas look for others. Targets found by queries that
+// failed aren't the ones the targeting asked for, there is none on errors
+func (s *Server) scanAreas(ctx context.Context, b *boostRequest2) ([]*user, []int, error) {
+	lim := b.Limit
+	users, reach := make([]*user, 0, lim), make([]int, len(b.Areas))
+	seen := map[string]bool{}
+	for i, a := range b.Areas {
+		if lim <= 0 {
+			break
+		}
+		usrs, newlim, err := s.scanArea(ctx, b, a, lim, seen)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error scanning area %d: %v", i, err)
+		}
+		for _, usr := range usrs {
+			seen[usr.Id] = true
+		}
+		users, reach[i], lim = append(users, usrs...), len(usrs), newlim
+	}
+	return users, reach, nil
+}
 
-	users := make([]*user, 0, lim)
-	var curlim int = lim
+// scanArea runs the queries of the area, queryParallelism at once, and
+// keeps the lim users nearest to its center that aren't in seen. Queries
+// are ordered by age, not distance, so every query reads all its users
+// before they are sorted by distance, a user of a farther cell can be
+// nearer than the ones of the cells before too. It fails when any query does
+func (s *Server) scanArea(ctx context.Context, b *boostRequest2, a area, lim int, seen map[string]bool) ([]*user, int, error) {
+	shp, err := a.shape()
+	if err != nil {
+		return nil, lim, err
+	}
+	qs := b.planQueries(a.cover(coverCells))
+
+	found, errs := make([][]*user, len(qs)), make([]error, len(qs))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, queryParallelism)
+	for i, q := range qs {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, q *DocQuery) {
+			defer func() { <-sem; wg.Done() }()
+			usrs, err := s.runQuery(ctx, q, shp, seen)
+			found[i], errs[i] = usrs, err
+		}(i, q)
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, lim, err
+	}
 
-	for _, layer := range layers {
-		la, li := layer, curlim
-		q := b.buildQuery(Client.Firestore, la, li)
-		it := q.Documents(ctx)
-		for {
-			var usr user
-			doc, err := it.Next()
-			if err != nil {
-				break
-			}
+	users := nearestUsers(a.center(), found, lim)
+	fmt.Printf("we found %v users for the boost in %d queries\n", len(users), len(qs))
+	return users, lim - len(users), nil
+}
 
-			if err = doc.DataTo(&usr); err != nil {
-				break
-			}
+// queries run at most that many at once and read queryPage users a page
+const (
+	queryParallelism = 8
+	queryPage        = 100
+)
 
-			cl2 := closest2(a.Perim, latlon{Lat: usr.Lat, Lon: usr.Lon})
-			usrDist := geoDist(latlon{Lat: usr.Lat, Lon: usr.Lon}, a.Center)
+// runQuery reads every page of q and keeps the users in shp and not in
+// seen, it returns what it found before an error
+func (s *Server) runQuery(ctx context.Context, q *DocQuery, shp shape, seen map[string]bool) ([]*user, error) {
+	users := make([]*user, 0)
+	var cursor []interface{}
+	for {
+		page := *q
+		page.StartAfter, page.Limit = cursor, queryPage
+		n, err := s.readPage(ctx, &page, func(usr *user) {
+			cursor = []interface{}{usr.Age, usr.Id}
+			if !seen[usr.Id] && shp.contains(latlon{Lat: usr.Lat, Lon: usr.Lon}) {
+				users = append(users, usr)
+			}
+		})
+		if err != nil {
+			return users, err
+		} else if n < queryPage {
+			break
+		}
+	}
+	return users, nil
+}
 
-			valid := Any(cl2, func(ll latlon) bool {
-				return usrDist <= ll.RefDist
-			})
+func (s *Server) readPage(ctx context.Context, q *DocQuery, f func(*user)) (int, error) {
+	it := s.Firestore.Query(ctx, q)
+	defer it.Stop()
+	n := 0
+	for {
+		doc, err := it.Next()
+		if err == iterator.Done {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		n++
+		var usr user
+		if err := doc.DataTo(&usr); err != nil {
+			return n, fmt.Errorf("error decoding user: %v", err)
+		}
+		f(&usr)
+	}
+}
 
-			if valid {
-				users = append(users, &usr)
-				curlim--
-				if curlim == 0 {
-					break
-				}
+// nearestUsers merges the users of every query, once each, and keeps the
+// lim nearest to center
+func nearestUsers(center latlon, found [][]*user, lim int) []*user {
+	seen, users := map[string]bool{}, make([]*user, 0)
+	dist := map[*user]float64{}
+	for _, usrs := range found {
+		for _, usr := range usrs {
+			if !seen[usr.Id] {
+				seen[usr.Id], dist[usr] = true, geoDist(center, latlon{Lat: usr.Lat, Lon: usr.Lon})
+				users = append(users, usr)
 			}
 		}
-
-		if curlim == 0 {
-			break
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if dist[users[i]] != dist[users[j]] {
+			return dist[users[i]] < dist[users[j]]
 		}
+		return users[i].Id < users[j].Id
+	})
+	if len(users) > lim {
+		users = users[:lim]
 	}
-	fmt.Printf("we found %v users for the boost\n", len(users))
-	return users, curlim
+	return users
 }
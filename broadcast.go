@@ -0,0 +1,395 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	rtdb "firebase.google.com/go/v4/db"
+)
+
+// statuses of a broadcasted tx, ARC has finer ones, see arcStatus
+const (
+	TxAccepted = "accepted" // a provider took it, not seen on the network yet
+	TxSeen     = "seen"     // in mempools
+	TxMined    = "mined"
+	TxRejected = "rejected"
+)
+
+// BroadcastResult is what a provider answered for a tx, Txid is in explorer
+// order like every provider prints it
+type BroadcastResult struct {
+	Txid        string `json:"txid"`
+	Status      string `json:"status"`
+	DoubleSpend bool   `json:"doubleSpend"`
+	Provider    string `json:"provider"`
+}
+
+// BroadcastError is a provider failing to take a tx. Retryable failures
+// (timeouts, 5xx, rate limits) are worth another try, the others are the
+// tx being refused and no provider will take it
+type BroadcastError struct {
+	Provider    string
+	Retryable   bool
+	DoubleSpend bool
+	Message     string
+	Err         error
+}
+
+func (e *BroadcastError) Error() string {
+	msg := e.Provider + ": " + e.Message
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *BroadcastError) Unwrap() error {
+	return e.Err
+}
+
+type Broadcaster interface {
+	Broadcast(ctx context.Context, rawTx []byte) (*BroadcastResult, error)
+}
+
+// MultiBroadcaster tries Providers in order, each one is retried Retries
+// times on retryable failures, with a doubling Backoff, before falling back
+// on the next. A provider refusing the tx ends it there
+type MultiBroadcaster struct {
+	Providers []Broadcaster
+	Retries   int
+	Backoff   time.Duration
+}
+
+func (m *MultiBroadcaster) Broadcast(ctx context.Context, rawTx []byte) (*BroadcastResult, error) {
+	if len(m.Providers) == 0 {
+		return nil, errors.New("no broadcast providers")
+	}
+	var err error
+	for _, p := range m.Providers {
+		backoff := m.Backoff
+		for try := 0; try <= m.Retries; try++ {
+			var res *BroadcastResult
+			if res, err = p.Broadcast(ctx, rawTx); err == nil {
+				return res, nil
+			}
+			var be *BroadcastError
+			if errors.As(err, &be) && !be.Retryable {
+				return res, err
+			}
+			log.Printf("error broadcasting, try %d: %v\n", try+1, err)
+			if try == m.Retries {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+	}
+	return nil, err
+}
+
+func doBroadcast(ctx context.Context, c *http.Client, provider string, req *http.Request) (int, []byte, error) {
+	if c == nil {
+		c = http.DefaultClient
+	}
+	rsp, err := c.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, nil, &BroadcastError{Provider: provider, Retryable: true, Message: "error posting tx", Err: err}
+	}
+	defer rsp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(rsp.Body, 1<<20))
+	if err != nil {
+		return 0, nil, &BroadcastError{Provider: provider, Retryable: true, Message: "error reading response", Err: err}
+	}
+	return rsp.StatusCode, body, nil
+}
+
+func retryableStatus(code int) bool {
+	return code >= 500 || code == http.StatusTooManyRequests || code == http.StatusRequestTimeout
+}
+
+// WhatsOnChainBroadcaster posts to the whatsonchain raw tx endpoint, which
+// answers the quoted txid or the node's reject reason as text
+type WhatsOnChainBroadcaster struct {
+	BaseURL string // like https://api.whatsonchain.com/v1/bsv/main
+	APIKey  string
+	Client  *http.Client
+}
+
+const providerWhatsOnChain = "whatsonchain"
+
+// node reject reasons, the mempool ones mean the inputs are spent already.
+// Missing inputs are no double spend, the parent tx may just not have
+// reached the node yet, so they're retried
+var (
+	doubleSpendReasons   = []string{"txn-mempool-conflict", "bad-txns-inputs-spent", "txn-double-spend-detected"}
+	missingInputsReasons = []string{"missing-inputs", "missing inputs"}
+	alreadyKnownReasons  = []string{"txn-already-known", "already in the mempool", "txn-already-in-mempool"}
+)
+
+func containsAny(s string, subs []string) bool {
+	s = strings.ToLower(s)
+	return Any(subs, func(sub string) bool { return strings.Contains(s, sub) })
+}
+
+func (w *WhatsOnChainBroadcaster) Broadcast(ctx context.Context, rawTx []byte) (*BroadcastResult, error) {
+	payload, _ := json.Marshal(map[string]string{"txhex": hex.EncodeToString(rawTx)})
+	req, err := http.NewRequest("POST", strings.TrimSuffix(w.BaseURL, "/")+"/tx/raw", bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(w.APIKey) > 0 {
+		req.Header.Set("woc-api-key", w.APIKey)
+	}
+
+	status, body, err := doBroadcast(ctx, w.Client, providerWhatsOnChain, req)
+	if err != nil {
+		return nil, err
+	}
+	res := &BroadcastResult{Txid: explorerTxid(Txid(rawTx)), Status: TxSeen, Provider: providerWhatsOnChain}
+	if status == 200 {
+		var txid string
+		if err := json.Unmarshal(body, &txid); err != nil || txid != res.Txid {
+			log.Printf("whatsonchain answered %s for tx %s\n", string(body), res.Txid)
+		}
+		return res, nil
+	}
+
+	reason := strings.TrimSpace(string(body))
+	if containsAny(reason, alreadyKnownReasons) {
+		return res, nil
+	}
+	res.Status, res.DoubleSpend = TxRejected, containsAny(reason, doubleSpendReasons)
+	return res, &BroadcastError{
+		Provider:    providerWhatsOnChain,
+		Retryable:   retryableStatus(status) || containsAny(reason, missingInputsReasons),
+		DoubleSpend: res.DoubleSpend,
+		Message:     fmt.Sprintf("%d %s", status, reason),
+	}
+}
+
+// ARCBroadcaster posts to an ARC endpoint (TAAL, GorillaPool...), with
+// CallbackURL set ARC posts every later status of the tx there, see
+// HandleBroadcastCallback. It also quotes fees, see FeePolicy
+type ARCBroadcaster struct {
+	BaseURL       string // like https://arc.taal.com
+	APIKey        string
+	CallbackURL   string
+	CallbackToken string
+	Client        *http.Client
+
+	mu       sync.Mutex
+	policy   *FeePolicy
+	policyAt time.Time
+}
+
+const providerARC = "arc"
+
+// arcResponse is both what /v1/tx answers and what ARC posts to callbacks
+type arcResponse struct {
+	Txid         string   `json:"txid"`
+	TxStatus     string   `json:"txStatus"`
+	Status       int      `json:"status"`
+	Title        string   `json:"title"`
+	Detail       string   `json:"detail"`
+	ExtraInfo    string   `json:"extraInfo"`
+	CompetingTxs []string `json:"competingTxs"`
+}
+
+// arcStatus maps ARC tx statuses to ours
+func arcStatus(txStatus string) string {
+	switch txStatus {
+	case "SEEN_ON_NETWORK", "SEEN_IN_ORPHAN_MEMPOOL", "ACCEPTED_BY_NETWORK":
+		return TxSeen
+	case "MINED":
+		return TxMined
+	case "REJECTED", "DOUBLE_SPEND_ATTEMPTED":
+		return TxRejected
+	default: // QUEUED, RECEIVED, STORED, ANNOUNCED_TO_NETWORK, SENT_TO_NETWORK...
+		return TxAccepted
+	}
+}
+
+func (a *arcResponse) result() *BroadcastResult {
+	return &BroadcastResult{
+		Txid:        a.Txid,
+		Status:      arcStatus(a.TxStatus),
+		DoubleSpend: a.TxStatus == "DOUBLE_SPEND_ATTEMPTED" || len(a.CompetingTxs) > 0,
+		Provider:    providerARC,
+	}
+}
+
+func (a *ARCBroadcaster) Broadcast(ctx context.Context, rawTx []byte) (*BroadcastResult, error) {
+	payload, _ := json.Marshal(map[string]string{"rawTx": hex.EncodeToString(rawTx)})
+	req, err := http.NewRequest("POST", strings.TrimSuffix(a.BaseURL, "/")+"/v1/tx", bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(a.APIKey) > 0 {
+		req.Header.Set("Authorization", "Bearer "+a.APIKey)
+	}
+	if len(a.CallbackURL) > 0 {
+		req.Header.Set("X-CallbackUrl", a.CallbackURL)
+		req.Header.Set("X-CallbackToken", a.CallbackToken)
+	}
+
+	status, body, err := doBroadcast(ctx, a.Client, providerARC, req)
+	if err != nil {
+		return nil, err
+	}
+	var ar arcResponse
+	if err := json.Unmarshal(body, &ar); err != nil {
+		return nil, &BroadcastError{
+			Provider:  providerARC,
+			Retryable: retryableStatus(status),
+			Message:   fmt.Sprintf("%d %s", status, string(body)),
+		}
+	}
+	if len(ar.Txid) == 0 {
+		ar.Txid = explorerTxid(Txid(rawTx))
+	}
+	res := ar.result()
+	if status == 200 && res.Status != TxRejected {
+		return res, nil
+	}
+	res.Status = TxRejected
+	return res, &BroadcastError{
+		Provider:    providerARC,
+		Retryable:   retryableStatus(status),
+		DoubleSpend: res.DoubleSpend,
+		Message:     fmt.Sprintf("%d %s %s %s %s", status, ar.Title, ar.TxStatus, ar.Detail, ar.ExtraInfo),
+	}
+}
+
+// MockBroadcaster takes every tx in process, a tx spending an outpoint
+// another tx spent already is refused as a double spend. Err, when set,
+// fails every broadcast, and Fees is its fee quote
+type MockBroadcaster struct {
+	mu    sync.Mutex
+	Sent  [][]byte
+	spent map[string]string
+	Err   error
+	Fees  *FeePolicy
+}
+
+const providerMock = "mock"
+
+func NewMockBroadcaster() *MockBroadcaster {
+	return &MockBroadcaster{spent: map[string]string{}}
+}
+
+func (m *MockBroadcaster) Broadcast(ctx context.Context, rawTx []byte) (*BroadcastResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Err != nil {
+		return nil, m.Err
+	}
+	tx, err := ParseTx(rawTx)
+	if err != nil {
+		return nil, &BroadcastError{Provider: providerMock, Message: "invalid tx", Err: err}
+	}
+	res := &BroadcastResult{Txid: explorerTxid(tx.Txid()), Status: TxSeen, Provider: providerMock}
+	for _, tin := range tx.txins {
+		if by, ok := m.spent[outpoint(tin.txid, tin.utxoIndex)]; ok && by != res.Txid {
+			res.Status, res.DoubleSpend = TxRejected, true
+			return res, &BroadcastError{Provider: providerMock, DoubleSpend: true, Message: "txn-mempool-conflict"}
+		}
+	}
+	for _, tin := range tx.txins {
+		m.spent[outpoint(tin.txid, tin.utxoIndex)] = res.Txid
+	}
+	m.Sent = append(m.Sent, rawTx)
+	return res, nil
+}
+
+// broadcastError is how handlers answer a failed broadcast, a double spend
+// won't go through by retrying, the client needs other inputs
+func broadcastError(err error) *Error {
+	msg := "error broadcasting tx: " + err.Error()
+	var be *BroadcastError
+	if !errors.As(err, &be) {
+		return badGateway(codeBroadcastFailed, msg, true, err)
+	}
+	if be.DoubleSpend {
+		return &Error{Status: http.StatusConflict, Code: codeDoubleSpend, Message: msg, Err: err}
+	}
+	return badGateway(codeBroadcastFailed, msg, be.Retryable, err)
+}
+
+// txs/<txid> keeps the last status of the txs we broadcast, they all live
+// on one shard picked from the txid so callbacks find them without a sender
+func (s *Server) txShard(txid string) (ServerShard, error) {
+	regs := make([]string, 0, len(s.Shards))
+	for reg := range s.Shards {
+		regs = append(regs, reg)
+	}
+	if len(regs) == 0 {
+		return ServerShard{}, errors.New("no shards")
+	}
+	sort.Strings(regs)
+	var h int
+	for _, c := range []byte(txid) {
+		h = (h*31 + int(c)) % 1000003
+	}
+	reg := regs[h%len(regs)]
+	return s.Shards[reg][h%len(s.Shards[reg])], nil
+}
+
+func (s *Server) recordTxStatus(ctx context.Context, res *BroadcastResult, extra map[string]interface{}) error {
+	shrd, err := s.txShard(res.Txid)
+	if err != nil {
+		return err
+	}
+	ref := shrd.RealtimeDB.NewRef("txs/" + res.Txid)
+	return ref.Transaction(ctx, func(tn rtdb.TransactionNode) (interface{}, error) {
+		var cur map[string]interface{}
+		if err := tn.Unmarshal(&cur); err != nil || cur == nil {
+			cur = map[string]interface{}{}
+		}
+		CopyMap(extra, cur)
+		cur["status"], cur["doubleSpend"], cur["provider"] = res.Status, res.DoubleSpend, res.Provider
+		cur["updatedAt"] = time.Now().UnixMilli()
+		return cur, nil
+	})
+}
+
+// HandleBroadcastCallback takes the status updates ARC posts for the txs
+// broadcast with a callback url, they carry the callback token as bearer
+func (s *Server) HandleBroadcastCallback(w http.ResponseWriter, r *http.Request) {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if len(s.CallbackToken) == 0 || subtle.ConstantTimeCompare([]byte(token), []byte(s.CallbackToken)) != 1 {
+		WriteError(w, unauthenticated("invalid callback token", nil))
+		return
+	}
+	var ar arcResponse
+	if err := json.NewDecoder(r.Body).Decode(&ar); err != nil {
+		WriteError(w, bodyError(codeInvalidJson, "error decoding callback", err))
+		return
+	}
+	if _, err := hex.DecodeString(ar.Txid); err != nil || len(ar.Txid) != 64 {
+		WriteError(w, badRequest(codeInvalidRequest, "invalid callback txid "+ar.Txid, err))
+		return
+	}
+	if err := s.recordTxStatus(r.Context(), ar.result(), nil); err != nil {
+		WriteError(w, internal(codeWriteFailed, "error recording tx status", err))
+		return
+	}
+	writeJson(w, map[string]string{"status": "ok"})
+}
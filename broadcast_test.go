@@ -0,0 +1,300 @@
+package backend
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type broadcastFunc func(ctx context.Context, rawTx []byte) (*BroadcastResult, error)
+
+func (f broadcastFunc) Broadcast(ctx context.Context, rawTx []byte) (*BroadcastResult, error) {
+	return f(ctx, rawTx)
+}
+
+func TestMultiBroadcaster(t *testing.T) {
+	ctx := context.Background()
+	raw := testFundingTx(t).Raw()
+
+	calls := map[string]int{}
+	provider := func(name string, errs ...error) Broadcaster {
+		return broadcastFunc(func(ctx context.Context, rawTx []byte) (*BroadcastResult, error) {
+			i := calls[name]
+			calls[name]++
+			if i < len(errs) && errs[i] != nil {
+				return nil, errs[i]
+			}
+			return &BroadcastResult{Txid: explorerTxid(Txid(rawTx)), Status: TxSeen, Provider: name}, nil
+		})
+	}
+	flaky := &BroadcastError{Provider: "flaky", Retryable: true, Message: "503"}
+	refused := &BroadcastError{Provider: "strict", Message: "400 bad-txns"}
+
+	cases := []struct {
+		name      string
+		providers []Broadcaster
+		provider  string
+		calls     map[string]int
+		err       error
+	}{
+		{"first try", []Broadcaster{provider("a")}, "a", map[string]int{"a": 1}, nil},
+		{"retried", []Broadcaster{provider("a", flaky, flaky)}, "a", map[string]int{"a": 3}, nil},
+		{"fallback", []Broadcaster{provider("a", flaky, flaky, flaky), provider("b")}, "b",
+			map[string]int{"a": 3, "b": 1}, nil},
+		{"network errors fall back", []Broadcaster{provider("a", errors.New("dial"), errors.New("dial"),
+			errors.New("dial")), provider("b")}, "b", map[string]int{"a": 3, "b": 1}, nil},
+		{"refused", []Broadcaster{provider("a", refused), provider("b")}, "",
+			map[string]int{"a": 1}, refused},
+		{"all down", []Broadcaster{provider("a", flaky, flaky, flaky), provider("b", flaky, flaky, flaky)}, "",
+			map[string]int{"a": 3, "b": 3}, flaky},
+	}
+	for _, tc := range cases {
+		calls = map[string]int{}
+		m := &MultiBroadcaster{Providers: tc.providers, Retries: 2, Backoff: time.Millisecond}
+		res, err := m.Broadcast(ctx, raw)
+		if err != tc.err {
+			t.Errorf("%s: expected error %v, got %v\n", tc.name, tc.err, err)
+		}
+		if err == nil && res.Provider != tc.provider {
+			t.Errorf("%s: expected %s to broadcast, got %+v\n", tc.name, tc.provider, res)
+		}
+		if !reflect.DeepEqual(calls, tc.calls) {
+			t.Errorf("%s: expected calls %v, got %v\n", tc.name, tc.calls, calls)
+		}
+	}
+
+	calls = map[string]int{}
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	m := &MultiBroadcaster{Providers: []Broadcaster{provider("a", flaky, flaky)}, Retries: 2, Backoff: time.Hour}
+	if _, err := m.Broadcast(cctx, raw); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the backoff to end with the context, got %v\n", err)
+	}
+}
+
+func TestWhatsOnChainBroadcaster(t *testing.T) {
+	ctx := context.Background()
+	raw := testFundingTx(t).Raw()
+	txid := explorerTxid(Txid(raw))
+
+	var status int
+	var answer string
+	woc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		if r.URL.Path != "/tx/raw" || body["txhex"] != hex.EncodeToString(raw) || r.Header.Get("woc-api-key") != "key" {
+			t.Errorf("unexpected broadcast %s %v %v\n", r.URL.Path, body, r.Header)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(answer))
+	}))
+	defer woc.Close()
+	b := &WhatsOnChainBroadcaster{BaseURL: woc.URL, APIKey: "key"}
+
+	cases := []struct {
+		status      int
+		answer      string
+		txStatus    string
+		retryable   bool
+		doubleSpend bool
+	}{
+		{200, `"` + txid + `"`, TxSeen, false, false},
+		{400, "unexpected response code 500: 257: txn-already-known", TxSeen, false, false},
+		{400, "unexpected response code 500: 258: txn-mempool-conflict", TxRejected, false, true},
+		{400, "unexpected response code 500: Missing inputs", TxRejected, true, false},
+		{400, "unexpected response code 500: 64: dust", TxRejected, false, false},
+		{503, "unavailable", TxRejected, true, false},
+	}
+	for _, tc := range cases {
+		status, answer = tc.status, tc.answer
+		res, err := b.Broadcast(ctx, raw)
+		if res == nil || res.Txid != txid || res.Status != tc.txStatus || res.DoubleSpend != tc.doubleSpend {
+			t.Errorf("%s: unexpected result %+v\n", tc.answer, res)
+		}
+		var be *BroadcastError
+		if tc.txStatus == TxRejected && (!errors.As(err, &be) || be.Retryable != tc.retryable) {
+			t.Errorf("%s: unexpected error %v\n", tc.answer, err)
+		} else if tc.txStatus != TxRejected && err != nil {
+			t.Errorf("%s: expected no error, got %v\n", tc.answer, err)
+		}
+	}
+}
+
+func TestARCBroadcaster(t *testing.T) {
+	ctx := context.Background()
+	raw := testFundingTx(t).Raw()
+	txid := explorerTxid(Txid(raw))
+
+	var status int
+	var answer string
+	arc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		if r.URL.Path != "/v1/tx" || body["rawTx"] != hex.EncodeToString(raw) ||
+			r.Header.Get("Authorization") != "Bearer key" ||
+			r.Header.Get("X-CallbackUrl") != "https://down4.io/broadcast/callback" ||
+			r.Header.Get("X-CallbackToken") != "secret" {
+			t.Errorf("unexpected broadcast %s %v %v\n", r.URL.Path, body, r.Header)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(answer))
+	}))
+	defer arc.Close()
+	b := &ARCBroadcaster{BaseURL: arc.URL + "/", APIKey: "key",
+		CallbackURL: "https://down4.io/broadcast/callback", CallbackToken: "secret"}
+
+	cases := []struct {
+		status      int
+		answer      string
+		txStatus    string
+		retryable   bool
+		doubleSpend bool
+	}{
+		{200, `{"txid":"` + txid + `","txStatus":"SEEN_ON_NETWORK","status":200,"title":"OK"}`, TxSeen, false, false},
+		{200, `{"txid":"` + txid + `","txStatus":"STORED","status":200}`, TxAccepted, false, false},
+		{200, `{"txid":"` + txid + `","txStatus":"DOUBLE_SPEND_ATTEMPTED","competingTxs":["ab"]}`, TxRejected, false, true},
+		{465, `{"status":465,"title":"Fee too low","detail":"fee too low"}`, TxRejected, false, false},
+		{503, `{"status":503,"title":"Unavailable"}`, TxRejected, true, false},
+		{502, `<html>bad gateway</html>`, "", true, false},
+	}
+	for _, tc := range cases {
+		status, answer = tc.status, tc.answer
+		res, err := b.Broadcast(ctx, raw)
+		if len(tc.txStatus) > 0 && (res == nil || res.Txid != txid || res.Status != tc.txStatus || res.DoubleSpend != tc.doubleSpend) {
+			t.Errorf("%s: unexpected result %+v\n", tc.answer, res)
+		}
+		var be *BroadcastError
+		if tc.txStatus == TxRejected || len(tc.txStatus) == 0 {
+			if !errors.As(err, &be) || be.Retryable != tc.retryable || be.DoubleSpend != tc.doubleSpend {
+				t.Errorf("%s: unexpected error %v\n", tc.answer, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: expected no error, got %v\n", tc.answer, err)
+		}
+	}
+}
+
+func TestMockBroadcaster(t *testing.T) {
+	ctx := context.Background()
+	m := NewMockBroadcaster()
+	tx := testFundingTx(t)
+	if _, err := m.Broadcast(ctx, tx.Raw()); err != nil {
+		t.Fatalf("error broadcasting: %v\n", err)
+	}
+	// the same tx again is fine, another one spending its input isn't
+	if _, err := m.Broadcast(ctx, tx.Raw()); err != nil {
+		t.Fatalf("error broadcasting again: %v\n", err)
+	}
+	tx.txouts = tx.txouts[:1]
+	tx.nOuts = makeVarInt(1)
+	res, err := m.Broadcast(ctx, tx.Raw())
+	var be *BroadcastError
+	if !errors.As(err, &be) || !be.DoubleSpend || !res.DoubleSpend {
+		t.Fatalf("expected a double spend, got %+v %v\n", res, err)
+	}
+	if e := broadcastError(err); e.Status != http.StatusConflict || e.Code != codeDoubleSpend {
+		t.Fatalf("expected a conflict, got %+v\n", e)
+	}
+	if len(m.Sent) != 2 {
+		t.Fatalf("expected 2 sent txs, got %d\n", len(m.Sent))
+	}
+}
+
+func TestBroadcastCallback(t *testing.T) {
+	ctx := context.Background()
+	c := newTestServer(t)
+	h := c.Handler(DefaultMaxBodyBytes)
+	txid := explorerTxid(testFundingTx(t).Txid())
+
+	call := func(token, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/broadcast/callback", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		h.ServeHTTP(w, r)
+		return w
+	}
+	mined := `{"txid":"` + txid + `","txStatus":"MINED","blockHeight":1}`
+
+	// nothing is accepted until a token is configured
+	if w := call("", mined); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a callback token, got %d\n", w.Code)
+	}
+	c.CallbackToken = "secret"
+	h = c.Handler(DefaultMaxBodyBytes)
+	if w := call("guess", mined); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 with a bad token, got %d\n", w.Code)
+	}
+	if w := call("secret", `{"txid":"nope","txStatus":"MINED"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 with a bad txid, got %d\n", w.Code)
+	}
+
+	c.recordTxStatus(ctx, &BroadcastResult{Txid: txid, Status: TxAccepted, Provider: providerARC},
+		map[string]interface{}{"sender": "jones-america-1"})
+	if w := call("secret", mined); w.Code != 200 {
+		t.Fatalf("expected 200, got %d %s\n", w.Code, w.Body.String())
+	}
+	var status map[string]interface{}
+	shrd, _ := c.txShard(txid)
+	shrd.RealtimeDB.NewRef("txs/"+txid).Get(ctx, &status)
+	if status["status"] != TxMined || status["sender"] != "jones-america-1" {
+		t.Fatalf("unexpected tx status %v\n", status)
+	}
+}
+
+func TestBroadcastConfig(t *testing.T) {
+	t.Setenv("ARC_KEY", "key")
+	t.Setenv("ARC_CALLBACK", "secret")
+	bc := BroadcastConfig{
+		Retries: 1,
+		Providers: []ProviderConfig{
+			{Kind: "arc", URL: "https://arc.taal.com", APIKeyEnv: "ARC_KEY",
+				CallbackURL: "https://down4.io/broadcast/callback", CallbackTokenEnv: "ARC_CALLBACK"},
+			{Kind: "whatsonchain"},
+		},
+	}
+	if err := bc.Validate(Mainnet); err != nil {
+		t.Fatalf("unexpected error: %v\n", err)
+	}
+	m := bc.Broadcaster(Mainnet)
+	arc, ok := m.Providers[0].(*ARCBroadcaster)
+	if !ok || arc.APIKey != "key" || arc.CallbackToken != "secret" || m.Retries != 1 || bc.CallbackToken() != "secret" {
+		t.Fatalf("unexpected broadcaster %+v\n", m.Providers[0])
+	}
+	if woc, ok := m.Providers[1].(*WhatsOnChainBroadcaster); !ok || woc.BaseURL != Mainnet.WhatsOnChainURL() {
+		t.Fatalf("unexpected broadcaster %+v\n", m.Providers[1])
+	}
+	if m := (BroadcastConfig{}).Broadcaster(Testnet); len(m.Providers) != 1 || m.Retries != defaultBroadcastRetries {
+		t.Fatalf("unexpected default broadcaster %+v\n", m)
+	} else if woc := m.Providers[0].(*WhatsOnChainBroadcaster); woc.BaseURL != Testnet.WhatsOnChainURL() {
+		t.Fatalf("unexpected default broadcaster url %s\n", woc.BaseURL)
+	}
+	bare := BroadcastConfig{Providers: []ProviderConfig{{Kind: "arc"}}}
+	if m := bare.Broadcaster(Testnet); m.Providers[0].(*ARCBroadcaster).BaseURL != Testnet.ARCURL() {
+		t.Fatalf("unexpected arc broadcaster %+v\n", m.Providers[0])
+	}
+	if err := bc.Validate(Testnet); err == nil {
+		t.Fatal("expected an error for a mainnet provider on testnet")
+	}
+
+	invalids := map[string]BroadcastConfig{
+		"unknown kind":       {Providers: []ProviderConfig{{Kind: "taal"}}},
+		"arc bad url":        {Providers: []ProviderConfig{{Kind: "arc", URL: "arc.taal.com"}}},
+		"callback no token":  {Providers: []ProviderConfig{{Kind: "arc", URL: "https://arc.taal.com", CallbackURL: "https://x"}}},
+		"woc callback":       {Providers: []ProviderConfig{{Kind: "whatsonchain", CallbackURL: "https://x", CallbackTokenEnv: "X"}}},
+		"negative retries":   {Retries: -1},
+		"too many retries":   {Retries: 100},
+		"two callback hosts": {Providers: []ProviderConfig{bc.Providers[0], bc.Providers[0]}},
+	}
+	for name, ic := range invalids {
+		if err := ic.Validate(Mainnet); err == nil {
+			t.Errorf("%s: expected an error\n", name)
+		}
+	}
+}
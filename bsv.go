@@ -3,14 +3,14 @@ package backend
 import (
 	"bytes"
 	"crypto/sha1"
+	"errors"
+	"fmt"
 	"hash"
-	"math"
 
 	"encoding/binary"
 )
 
-func simpleBoostHashPuzzle(s1 []byte, i uint32, buf *bytes.Buffer, h hash.Hash) []byte {
-	shp := make([]byte, 23)
+func simpleBoostHashPuzzle(s1 []byte, i uint32, sb *ScriptBuilder, buf *bytes.Buffer, h hash.Hash) ([]byte, error) {
 	buf.Write(s1)
 	binary.Write(buf, binary.BigEndian, i)
 	h.Write(buf.Bytes())
@@ -19,58 +19,69 @@ func simpleBoostHashPuzzle(s1 []byte, i uint32, buf *bytes.Buffer, h hash.Hash)
 	h.Write(s2)
 	s3 := h.Sum(nil)
 	h.Reset()
-	buf.Reset()		
-	buf.WriteByte(op_sha1)
-	buf.Write(op_push_data(s3))
-	buf.WriteByte(op_equal)
-	copy(shp, buf.Bytes())
 	buf.Reset()
-	return shp
+	return sb.Reset().AddOp(op_sha1).AddData(s3).AddOp(op_equal).Script()
 }
 
-func p2pkh(pkh []byte, buf *bytes.Buffer) []byte {
-	sc := make([]byte, 25)
-	buf.WriteByte(op_dup)
-	buf.WriteByte(op_hash160)
-	buf.Write(op_push_data(pkh))
-	buf.WriteByte(op_equal_verify)
-	buf.WriteByte(op_check_sig)
-	copy(sc, buf.Bytes())
-	buf.Reset()
-	return sc
+// boostSecret is s2 of output i, what unlocks its hash puzzle
+func boostSecret(s1 []byte, i uint32) []byte {
+	buf := make([]byte, len(s1)+4)
+	copy(buf, s1)
+	binary.BigEndian.PutUint32(buf[len(s1):], i)
+	s2 := sha1.Sum(buf)
+	return s2[:]
+}
+
+func p2pkh(pkh []byte) ([]byte, error) {
+	if len(pkh) != 20 {
+		return nil, fmt.Errorf("invalid pubkey hash length: %d", len(pkh))
+	}
+	return NewScriptBuilder().
+		AddOp(op_dup, op_hash160).
+		AddData(pkh).
+		AddOp(op_equal_verify, op_check_sig).
+		Script()
 }
 
-func BoostScript(t *Tx, s1 []byte, nout int, pph int, inSats int, addr []byte) *Tx {
-	// const bytes_per_sat float64 = 20
-	const bytes_per_sat float64 = 1000 // fees are len(tx.raw()) / 1000
-	const shp_out_size = 32            // 3 OPS, 20 data_bytes, 8 bytes for sats, 1 byte for len
-	const p2pkh_out_size = 34          // 5 OPS, 20 data_bytes, 8 bytes for sats, 1 byte for len
+var errUnderfunded = errors.New("inputs don't fund the boost")
 
-	buf, h := new(bytes.Buffer), sha1.New()
+// BoostScript replaces the outputs of t with nout boost outputs of pph and
+// the change to addr, paying fees. Change under the dust limit is refused
+// instead of donating it to miners
+func BoostScript(t *Tx, s1 []byte, nout int, pph int, inSats int, addr []byte, fees FeePolicy) (*Tx, error) {
+	q, err := QuoteBoost(t, nout, uint64(pph), fees)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(inSats) < q.Required {
+		return nil, fmt.Errorf("%w: %d sats in, %d boosted and %d of fees need at least %d with the change",
+			errUnderfunded, inSats, q.Boosted, q.Fee, q.Required)
+	}
+	change := uint64(inSats) - q.Boosted - q.Fee
+
+	buf, h, sb := new(bytes.Buffer), sha1.New(), NewScriptBuilder()
 	outs := make([]*Txout, 0, nout+1)
 
 	for i := 0; i < nout; i++ {
-		shp := simpleBoostHashPuzzle(s1, uint32(i), buf, h)
+		shp, err := simpleBoostHashPuzzle(s1, uint32(i), sb, buf, h)
+		if err != nil {
+			return nil, err
+		}
 		tout := &Txout{
 			sats:      uint64(pph),
-			scriptLen: makeVarInt(len(shp)),
+			scriptLen: makeVarInt(uint64(len(shp))),
 			script:    shp,
 		}
 		outs = append(outs, tout)
-	}	
-
-	vout := makeVarInt(nout + 1)                                          // nout + change
-	outRelSize := (shp_out_size * nout) + p2pkh_out_size + len(vout.data) // size relating outs
-	txSize := len(t.Raw()) - 1 + outRelSize                               // -1 to remove varInt(0) vout
-	
-	fees := int(math.Ceil(float64(txSize) / bytes_per_sat))
-	boostSats := pph * nout
-	change := inSats - (boostSats + fees)
+	}
 
-	changeScript := p2pkh(addr, buf)
+	changeScript, err := p2pkh(addr)
+	if err != nil {
+		return nil, err
+	}
 	changeOut := &Txout{
-		sats:      uint64(change),
-		scriptLen: makeVarInt(len(changeScript)),
+		sats:      change,
+		scriptLen: makeVarInt(uint64(len(changeScript))),
 		script:    changeScript,
 	}
 
@@ -87,7 +98,56 @@ func BoostScript(t *Tx, s1 []byte, nout int, pph int, inSats int, addr []byte) *
 	// maximun is 2^32 outs which would be 44 * ~4billion // which would be insane
 
 	t.txouts = outs
-	t.nOuts = vout
-	return t
+	t.nOuts = makeVarInt(uint64(nout + 1)) // nout + change
+	return t, nil
 
 }
+
+var errDustClaim = errors.New("boost outputs don't cover the fee")
+
+// ClaimScript spends output index of the boost tx txid, a hash puzzle of
+// sats, to addr. s2 is all the unlocking script needs so the claim isn't
+// signed, the fee comes out of the boosted sats
+func ClaimScript(txid []byte, index uint32, s1 []byte, sats uint64, addr []byte, fees FeePolicy) (*Tx, error) {
+	return SweepScript(txid, []uint32{index}, s1, sats, addr, fees)
+}
+
+// SweepScript spends the outputs outs of the boost tx txid, each of pph, to
+// addr in a single output, like ClaimScript for many outputs
+func SweepScript(txid []byte, outs []uint32, s1 []byte, pph uint64, addr []byte, fees FeePolicy) (*Tx, error) {
+	if len(outs) == 0 {
+		return nil, errors.New("no outputs to spend")
+	}
+	lock, err := p2pkh(addr)
+	if err != nil {
+		return nil, err
+	}
+	sb := NewScriptBuilder()
+	ins := make([]*Txin, 0, len(outs))
+	for _, i := range outs {
+		unlock, err := sb.Reset().AddData(boostSecret(s1, i)).Script()
+		if err != nil {
+			return nil, err
+		}
+		ins = append(ins, &Txin{
+			txid:       txid,
+			utxoIndex:  i,
+			scriptLen:  makeVarInt(uint64(len(unlock))),
+			script:     unlock,
+			sequenceNo: 0xffffffff,
+		})
+	}
+	t := &Tx{
+		versionNo: 1,
+		nIns:      makeVarInt(uint64(len(ins))),
+		txins:     ins,
+		nOuts:     makeVarInt(1),
+		txouts:    []*Txout{{scriptLen: makeVarInt(uint64(len(lock))), script: lock}},
+	}
+	sats, fee := pph*uint64(len(outs)), fees.Fee(len(t.Raw()))
+	if sats < fee+fees.Dust {
+		return nil, fmt.Errorf("%w: %d sats can't pay a %d sats fee and keep %d", errDustClaim, sats, fee, fees.Dust)
+	}
+	t.txouts[0].sats = sats - fee
+	return t, nil
+}
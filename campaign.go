@@ -0,0 +1,265 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	rtdb "firebase.google.com/go/v4/db"
+	"github.com/btcsuite/btcd/btcutil/base58"
+)
+
+// statuses of a campaign, a boost from its tx to its outputs being spent.
+// Failed is a tx no provider took, nobody was boosted
+const (
+	CampaignCreated          = "created"
+	CampaignBroadcast        = "broadcast"
+	CampaignDelivered        = "delivered"
+	CampaignPartiallyClaimed = "partially_claimed"
+	CampaignClaimed          = "claimed"
+	CampaignExpired          = "expired"
+	CampaignRefunded         = "refunded"
+	CampaignFailed           = "failed"
+)
+
+var campaignTransitions = map[string][]string{
+	CampaignCreated:          {CampaignBroadcast, CampaignFailed},
+	CampaignBroadcast:        {CampaignDelivered, CampaignExpired},
+	CampaignDelivered:        {CampaignPartiallyClaimed, CampaignClaimed, CampaignExpired},
+	CampaignPartiallyClaimed: {CampaignPartiallyClaimed, CampaignClaimed, CampaignExpired},
+	CampaignExpired:          {CampaignRefunded},
+}
+
+var errCampaignTransition = errors.New("invalid campaign transition")
+
+// Campaign ties a boost tx to its targeting and the packs its targets were
+// delivered in. Output i of Txid boosts the i-th target, ChangeIndex is the
+// change. S1 is the secret of the hash puzzles, kept to build claims and
+// never answered. After ExpiresAt what isn't claimed is refunded to
+// ChangeAddress in RefundTxid. It lives under roots/<sender unik>/campaigns/<id>
+type Campaign struct {
+	Id            string          `json:"id"`
+	Sender        string          `json:"sender"`
+	Status        string          `json:"status"`
+	Txid          string          `json:"txid"`
+	S1            string          `json:"s1,omitempty"`
+	PricePerHead  int             `json:"pph"`
+	Targets       int             `json:"targets"`
+	ChangeIndex   int             `json:"changeIndex"`
+	Claimed       int             `json:"claimed"`
+	ChangeAddress string          `json:"changeAddr"`
+	RefundTxid    string          `json:"refundTxid,omitempty"`
+	Refunded      uint64          `json:"refunded,omitempty"`
+	Targeting     *Targeting      `json:"targeting"`
+	Packs         []*CampaignPack `json:"packs,omitempty"`
+	CreatedAt     int64           `json:"createdAt"`
+	UpdatedAt     int64           `json:"updatedAt"`
+	ExpiresAt     int64           `json:"expiresAt"`
+}
+
+// Targeting is who a campaign was asked to reach
+type Targeting struct {
+	Limit   int      `json:"limit"`
+	MinAge  int      `json:"minAge"`
+	MaxAge  int      `json:"maxAge"`
+	Genders []string `json:"genders"`
+	Areas   []area   `json:"areas"`
+}
+
+// CampaignPack is one boosts/<unik> node and the targets [Start, End) whose
+// queues point to it, Delivered of them were written
+type CampaignPack struct {
+	BoostId   string `json:"boostId"`
+	Start     int    `json:"start"`
+	End       int    `json:"end"`
+	Delivered int    `json:"delivered"`
+	Error     string `json:"error,omitempty"`
+}
+
+func newCampaign(br *boostRequest2, txid string, targets int, ttl time.Duration) *Campaign {
+	now := time.Now().UnixMilli()
+	return &Campaign{
+		Id:            base58.Encode(RandomBytes(16)),
+		Sender:        br.SenderID,
+		Status:        CampaignCreated,
+		Txid:          txid,
+		S1:            br.S1,
+		PricePerHead:  br.PricePerHead,
+		Targets:       targets,
+		ChangeIndex:   targets,
+		ChangeAddress: br.ChangeAddress,
+		Targeting: &Targeting{
+			Limit:   br.Limit,
+			MinAge:  br.MinAge,
+			MaxAge:  br.MaxAge,
+			Genders: br.Genders,
+			Areas:   br.Areas,
+		},
+		CreatedAt: now,
+		UpdatedAt: now,
+		ExpiresAt: now + ttl.Milliseconds(),
+	}
+}
+
+// advance moves c to status, if the lifecycle allows it
+func (c *Campaign) advance(status string) error {
+	for _, to := range campaignTransitions[c.Status] {
+		if to == status {
+			c.Status, c.UpdatedAt = status, time.Now().UnixMilli()
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s to %s", errCampaignTransition, c.Status, status)
+}
+
+func (s *Server) campaignsRef(sender string) (RealtimeRef, error) {
+	shrd, cp, err := s.senderShard(sender)
+	if err != nil {
+		return nil, err
+	}
+	return shrd.RealtimeDB.NewRef("roots/" + cp.Unik + "/campaigns"), nil
+}
+
+// senderShard is the shard of the campaigns of sender
+func (s *Server) senderShard(sender string) (ServerShard, *ComposedId, error) {
+	cp, err := parseUserId(sender)
+	if err != nil {
+		return ServerShard{}, nil, err
+	}
+	shrd, err := s.ServerShard(cp)
+	return shrd, cp, err
+}
+
+// createCampaign writes c and indexes its expiry, see SweepExpired
+func (s *Server) createCampaign(ctx context.Context, c *Campaign) error {
+	shrd, cp, err := s.senderShard(c.Sender)
+	if err != nil {
+		return err
+	}
+	if err := shrd.RealtimeDB.NewRef("roots/"+cp.Unik+"/campaigns/"+c.Id).Set(ctx, c); err != nil {
+		return err
+	}
+	exp := &campaignExpiry{Sender: c.Sender, ExpiresAt: c.ExpiresAt}
+	return shrd.RealtimeDB.NewRef("expiries/"+c.Id).Set(ctx, exp)
+}
+
+// updateCampaign runs fn on the stored campaign in a transaction, an error
+// of fn leaves it as it was
+func (s *Server) updateCampaign(ctx context.Context, sender, id string, fn func(c *Campaign) error) (*Campaign, error) {
+	ref, err := s.campaignsRef(sender)
+	if err != nil {
+		return nil, err
+	}
+	var updated *Campaign
+	err = ref.Child(id).Transaction(ctx, func(tn rtdb.TransactionNode) (interface{}, error) {
+		var c *Campaign
+		if err := tn.Unmarshal(&c); err != nil {
+			return nil, err
+		}
+		if c == nil {
+			return nil, fmt.Errorf("no campaign %s for %s", id, sender)
+		}
+		if err := fn(c); err != nil {
+			return nil, err
+		}
+		c.UpdatedAt = time.Now().UnixMilli()
+		updated = c
+		return c, nil
+	})
+	return updated, err
+}
+
+func (s *Server) campaign(ctx context.Context, sender, id string) (*Campaign, error) {
+	ref, err := s.campaignsRef(sender)
+	if err != nil {
+		return nil, err
+	}
+	var c *Campaign
+	if err := ref.Child(id).Get(ctx, &c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// campaigns of sender, newest first
+func (s *Server) campaigns(ctx context.Context, sender string) ([]*Campaign, error) {
+	ref, err := s.campaignsRef(sender)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]*Campaign
+	if err := ref.Get(ctx, &m); err != nil {
+		return nil, err
+	}
+	cs := make([]*Campaign, 0, len(m))
+	for _, c := range m {
+		cs = append(cs, c)
+	}
+	sort.Slice(cs, func(i, j int) bool { return cs[i].CreatedAt > cs[j].CreatedAt })
+	return cs, nil
+}
+
+type campaignRequest struct {
+	SenderID   string `json:"senderID"`
+	CampaignID string `json:"campaignID"`
+}
+
+func (s *Server) decodeCampaignRequest(r *http.Request) (*campaignRequest, error) {
+	var cr campaignRequest
+	if err := json.NewDecoder(r.Body).Decode(&cr); err != nil {
+		return nil, bodyError(codeInvalidJson, "error decoding campaignRequest", err)
+	}
+	id, err := identityFrom(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	if !id.is(cr.SenderID) {
+		return nil, forbidden("sender " + cr.SenderID + " is not the caller")
+	}
+	return &cr, nil
+}
+
+// HandleListCampaigns lists the campaigns of the caller, without their packs
+func (s *Server) HandleListCampaigns(w http.ResponseWriter, r *http.Request) {
+	cr, err := s.decodeCampaignRequest(r)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	cs, err := s.campaigns(r.Context(), cr.SenderID)
+	if err != nil {
+		WriteError(w, internal(codeInternal, "error reading campaigns", err))
+		return
+	}
+	for _, c := range cs {
+		c.Packs, c.S1 = nil, ""
+	}
+	writeJson(w, map[string][]*Campaign{"campaigns": cs})
+}
+
+// HandleInspectCampaign is one campaign of the caller with its packs
+func (s *Server) HandleInspectCampaign(w http.ResponseWriter, r *http.Request) {
+	cr, err := s.decodeCampaignRequest(r)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	if len(cr.CampaignID) == 0 {
+		WriteError(w, badRequest(codeInvalidRequest, "missing campaignID", nil))
+		return
+	}
+	c, err := s.campaign(r.Context(), cr.SenderID, cr.CampaignID)
+	if err != nil {
+		WriteError(w, internal(codeInternal, "error reading campaign", err))
+		return
+	} else if c == nil {
+		WriteError(w, notFound(codeNoCampaign, "no campaign "+cr.CampaignID, nil))
+		return
+	}
+	c.S1 = ""
+	writeJson(w, c)
+}
@@ -0,0 +1,179 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCampaign(t *testing.T) {
+	ctx := context.Background()
+	c := newTestServer(t)
+	targets := seedBoostUsers(c.Firestore.(*MemoryDocs))
+
+	b, _ := json.Marshal(testBoostRequest())
+	w := httptest.NewRecorder()
+	c.HandleBoostRequest(w, asUser(httptest.NewRequest("POST", "/boost", bytes.NewReader(b)), "jones"))
+	var res boostResult
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || w.Code != 200 || len(res.Campaign) == 0 {
+		t.Fatalf("unexpected boost response %d: %s\n", w.Code, w.Body.String())
+	}
+
+	campaigns := func(path, uid string, cr campaignRequest) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(cr)
+		w := httptest.NewRecorder()
+		r := asUser(httptest.NewRequest("POST", path, bytes.NewReader(b)), uid)
+		if path == "/campaigns" {
+			c.HandleListCampaigns(w, r)
+		} else {
+			c.HandleInspectCampaign(w, r)
+		}
+		return w
+	}
+
+	w = campaigns("/campaigns/inspect", "jones", campaignRequest{SenderID: "jones-america-1", CampaignID: res.Campaign})
+	var camp Campaign
+	if err := json.Unmarshal(w.Body.Bytes(), &camp); err != nil || w.Code != 200 {
+		t.Fatalf("unexpected inspect response %d: %s\n", w.Code, w.Body.String())
+	}
+	tx, _ := ParseTx(c.Broadcaster.(*MockBroadcaster).Sent[0])
+	if camp.Status != CampaignDelivered || camp.Txid != explorerTxid(tx.Txid()) || camp.Targets != len(targets) ||
+		camp.ChangeIndex != len(targets) || len(camp.S1) != 0 || camp.Targeting == nil || camp.Targeting.Limit != testBoostRequest().Limit {
+		t.Fatalf("unexpected campaign %+v\n", camp)
+	}
+	if len(camp.Packs) != 1 || camp.Packs[0].Delivered != len(targets) || camp.Packs[0].End != len(targets) {
+		t.Fatalf("unexpected packs %+v\n", camp.Packs)
+	}
+	var boost map[string]interface{}
+	bid := ParseRoot(camp.Packs[0].BoostId)[0]
+	c.Shards[bid.Region][bid.Shard].RealtimeDB.NewRef("boosts/"+bid.Unik).Get(ctx, &boost)
+	if boost["campaign"] != camp.Id || boost["sender"] != camp.Sender {
+		t.Fatalf("unexpected boost node %v\n", boost)
+	}
+
+	w = campaigns("/campaigns", "jones", campaignRequest{SenderID: "jones-america-1"})
+	var list struct{ Campaigns []*Campaign }
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || w.Code != 200 || len(list.Campaigns) != 1 {
+		t.Fatalf("unexpected list response %d: %s\n", w.Code, w.Body.String())
+	}
+	if list.Campaigns[0].Id != camp.Id || list.Campaigns[0].Packs != nil {
+		t.Fatalf("unexpected listed campaign %+v\n", list.Campaigns[0])
+	}
+
+	for name, tc := range map[string]struct {
+		path, uid string
+		cr        campaignRequest
+		code      int
+	}{
+		"someone else's": {"/campaigns", "rimouski", campaignRequest{SenderID: "jones-america-1"}, 403},
+		"no id":          {"/campaigns/inspect", "jones", campaignRequest{SenderID: "jones-america-1"}, 400},
+		"unknown":        {"/campaigns/inspect", "jones", campaignRequest{SenderID: "jones-america-1", CampaignID: "nope"}, 404},
+	} {
+		if w := campaigns(tc.path, tc.uid, tc.cr); w.Code != tc.code {
+			t.Errorf("%s: expected %d, got %d %s\n", name, tc.code, w.Code, w.Body.String())
+		}
+	}
+}
+
+// failingDB fails every write under boosts/
+type failingDB struct{ RealtimeDB }
+
+type failingRef struct{ RealtimeRef }
+
+func (f failingDB) NewRef(path string) RealtimeRef {
+	if strings.HasPrefix(path, "boosts/") {
+		return failingRef{f.RealtimeDB.NewRef(path)}
+	}
+	return f.RealtimeDB.NewRef(path)
+}
+
+func (f failingRef) Set(ctx context.Context, v interface{}) error {
+	return errors.New("write refused")
+}
+
+func TestCampaignUndelivered(t *testing.T) {
+	ctx := context.Background()
+	c := newTestServer(t)
+	seedBoostUsers(c.Firestore.(*MemoryDocs))
+	for _, shrds := range c.Shards {
+		for i := range shrds {
+			shrds[i].RealtimeDB = failingDB{shrds[i].RealtimeDB}
+		}
+	}
+
+	b, _ := json.Marshal(testBoostRequest())
+	w := httptest.NewRecorder()
+	c.HandleBoostRequest(w, asUser(httptest.NewRequest("POST", "/boost", bytes.NewReader(b)), "jones"))
+	if w.Code != 500 || !bytes.Contains(w.Body.Bytes(), []byte(codeWriteFailed)) {
+		t.Fatalf("expected every boost to fail, got %d %s\n", w.Code, w.Body.String())
+	}
+	var camps map[string]*Campaign
+	c.Shards["america"][1].RealtimeDB.NewRef("roots/jones/campaigns").Get(ctx, &camps)
+	if len(camps) != 1 {
+		t.Fatalf("expected a campaign, got %v\n", camps)
+	}
+	for _, camp := range camps {
+		if camp.Status != CampaignBroadcast || len(camp.Packs) != 1 || camp.Packs[0].Error != "write refused" || camp.Packs[0].Delivered != 0 {
+			t.Fatalf("expected a broadcast campaign with the pack error, got %+v\n", camp)
+		}
+	}
+}
+
+func TestWriteBoostsUnknownRegion(t *testing.T) {
+	c := newTestServer(t)
+	br := testBoostRequest()
+
+	users := []*user{{Id: "ghost-mars-0"}, {Id: "ghost-mars-1"}, {Id: "hashirama-america-1"}}
+	packs := c.writeBoosts(context.Background(), users, br, "campaign")
+	if len(packs) != 1 || packs[0].Error != "" || packs[0].Delivered != 1 || ParseRoot(packs[0].BoostId)[0].Region != "america" {
+		t.Fatalf("expected the pack on a served region, got %+v\n", packs[0])
+	}
+	packs = c.writeBoosts(context.Background(), users[:2], br, "campaign")
+	if len(packs) != 1 || packs[0].Error == "" || packs[0].BoostId != "" {
+		t.Fatalf("expected the pack to fail, got %+v\n", packs[0])
+	}
+}
+
+func TestCampaignLifecycle(t *testing.T) {
+	camp := newCampaign(testBoostRequest(), "txid", 3, time.Hour)
+	for _, status := range []string{CampaignBroadcast, CampaignDelivered, CampaignPartiallyClaimed, CampaignPartiallyClaimed, CampaignExpired, CampaignRefunded} {
+		if err := camp.advance(status); err != nil {
+			t.Fatalf("error moving to %s: %v\n", status, err)
+		}
+	}
+	if err := camp.advance(CampaignClaimed); !errors.Is(err, errCampaignTransition) {
+		t.Fatalf("expected %v from a refunded campaign, got %v\n", errCampaignTransition, err)
+	}
+	if err := newCampaign(testBoostRequest(), "txid", 3, time.Hour).advance(CampaignDelivered); err == nil {
+		t.Fatal("expected an error delivering a campaign never broadcast")
+	}
+
+	// campaigns of malformed senders aren't written
+	c := newTestServer(t)
+	for _, sender := range []string{"jones", "jones-nowhere-0"} {
+		bad := newCampaign(testBoostRequest(), "txid", 3, time.Hour)
+		bad.Sender = sender
+		if err := c.createCampaign(context.Background(), bad); err == nil {
+			t.Errorf("expected an error creating a campaign of %s\n", sender)
+		}
+	}
+
+	// a tx nobody took fails its campaign
+	seedBoostUsers(c.Firestore.(*MemoryDocs))
+	c.Broadcaster.(*MockBroadcaster).Err = &BroadcastError{Provider: providerMock, Message: "rejected"}
+	b, _ := json.Marshal(testBoostRequest())
+	w := httptest.NewRecorder()
+	c.HandleBoostRequest(w, asUser(httptest.NewRequest("POST", "/boost", bytes.NewReader(b)), "jones"))
+	if w.Code == 200 {
+		t.Fatalf("expected the boost to fail, got %s\n", w.Body.String())
+	}
+	cs, err := c.campaigns(context.Background(), "jones-america-1")
+	if err != nil || len(cs) != 1 || cs[0].Status != CampaignFailed || len(cs[0].Packs) != 0 {
+		t.Fatalf("expected a failed campaign, got %v: %v\n", cs, err)
+	}
+}
@@ -0,0 +1,184 @@
+package backend
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	rtdb "firebase.google.com/go/v4/db"
+)
+
+// boostNode is what writeBoosts leaves under boosts/<unik> that claims need
+type boostNode struct {
+	Sender    string `json:"sender"`
+	Campaign  string `json:"campaign"`
+	Sats      int    `json:"sats"`
+	PackStart int    `json:"packStart"`
+	PackEnd   int    `json:"packEnd"`
+}
+
+type claimRequest struct {
+	UserID  string `json:"userID"`
+	BoostID string `json:"boostID"`
+	Index   int    `json:"index"`
+	Address string `json:"addr"`
+}
+
+type claimResult struct {
+	Txid string `json:"txid"`
+	Sats uint64 `json:"sats"`
+}
+
+var errAlreadyClaimed = errors.New("boost output already claimed")
+
+// HandleClaimBoost spends the output a boost locked for the caller to their
+// address. The output is marked claimed under boosts/<unik>/claims/<index>
+// before the claim is broadcast, so it is claimed once
+func (s *Server) HandleClaimBoost(w http.ResponseWriter, r *http.Request) {
+	res, err := s.handleClaimBoost(r.Context(), r)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	writeJson(w, res)
+}
+
+func (s *Server) handleClaimBoost(ctx context.Context, r *http.Request) (*claimResult, error) {
+	var cr claimRequest
+	if err := json.NewDecoder(r.Body).Decode(&cr); err != nil {
+		return nil, bodyError(codeInvalidJson, "error decoding claimRequest", err)
+	}
+	id, err := identityFrom(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	if !id.is(cr.UserID) {
+		return nil, forbidden("user " + cr.UserID + " is not the caller")
+	}
+	addr, err := s.Network.DecodeAddress(cr.Address)
+	if err != nil {
+		return nil, badRequest(codeInvalidAddress, "error decoding claim address", err)
+	}
+	boostId, err := parseUserId(cr.BoostID)
+	if err != nil {
+		return nil, badRequest(codeInvalidRequest, "invalid boost id", err)
+	}
+	shrd, err := s.ServerShard(boostId)
+	if err != nil {
+		return nil, badRequest(codeInvalidRequest, "invalid boost id", err)
+	}
+	boostRef := shrd.RealtimeDB.NewRef("boosts/" + boostId.Unik)
+
+	var node *boostNode
+	if err := boostRef.Get(ctx, &node); err != nil {
+		return nil, internal(codeInternal, "error reading boost", err)
+	} else if node == nil || len(node.Campaign) == 0 {
+		return nil, notFound(codeNoBoost, "no boost "+cr.BoostID, nil)
+	}
+	if cr.Index < node.PackStart || cr.Index >= node.PackEnd {
+		msg := fmt.Sprintf("output %d isn't in boost %s", cr.Index, cr.BoostID)
+		return nil, badRequest(codeInvalidRequest, msg, nil)
+	}
+
+	// the queue entry of the caller for this boost holds their output
+	userId, _ := parseUserId(cr.UserID)
+	ushrd, err := s.ServerShard(userId)
+	if err != nil {
+		return nil, badRequest(codeInvalidRequest, "invalid user id", err)
+	}
+	var queued *int
+	pth := "nodes/" + userId.Unik + "/queues/boost/" + satsPrefix(node.Sats) + "%" + cr.BoostID
+	if err := ushrd.RealtimeDB.NewRef(pth).Get(ctx, &queued); err != nil {
+		return nil, internal(codeInternal, "error reading boost queue", err)
+	} else if queued == nil || *queued != cr.Index {
+		return nil, forbidden(fmt.Sprintf("output %d of boost %s isn't for %s", cr.Index, cr.BoostID, cr.UserID))
+	}
+
+	camp, err := s.campaign(ctx, node.Sender, node.Campaign)
+	if err != nil {
+		return nil, internal(codeInternal, "error reading campaign", err)
+	} else if camp == nil {
+		return nil, notFound(codeNoCampaign, "no campaign "+node.Campaign, nil)
+	}
+	// past its expiry the sweep can refund the output any time, even if the
+	// campaign isn't expired yet
+	status := camp.Status
+	if camp.ExpiresAt > 0 && time.Now().UnixMilli() >= camp.ExpiresAt {
+		status = CampaignExpired
+	}
+	if status != CampaignDelivered && status != CampaignPartiallyClaimed {
+		return nil, badRequest(codeInvalidRequest, "campaign is "+status+", its outputs can't be claimed", nil)
+	}
+	s1, err := base64.StdEncoding.DecodeString(camp.S1)
+	if err != nil {
+		return nil, internal(codeInternal, "error decoding campaign s1", err)
+	}
+	txid, err := txidOf(camp.Txid)
+	if err != nil {
+		return nil, internal(codeInternal, "invalid campaign txid", err)
+	}
+
+	// the output is rebuilt from the campaign like sweeps do, fetching it
+	// would download the whole boost tx for every claim
+	prevout := puzzlePrevouts(s1, []uint32{uint32(cr.Index)}, uint64(camp.PricePerHead))[0]
+	claim, err := ClaimScript(txid, uint32(cr.Index), s1, prevout.Sats, addr, s.FeePolicy(ctx))
+	if errors.Is(err, errDustClaim) {
+		return nil, badRequest(codeDustClaim, "boost output is too small to claim", err)
+	} else if err != nil {
+		return nil, internal(codeInternal, "error building claim tx", err)
+	}
+	if err := VerifyScript(claim.txins[0].script, prevout.Script, nil); err != nil {
+		e := internal(codeInternal, "claim doesn't unlock the boost output", err)
+		e.Retryable = false
+		return nil, e
+	}
+
+	rawTx := claim.Raw()
+	claimTxid := explorerTxid(Txid(rawTx))
+	claimRef := boostRef.Child("claims/" + strconv.Itoa(cr.Index))
+	err = claimRef.Transaction(ctx, func(tn rtdb.TransactionNode) (interface{}, error) {
+		var cur map[string]interface{}
+		if err := tn.Unmarshal(&cur); err != nil {
+			return nil, err
+		}
+		if cur != nil {
+			return nil, errAlreadyClaimed
+		}
+		return map[string]interface{}{
+			"claimer":   cr.UserID,
+			"txid":      claimTxid,
+			"claimedAt": time.Now().UnixMilli(),
+		}, nil
+	})
+	if errors.Is(err, errAlreadyClaimed) {
+		return nil, &Error{Status: http.StatusConflict, Code: codeAlreadyClaimed, Message: "output already claimed", Err: err}
+	} else if err != nil {
+		return nil, internal(codeWriteFailed, "error marking output claimed", err)
+	}
+
+	bres, err := s.Broadcaster.Broadcast(ctx, rawTx)
+	if err != nil {
+		// nothing was spent, the output can be claimed again
+		NonFatal(claimRef.Set(ctx, nil), "error releasing claim of "+claimTxid)
+		return nil, broadcastError(err)
+	}
+	extra := map[string]interface{}{"claimer": cr.UserID, "campaign": camp.Id, "boost": cr.BoostID}
+	if err := s.recordTxStatus(ctx, bres, extra); err != nil {
+		NonFatal(err, "error recording claim tx status")
+	}
+	_, err = s.updateCampaign(ctx, camp.Sender, camp.Id, func(c *Campaign) error {
+		c.Claimed++
+		if c.Claimed >= c.Targets {
+			return c.advance(CampaignClaimed)
+		}
+		return c.advance(CampaignPartiallyClaimed)
+	})
+	NonFatal(err, "error counting claim of campaign "+camp.Id)
+
+	return &claimResult{Txid: claimTxid, Sats: claim.txouts[0].sats}, nil
+}
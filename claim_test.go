@@ -0,0 +1,124 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+// testCampaign boosts the seeded users as jones and makes the outputs of
+// the boost tx spendable, outputs is the one each target was queued
+func testCampaign(t *testing.T, c *Server) (boostTx []byte, camp *Campaign, targets []string, outputs map[string]int) {
+	ctx := context.Background()
+	targets = seedBoostUsers(c.Firestore.(*MemoryDocs))
+	b, _ := json.Marshal(testBoostRequest())
+	w := httptest.NewRecorder()
+	c.HandleBoostRequest(w, asUser(httptest.NewRequest("POST", "/boost", bytes.NewReader(b)), "jones"))
+	var res boostResult
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || w.Code != 200 {
+		t.Fatalf("unexpected boost response %d: %s\n", w.Code, w.Body.String())
+	}
+	boostTx = c.Broadcaster.(*MockBroadcaster).Sent[0]
+	c.UTXOs.(*MemoryUTXOs).AddTx(boostTx)
+	camp, _ = c.campaign(ctx, "jones-america-1", res.Campaign)
+
+	outputs = map[string]int{}
+	for _, id := range targets {
+		cp := ParseRoot(id)[0]
+		var q map[string]int
+		c.Shards[cp.Region][cp.Shard].RealtimeDB.NewRef("nodes/"+cp.Unik+"/queues/boost").Get(ctx, &q)
+		for _, i := range q {
+			outputs[id] = i
+		}
+	}
+	return boostTx, camp, targets, outputs
+}
+
+func testClaim(c *Server, uid string, cr claimRequest) *httptest.ResponseRecorder {
+	b, _ := json.Marshal(cr)
+	w := httptest.NewRecorder()
+	c.HandleClaimBoost(w, asUser(httptest.NewRequest("POST", "/boost/claim", bytes.NewReader(b)), uid))
+	return w
+}
+
+func TestClaimBoost(t *testing.T) {
+	ctx := context.Background()
+	c := newTestServer(t)
+	boostTx, camp, targets, outputs := testCampaign(t, c)
+	mock, boostId := c.Broadcaster.(*MockBroadcaster), camp.Packs[0].BoostId
+
+	pkh := RandomBytes(20)
+	addr := c.Network.EncodeAddress(pkh)
+	claim := func(uid string, cr claimRequest) *httptest.ResponseRecorder { return testClaim(c, uid, cr) }
+	request := func(id string) claimRequest {
+		return claimRequest{UserID: id, BoostID: boostId, Index: outputs[id], Address: addr}
+	}
+
+	// claims don't look the boost tx up
+	utxos := c.UTXOs
+	c.UTXOs = NewMemoryUTXOs()
+	rimouski := request(targets[0])
+	w := claim("rimouski", rimouski)
+	c.UTXOs = utxos
+	var cres claimResult
+	if err := json.Unmarshal(w.Body.Bytes(), &cres); err != nil || w.Code != 200 {
+		t.Fatalf("unexpected claim response %d: %s\n", w.Code, w.Body.String())
+	}
+	claimTx, err := ParseTx(mock.Sent[len(mock.Sent)-1])
+	if err != nil {
+		t.Fatalf("error parsing claim tx: %v\n", err)
+	}
+	prevout, _ := c.UTXOs.Prevout(ctx, Txid(boostTx), uint32(rimouski.Index))
+	if err := claimTx.VerifyInputs([]*Prevout{prevout}); err != nil {
+		t.Fatalf("claim doesn't spend the boost output: %v\n", err)
+	}
+	lock, _ := p2pkh(pkh)
+	out := claimTx.txouts[0]
+	fee := c.FeePolicy(ctx).Fee(len(claimTx.Raw()))
+	if len(claimTx.txouts) != 1 || !bytes.Equal(out.script, lock) || out.sats != 100-fee || cres.Sats != out.sats ||
+		cres.Txid != explorerTxid(claimTx.Txid()) {
+		t.Fatalf("unexpected claim %+v of %d sats\n", cres, out.sats)
+	}
+	if camp, _ = c.campaign(ctx, camp.Sender, camp.Id); camp.Status != CampaignPartiallyClaimed || camp.Claimed != 1 {
+		t.Fatalf("unexpected campaign after a claim %+v\n", camp)
+	}
+
+	for name, tc := range map[string]struct {
+		uid  string
+		cr   claimRequest
+		code int
+	}{
+		"twice":          {"rimouski", rimouski, 409},
+		"someone else's": {"bic", claimRequest{UserID: targets[1], BoostID: boostId, Index: rimouski.Index, Address: addr}, 403},
+		"not the caller": {"bic", rimouski, 403},
+		"unknown boost":  {"rimouski", claimRequest{UserID: targets[0], BoostID: "nope-america-0", Address: addr}, 404},
+		"out of pack":    {"rimouski", claimRequest{UserID: targets[0], BoostID: boostId, Index: len(targets), Address: addr}, 400},
+		"bad address":    {"rimouski", claimRequest{UserID: targets[0], BoostID: boostId, Address: "nope"}, 400},
+	} {
+		if w := claim(tc.uid, tc.cr); w.Code != tc.code {
+			t.Errorf("%s: expected %d, got %d %s\n", name, tc.code, w.Code, w.Body.String())
+		}
+	}
+
+	// a claim that isn't broadcast can be made again
+	mock.Err = &BroadcastError{Provider: providerMock, Message: "rejected"}
+	if w := claim("bic", request(targets[1])); w.Code == 200 {
+		t.Fatalf("expected the claim to fail, got %s\n", w.Body.String())
+	}
+	mock.Err = nil
+	mock.Fees = &FeePolicy{Dust: 100}
+	if w := claim("bic", request(targets[1])); w.Code != 400 || !bytes.Contains(w.Body.Bytes(), []byte(codeDustClaim)) {
+		t.Fatalf("expected %s, got %d %s\n", codeDustClaim, w.Code, w.Body.String())
+	}
+	mock.Fees = nil
+	for i, id := range targets[1:] {
+		if w := claim(ParseRoot(id)[0].Unik, request(id)); w.Code != 200 {
+			t.Fatalf("claim %d: unexpected response %d %s\n", i, w.Code, w.Body.String())
+		}
+	}
+	if camp, _ = c.campaign(ctx, camp.Sender, camp.Id); camp.Status != CampaignClaimed || camp.Claimed != len(targets) {
+		t.Fatalf("expected a claimed campaign, got %+v\n", camp)
+	}
+}
@@ -0,0 +1,144 @@
+// down4d serves the backend handlers over plain http, for our own VMs or
+// for local runs. To run against the firebase emulators, set the usual
+// FIREBASE_DATABASE_EMULATOR_HOST, FIRESTORE_EMULATOR_HOST and
+// STORAGE_EMULATOR_HOST variables and point -config at emulator urls.
+// With -memory there is no firebase auth, tokens are checked against the
+// key set at DOWN4_AUTH_KEYS (or auth.keySetFile in the config), boosts
+// can only spend the outputs of the txs in utxoFile and are broadcast in
+// process unless the config lists broadcast providers. The same binary runs
+// testnet staging and mainnet production, see network in the config or
+// DOWN4_NETWORK. Every -sweep-every, the boosts past boostTTLHours are
+// refunded to their senders, nothing else sweeps them: without the flag
+// expired boosts are never refunded. Once after upgrading to boosts over
+// geohash1 to geohash6, run with -backfill-geohashes to index the existing
+// users
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	backend "github.com/coldstar-507/backend"
+)
+
+func main() {
+	var (
+		addr            = flag.String("addr", ":8080", "listen address")
+		configPath      = flag.String("config", "", "config file, defaults to $DOWN4_CONFIG, $DOWN4_SHARDS or the embedded config")
+		memory          = flag.Bool("memory", false, "use in-memory stores instead of firebase")
+		maxBody         = flag.Int64("max-body", backend.DefaultMaxBodyBytes, "max request body in bytes")
+		readTimeout     = flag.Duration("read-timeout", 30*time.Second, "max duration for reading a request")
+		writeTimeout    = flag.Duration("write-timeout", 2*time.Minute, "max duration for writing a response")
+		idleTimeout     = flag.Duration("idle-timeout", 2*time.Minute, "max keep-alive idle duration")
+		shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "grace period for in-flight requests")
+		sweepEvery      = flag.Duration("sweep-every", 10*time.Minute, "how often expired boosts are refunded, 0 to never")
+		backfill        = flag.Bool("backfill-geohashes", false, "index the users without geohash1 to geohash6 at startup")
+	)
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var cfg *backend.Config
+	var err error
+	if len(*configPath) > 0 {
+		cfg, err = backend.LoadConfigFile(*configPath)
+	} else {
+		cfg, err = backend.LoadConfig()
+	}
+	if err != nil {
+		log.Fatalf("error loading config: %v\n", err)
+	}
+
+	var srv *backend.Server
+	if *memory {
+		srv = backend.NewMemoryServer(cfg)
+		ks, err := cfg.Auth.KeySet()
+		if err != nil {
+			log.Fatalf("error loading key set: %v\n", err)
+		}
+		if ks == nil {
+			log.Fatalln("-memory needs a local key set, see DOWN4_AUTH_KEYS")
+		}
+		srv.Verifier = ks
+		if len(cfg.Broadcast.Providers) > 0 {
+			srv.Broadcaster, srv.CallbackToken = cfg.Broadcast.Broadcaster(cfg.Net()), cfg.Broadcast.CallbackToken()
+		}
+		if len(cfg.UTXOFile) > 0 {
+			if srv.UTXOs, err = backend.LoadUTXOFile(cfg.UTXOFile); err != nil {
+				log.Fatalf("error loading utxos: %v\n", err)
+			}
+		}
+	} else if srv, err = backend.NewServer(ctx, cfg); err != nil {
+		log.Fatalf("error initializing server: %v\n", err)
+	}
+
+	hs := &http.Server{
+		Addr:              *addr,
+		Handler:           srv.Handler(*maxBody),
+		ReadTimeout:       *readTimeout,
+		ReadHeaderTimeout: *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		log.Printf("down4d listening on %s, on %s\n", *addr, srv.Network)
+		errc <- hs.ListenAndServe()
+	}()
+
+	if *backfill {
+		go func() {
+			if _, err := srv.BackfillGeohashes(ctx); err != nil {
+				log.Printf("error backfilling geohashes: %v\n", err)
+			}
+		}()
+	}
+
+	if *sweepEvery > 0 {
+		go sweep(ctx, srv, *sweepEvery)
+	}
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("error serving: %v\n", err)
+			os.Exit(1)
+		}
+	case <-ctx.Done():
+		log.Println("shutting down")
+		sctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := hs.Shutdown(sctx); err != nil {
+			log.Printf("error shutting down: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+func sweep(ctx context.Context, srv *backend.Server, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			refunded, err := srv.SweepExpired(ctx, now)
+			if err != nil {
+				log.Printf("error sweeping expired boosts: %v\n", err)
+			}
+			if len(refunded) > 0 {
+				log.Printf("refunded %d expired boosts\n", len(refunded))
+			}
+		}
+	}
+}
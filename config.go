@@ -0,0 +1,319 @@
+package backend
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// The shard topology is read from the file at DOWN4_CONFIG if set,
+// otherwise from the inline json in DOWN4_SHARDS, otherwise we fall back
+// on the production topology embedded from default_config.json.
+// FIREBASE_CONFIG points to the service account unless the config does,
+// and DOWN4_AUTH_KEYS to a local id token key set, see KeySetVerifier.
+// DOWN4_NETWORK picks mainnet or testnet unless the config does
+const (
+	configFileEnv  = "DOWN4_CONFIG"
+	configJsonEnv  = "DOWN4_SHARDS"
+	credentialsEnv = "FIREBASE_CONFIG"
+	authKeysEnv    = "DOWN4_AUTH_KEYS"
+	networkEnv     = "DOWN4_NETWORK"
+)
+
+//go:embed default_config.json
+var defaultConfig []byte
+
+type ShardConfig struct {
+	DatabaseURL  string `json:"databaseURL"`
+	TempBucket   string `json:"tempBucket"`
+	StaticBucket string `json:"staticBucket"`
+}
+
+// AuthConfig picks how id tokens are verified, by firebase auth unless
+// KeySetFile is set, then tokens must be signed by one of its keys
+type AuthConfig struct {
+	ProjectID  string `json:"projectId"`
+	KeySetFile string `json:"keySetFile"`
+}
+
+type Config struct {
+	CredentialsFile string `json:"credentialsFile"`
+	// mainnet or testnet, testnet when empty, see Net
+	Network Network `json:"network"`
+	// region name -> shards, a shard index in an id is an index in that list
+	Regions map[string][]ShardConfig `json:"regions"`
+	Auth    AuthConfig               `json:"auth"`
+	// raw txs whose outputs are the only utxos boosts can spend, instead
+	// of looking them up on whatsonchain, see LoadUTXOFile
+	UTXOFile  string          `json:"utxoFile"`
+	Broadcast BroadcastConfig `json:"broadcast"`
+	// what boosts pay at least, the network relay policy when unset. A
+	// broadcaster quoting higher fees wins, see Server.FeePolicy
+	Fees *FeePolicy `json:"fees"`
+	// hours boosted people have to claim, then what's left goes back to
+	// the sender, see Server.SweepExpired. 30 days when unset
+	BoostTTLHours int `json:"boostTTLHours"`
+}
+
+// Net is the network of the deployment
+func (c *Config) Net() Network {
+	if len(c.Network) == 0 {
+		return defaultNetwork
+	}
+	return c.Network
+}
+
+// FeePolicy is the configured fees or the network ones
+func (c *Config) FeePolicy() FeePolicy {
+	if c.Fees == nil {
+		return c.Net().FeePolicy()
+	}
+	return *c.Fees
+}
+
+const defaultBoostTTL = 30 * 24 * time.Hour
+
+// BoostTTL is how long boosts can be claimed
+func (c *Config) BoostTTL() time.Duration {
+	if c.BoostTTLHours == 0 {
+		return defaultBoostTTL
+	}
+	return time.Duration(c.BoostTTLHours) * time.Hour
+}
+
+// BroadcastConfig lists the providers boost txs are broadcast with, tried
+// in order, see MultiBroadcaster. Without any we post to whatsonchain.
+// Providers without a url get the one of the network
+type BroadcastConfig struct {
+	Providers []ProviderConfig `json:"providers"`
+	Retries   int              `json:"retries"`
+	BackoffMs int              `json:"backoffMs"`
+}
+
+// ProviderConfig is one broadcaster, Kind is whatsonchain, arc or mock.
+// Secrets stay out of config files, the api key and the callback token are
+// read from the env variables named by APIKeyEnv and CallbackTokenEnv
+type ProviderConfig struct {
+	Kind             string `json:"kind"`
+	URL              string `json:"url"`
+	APIKeyEnv        string `json:"apiKeyEnv"`
+	CallbackURL      string `json:"callbackUrl"`
+	CallbackTokenEnv string `json:"callbackTokenEnv"`
+}
+
+const (
+	defaultBroadcastRetries = 2
+	defaultBroadcastBackoff = 500 * time.Millisecond
+	maxBroadcastRetries     = 10
+)
+
+// Broadcaster builds the providers in order for net
+func (b BroadcastConfig) Broadcaster(net Network) *MultiBroadcaster {
+	m := &MultiBroadcaster{Retries: b.Retries, Backoff: time.Duration(b.BackoffMs) * time.Millisecond}
+	if len(b.Providers) == 0 {
+		m.Retries = defaultBroadcastRetries
+		m.Providers = []Broadcaster{&WhatsOnChainBroadcaster{BaseURL: net.WhatsOnChainURL()}}
+	}
+	if m.Backoff == 0 {
+		m.Backoff = defaultBroadcastBackoff
+	}
+	for _, p := range b.Providers {
+		switch p.Kind {
+		case providerWhatsOnChain:
+			url := p.URL
+			if len(url) == 0 {
+				url = net.WhatsOnChainURL()
+			}
+			m.Providers = append(m.Providers, &WhatsOnChainBroadcaster{BaseURL: url, APIKey: os.Getenv(p.APIKeyEnv)})
+		case providerARC:
+			url := p.URL
+			if len(url) == 0 {
+				url = net.ARCURL()
+			}
+			m.Providers = append(m.Providers, &ARCBroadcaster{
+				BaseURL:       url,
+				APIKey:        os.Getenv(p.APIKeyEnv),
+				CallbackURL:   p.CallbackURL,
+				CallbackToken: os.Getenv(p.CallbackTokenEnv),
+			})
+		case providerMock:
+			m.Providers = append(m.Providers, NewMockBroadcaster())
+		}
+	}
+	return m
+}
+
+// CallbackToken is what ARC callbacks have to carry, empty when no provider
+// asks for callbacks
+func (b BroadcastConfig) CallbackToken() string {
+	for _, p := range b.Providers {
+		if p.Kind == providerARC && len(p.CallbackURL) > 0 {
+			return os.Getenv(p.CallbackTokenEnv)
+		}
+	}
+	return ""
+}
+
+// Validate refuses providers pointed at the public endpoints of another
+// network than net
+func (b BroadcastConfig) Validate(net Network) error {
+	if b.Retries < 0 || b.Retries > maxBroadcastRetries {
+		return fmt.Errorf("invalid config: broadcast retries must be within 0 and %d", maxBroadcastRetries)
+	}
+	if b.BackoffMs < 0 {
+		return errors.New("invalid config: negative broadcast backoff")
+	}
+	callbacks := 0
+	for i, p := range b.Providers {
+		where := fmt.Sprintf("broadcast provider %d", i)
+		switch p.Kind {
+		case providerWhatsOnChain, providerARC, providerMock:
+		default:
+			return fmt.Errorf("invalid config: %s has unknown kind %q", where, p.Kind)
+		}
+		if len(p.URL) > 0 {
+			if u, err := url.Parse(p.URL); err != nil || len(u.Host) == 0 {
+				return fmt.Errorf("invalid config: %s has bad url %q", where, p.URL)
+			}
+			for other, params := range networks {
+				trimmed := strings.TrimSuffix(p.URL, "/")
+				if other != net && (trimmed == params.whatsOnChainURL || trimmed == params.arcURL) {
+					return fmt.Errorf("invalid config: %s is on %s, we are on %s", where, other, net)
+				}
+			}
+		}
+		if len(p.CallbackURL) == 0 {
+			continue
+		}
+		if p.Kind != providerARC {
+			return fmt.Errorf("invalid config: %s is %s, only arc has callbacks", where, p.Kind)
+		}
+		if len(p.CallbackTokenEnv) == 0 {
+			return fmt.Errorf("invalid config: %s has a callbackUrl without callbackTokenEnv", where)
+		}
+		if callbacks++; callbacks > 1 {
+			return fmt.Errorf("invalid config: %s, only one provider can have callbacks", where)
+		}
+	}
+	return nil
+}
+
+// KeySet loads the local key set, it is nil when none is configured
+func (a AuthConfig) KeySet() (*KeySetVerifier, error) {
+	if len(a.KeySetFile) == 0 {
+		return nil, nil
+	}
+	return LoadKeySet(a.KeySetFile, a.ProjectID)
+}
+
+func LoadConfig() (*Config, error) {
+	if path := os.Getenv(configFileEnv); len(path) > 0 {
+		return LoadConfigFile(path)
+	}
+
+	raw := defaultConfig
+	if env := os.Getenv(configJsonEnv); len(env) > 0 {
+		raw = []byte(env)
+	}
+	return withEnv(ParseConfig(raw))
+}
+
+func LoadConfigFile(path string) (*Config, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file %s: %v", path, err)
+	}
+	return withEnv(ParseConfig(raw))
+}
+
+func withEnv(cfg *Config, err error) (*Config, error) {
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.CredentialsFile) == 0 {
+		cfg.CredentialsFile = os.Getenv(credentialsEnv)
+	}
+	if len(cfg.Auth.KeySetFile) == 0 {
+		cfg.Auth.KeySetFile = os.Getenv(authKeysEnv)
+	}
+	if len(cfg.Network) == 0 {
+		cfg.Network = Network(os.Getenv(networkEnv))
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func ParseConfig(raw []byte) (*Config, error) {
+	var cfg Config
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("error decoding config: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func (c *Config) Validate() error {
+	if len(c.Regions) == 0 {
+		return errors.New("invalid config: no regions")
+	}
+	if len(c.Auth.KeySetFile) > 0 && len(c.Auth.ProjectID) == 0 {
+		return errors.New("invalid config: a key set needs a projectId")
+	}
+	if len(c.Network) > 0 {
+		if err := c.Network.Validate(); err != nil {
+			return fmt.Errorf("invalid config: %v", err)
+		}
+	}
+	if err := c.Broadcast.Validate(c.Net()); err != nil {
+		return err
+	}
+	if c.Fees != nil {
+		if err := c.Fees.Validate(); err != nil {
+			return fmt.Errorf("invalid config: %v", err)
+		}
+	}
+	if c.BoostTTLHours < 0 {
+		return errors.New("invalid config: negative boost ttl")
+	}
+
+	dbs, buckets := map[string]bool{}, map[string]bool{}
+	for reg, shards := range c.Regions {
+		// regions are part of hyphen separated ids, see ParseRoot
+		if len(reg) == 0 || strings.Contains(reg, "-") {
+			return fmt.Errorf("invalid config: bad region name %q", reg)
+		}
+		if len(shards) == 0 {
+			return fmt.Errorf("invalid config: region %s has no shards", reg)
+		}
+		for i, s := range shards {
+			where := fmt.Sprintf("%s[%d]", reg, i)
+			u, err := url.Parse(s.DatabaseURL)
+			if err != nil || (u.Scheme != "https" && u.Scheme != "http") || len(u.Host) == 0 {
+				return fmt.Errorf("invalid config: %s has bad databaseURL %q", where, s.DatabaseURL)
+			}
+			if len(s.TempBucket) == 0 || len(s.StaticBucket) == 0 {
+				return fmt.Errorf("invalid config: %s is missing a bucket", where)
+			}
+			if dbs[s.DatabaseURL] {
+				return fmt.Errorf("invalid config: %s reuses databaseURL %s", where, s.DatabaseURL)
+			}
+			dbs[s.DatabaseURL] = true
+			for _, b := range []string{s.TempBucket, s.StaticBucket} {
+				if buckets[b] {
+					return fmt.Errorf("invalid config: %s reuses bucket %s", where, b)
+				}
+				buckets[b] = true
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package backend
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+)
+
+// dryRunResult is what a boost would do. Reach is per area in the order of
+// the request, the areas after the limit is reached get 0. Cost is what
+// the boosted heads and the fee take out of the inputs, and Change is what
+// is left of inputSats, negative when they don't cover Quote.Required
+type dryRunResult struct {
+	Reach   []int       `json:"reach"`
+	Targets int         `json:"targets"`
+	Quote   *BoostQuote `json:"quote,omitempty"`
+	Cost    uint64      `json:"cost"`
+	Change  int64       `json:"change"`
+	Funded  bool        `json:"funded"`
+}
+
+// HandleBoostDryRun runs the targeting of a boost request without writing
+// boosts or broadcasting anything. The partial tx is optional and can be
+// unsigned, without one the fee is for a single p2pkh input
+func (s *Server) HandleBoostDryRun(w http.ResponseWriter, r *http.Request) {
+	res, err := s.handleBoostDryRun(r.Context(), r)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	writeJson(w, res)
+}
+
+func (s *Server) handleBoostDryRun(ctx context.Context, r *http.Request) (*dryRunResult, error) {
+	var br boostRequest2
+	if err := json.NewDecoder(r.Body).Decode(&br); err != nil {
+		return nil, bodyError(codeInvalidJson, "error decoding boostRequest", err)
+	}
+	if err := br.checkTargeting(); err != nil {
+		return nil, err
+	}
+
+	tx := &Tx{versionNo: 1, nIns: makeVarInt(1), txins: []*Txin{{txid: make([]byte, 32), scriptLen: makeVarInt(0)}}}
+	if len(br.PartialTx) > 0 {
+		txbuf, err := base64.StdEncoding.DecodeString(br.PartialTx)
+		if err != nil {
+			return nil, badRequest(codeInvalidRequest, "error decoding base64 partial tx", err)
+		}
+		if tx, err = ParseTx(txbuf); err != nil {
+			return nil, badRequest(codeInvalidRequest, "error parsing partial tx", err)
+		}
+	}
+
+	users, reach, err := s.scanAreas(ctx, &br)
+	if err != nil {
+		return nil, badGateway(codeQueryFailed, "error finding boost targets", true, err)
+	}
+	res := &dryRunResult{Reach: reach, Targets: len(users)}
+	if res.Targets == 0 {
+		return res, nil
+	}
+	q, err := QuoteBoost(tx, res.Targets, uint64(br.PricePerHead), s.FeePolicy(ctx))
+	if err != nil {
+		return nil, badRequest(codeInvalidRequest, "error quoting boost", err)
+	}
+	res.Quote, res.Cost = q, q.Boosted+q.Fee
+	res.Change = int64(br.InputSats) - int64(res.Cost)
+	res.Funded = br.InputSats > 0 && uint64(br.InputSats) >= q.Required
+	return res, nil
+}
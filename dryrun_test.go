@@ -0,0 +1,110 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestBoostDryRun(t *testing.T) {
+	ctx := context.Background()
+	c := newTestServer(t)
+	targets := seedBoostUsers(c.Firestore.(*MemoryDocs))
+
+	// the test area moved a few degrees north, where nobody is
+	empty := testBoostRequest().Areas[0]
+	empty.Center.Lat += 5
+	for i := range empty.Perim {
+		empty.Perim[i].Lat += 5
+	}
+
+	dryRun := func(f func(br *boostRequest2)) (*httptest.ResponseRecorder, *dryRunResult) {
+		br := testBoostRequest()
+		br.Areas = append([]area{empty}, br.Areas...)
+		f(br)
+		b, _ := json.Marshal(br)
+		w := httptest.NewRecorder()
+		c.HandleBoostDryRun(w, asUser(httptest.NewRequest("POST", "/boost/dryrun", bytes.NewReader(b)), "jones"))
+		var res dryRunResult
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return w, &res
+	}
+
+	w, res := dryRun(func(*boostRequest2) {})
+	if w.Code != 200 || res.Targets != len(targets) || !reflect.DeepEqual(res.Reach, []int{0, len(targets)}) {
+		t.Fatalf("unexpected dry run %d %s\n", w.Code, w.Body.String())
+	}
+	tx, _ := ParseTx(testPartialTx(t))
+	q, _ := QuoteBoost(tx, len(targets), 100, c.FeePolicy(ctx))
+	if *res.Quote != *q || res.Cost != q.Boosted+q.Fee || res.Change != 49049-int64(res.Cost) || !res.Funded {
+		t.Fatalf("unexpected dry run quote %s\n", w.Body.String())
+	}
+
+	// stops at the limit, the unsigned tx and its inputs aren't checked
+	w, res = dryRun(func(br *boostRequest2) {
+		unsigned, _ := ParseTx(testPartialTx(t))
+		unsigned.txins[0].script, unsigned.txins[0].scriptLen = nil, makeVarInt(0)
+		br.PartialTx, br.Limit, br.InputSats = base64.StdEncoding.EncodeToString(unsigned.Raw()), 2, 150
+		br.Areas = append(br.Areas, br.Areas[1])
+	})
+	if w.Code != 200 || res.Targets != 2 || !reflect.DeepEqual(res.Reach, []int{0, 2, 0}) || res.Funded || res.Change >= 0 {
+		t.Fatalf("unexpected limited dry run %d %s\n", w.Code, w.Body.String())
+	}
+
+	// overlapping areas reach their users once
+	_, res = dryRun(func(br *boostRequest2) {
+		br.Areas = append(br.Areas, area{Type: areaCircle, Center: br.Areas[1].Center, RadiusKm: 5})
+	})
+	if res.Targets != len(targets) || !reflect.DeepEqual(res.Reach, []int{0, len(targets), 0}) {
+		t.Fatalf("expected %d targets once each, got %+v\n", len(targets), res)
+	}
+
+	// no partial tx is sized as a single p2pkh input
+	_, res = dryRun(func(br *boostRequest2) { br.PartialTx = "" })
+	if res.Quote == nil || res.Quote.Size != BoostTxSize(tx, len(targets))+p2pkhUnlockSize-len(tx.txins[0].script) {
+		t.Fatalf("unexpected dry run without a tx %+v\n", res.Quote)
+	}
+
+	// 3 km around rimouski is everyone but the one 11 km north
+	center := latlon{Lat: 48.8465, Lon: -67.5271}
+	for _, a := range []area{
+		{Type: areaCircle, Center: center, RadiusKm: 3},
+		{Type: areaBox, Box: &boundingBox{South: 48.8, West: -67.6, North: 48.9, East: -67.5}},
+	} {
+		if _, res = dryRun(func(br *boostRequest2) { br.Areas = []area{a} }); res.Targets != len(targets) {
+			t.Fatalf("expected %d targets in the %s, got %+v\n", len(targets), a.Type, res)
+		}
+	}
+
+	if _, res = dryRun(func(br *boostRequest2) { br.MinAge, br.MaxAge = 90, 99 }); res.Targets != 0 || res.Quote != nil {
+		t.Fatalf("expected nobody to reach, got %+v\n", res)
+	}
+	for name, f := range map[string]func(*boostRequest2){
+		"no limit": func(br *boostRequest2) { br.Limit = 0 },
+		"no price": func(br *boostRequest2) { br.PricePerHead = 0 },
+		"bad tx":   func(br *boostRequest2) { br.PartialTx = "AAEC" },
+		"bad area": func(br *boostRequest2) { br.Areas[1].Perim = br.Areas[1].Perim[:2] },
+		"no areas": func(br *boostRequest2) { br.Areas = nil },
+	} {
+		if w, _ := dryRun(f); w.Code != 400 {
+			t.Errorf("%s: expected 400, got %d %s\n", name, w.Code, w.Body.String())
+		}
+	}
+
+	// nothing was broadcast or written
+	if sent := c.Broadcaster.(*MockBroadcaster).Sent; len(sent) != 0 {
+		t.Fatalf("expected no broadcast, got %d txs\n", len(sent))
+	}
+	for _, id := range targets {
+		cp := ParseRoot(id)[0]
+		var q map[string]int
+		c.Shards[cp.Region][cp.Shard].RealtimeDB.NewRef("nodes/"+cp.Unik+"/queues/boost").Get(ctx, &q)
+		if len(q) != 0 {
+			t.Fatalf("expected no boost for %s, got %v\n", id, q)
+		}
+	}
+}
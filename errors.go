@@ -0,0 +1,104 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// Error is what a handler answers with when it fails, it is rendered as
+// {"error": {"code", "message", "retryable"}} with Status as status code
+type Error struct {
+	Status    int    `json:"-"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Retryable bool   `json:"retryable"`
+	Err       error  `json:"-"`
+}
+
+const (
+	codeInvalidJson      = "invalid_json"
+	codeInvalidRequest   = "invalid_request"
+	codeInvalidTx        = "invalid_tx"
+	codeInvalidAddress   = "invalid_address"
+	codeUnderfunded      = "underfunded"
+	codeBodyTooLarge     = "body_too_large"
+	codeBadMethod        = "method_not_allowed"
+	codeNoBoostTargets   = "no_boost_targets"
+	codeNoCampaign       = "no_campaign"
+	codeNoBoost          = "no_boost"
+	codeNoUser           = "no_user"
+	codeAlreadyClaimed   = "already_claimed"
+	codeDustClaim        = "dust_claim"
+	codeBroadcastFailed  = "broadcast_failed"
+	codeDoubleSpend      = "double_spend"
+	codeUTXOLookupFailed = "utxo_lookup_failed"
+	codeQueryFailed      = "query_failed"
+	codeWriteFailed      = "write_failed"
+	codeConflict         = "conflict"
+	codeInternal         = "internal"
+)
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func badRequest(code, msg string, err error) *Error {
+	return &Error{Status: http.StatusBadRequest, Code: code, Message: msg, Err: err}
+}
+
+// bodyError is a bad request unless the body went over the router limit
+func bodyError(code, msg string, err error) *Error {
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		return &Error{Status: http.StatusRequestEntityTooLarge, Code: codeBodyTooLarge, Message: msg, Err: err}
+	}
+	return badRequest(code, msg, err)
+}
+
+func notFound(code, msg string, err error) *Error {
+	return &Error{Status: http.StatusNotFound, Code: code, Message: msg, Err: err}
+}
+
+func conflict(msg string, err error) *Error {
+	return &Error{Status: http.StatusConflict, Code: codeConflict, Message: msg, Retryable: true, Err: err}
+}
+
+func badGateway(code, msg string, retryable bool, err error) *Error {
+	return &Error{Status: http.StatusBadGateway, Code: code, Message: msg, Retryable: retryable, Err: err}
+}
+
+func internal(code, msg string, err error) *Error {
+	return &Error{Status: http.StatusInternalServerError, Code: code, Message: msg, Retryable: true, Err: err}
+}
+
+// WriteError renders err, anything that isn't an *Error is an internal error
+// and its details stay in the logs
+func WriteError(w http.ResponseWriter, err error) {
+	var e *Error
+	if !errors.As(err, &e) {
+		e = internal(codeInternal, "internal error", err)
+	}
+	log.Printf("error %d %s: %v\n", e.Status, e.Code, e)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	if err := json.NewEncoder(w).Encode(map[string]*Error{"error": e}); err != nil {
+		log.Printf("error writing error response: %v\n", err)
+	}
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("error writing response: %v\n", err)
+	}
+}
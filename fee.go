@@ -0,0 +1,249 @@
+package backend
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// FeePolicy is what boost txs pay to get mined, SatsPerKB for every 1000
+// bytes rounded up and never under MinFee. No output, the change included,
+// can hold less than Dust
+type FeePolicy struct {
+	SatsPerKB uint64 `json:"satsPerKB"`
+	MinFee    uint64 `json:"minFee"`
+	Dust      uint64 `json:"dust"`
+}
+
+func (f FeePolicy) Validate() error {
+	if f.Dust == 0 {
+		return errors.New("dust must be at least 1 sat")
+	}
+	if f.SatsPerKB > math.MaxUint32 || f.MinFee > math.MaxUint32 || f.Dust > math.MaxUint32 {
+		return errors.New("fees over 42 bsv")
+	}
+	return nil
+}
+
+// Fee is what a tx of size bytes pays
+func (f FeePolicy) Fee(size int) uint64 {
+	fee := (uint64(size)*f.SatsPerKB + 999) / 1000
+	if fee < f.MinFee {
+		return f.MinFee
+	}
+	return fee
+}
+
+// stricter takes the highest of every field of f and o
+func (f FeePolicy) stricter(o FeePolicy) FeePolicy {
+	if o.SatsPerKB > f.SatsPerKB {
+		f.SatsPerKB = o.SatsPerKB
+	}
+	if o.MinFee > f.MinFee {
+		f.MinFee = o.MinFee
+	}
+	if o.Dust > f.Dust {
+		f.Dust = o.Dust
+	}
+	return f
+}
+
+// FeeQuoter is a broadcaster that can tell what its miners charge
+type FeeQuoter interface {
+	FeePolicy(ctx context.Context) (*FeePolicy, error)
+}
+
+var errNoFeeQuote = errors.New("no provider quotes fees")
+
+// FeePolicy is what boosts pay right now, the stricter of the configured
+// policy and the quote of the broadcaster when it has one
+func (s *Server) FeePolicy(ctx context.Context) FeePolicy {
+	fees := s.Fees
+	q, ok := s.Broadcaster.(FeeQuoter)
+	if !ok {
+		return fees
+	}
+	quote, err := q.FeePolicy(ctx)
+	if err != nil {
+		if !errors.Is(err, errNoFeeQuote) {
+			NonFatal(err, "error getting a fee quote, using the configured fees")
+		}
+		return fees
+	}
+	return fees.stricter(*quote)
+}
+
+// exact sizes, a boost output is OP_SHA1 <s3> OP_EQUAL and the change a
+// p2pkh. An input that isn't signed yet will be unlocked by a p2pkh
+// signature of at most 72 bytes and its sighash byte and a compressed pubkey
+const (
+	boostOutSize    = 8 + 1 + 1 + 1 + 20 + 1
+	p2pkhOutSize    = 8 + 1 + 25
+	p2pkhUnlockSize = 1 + 73 + 1 + 33
+)
+
+// BoostTxSize is the size t will have with nout boost outputs and the
+// change, in place of the outputs it has
+func BoostTxSize(t *Tx, nout int) int {
+	size := 4 + len(makeVarInt(uint64(len(t.txins))).data) + 4 // version, nIns, nLockTime
+	for _, tin := range t.txins {
+		script := len(tin.script)
+		if script == 0 {
+			script = p2pkhUnlockSize
+		}
+		size += 32 + 4 + len(makeVarInt(uint64(script)).data) + script + 4
+	}
+	return size + len(makeVarInt(uint64(nout+1)).data) + nout*boostOutSize + p2pkhOutSize
+}
+
+// BoostQuote is what a boost of Outputs heads at PricePerHead costs,
+// inputs need at least Required sats, anything over it is change
+type BoostQuote struct {
+	Fees         FeePolicy `json:"fees"`
+	Outputs      int       `json:"outputs"`
+	PricePerHead uint64    `json:"pph"`
+	Size         int       `json:"size"`
+	Fee          uint64    `json:"fee"`
+	Boosted      uint64    `json:"boosted"`
+	Required     uint64    `json:"required"`
+}
+
+func QuoteBoost(t *Tx, nout int, pph uint64, fees FeePolicy) (*BoostQuote, error) {
+	if nout <= 0 || nout > maxBoostOutputs {
+		return nil, fmt.Errorf("invalid number of outputs: %d", nout)
+	}
+	if pph < fees.Dust {
+		return nil, fmt.Errorf("price per head %d is under the %d sats dust limit", pph, fees.Dust)
+	}
+	q := &BoostQuote{Fees: fees, Outputs: nout, PricePerHead: pph, Size: BoostTxSize(t, nout)}
+	q.Fee, q.Boosted = fees.Fee(q.Size), pph*uint64(nout)
+	q.Required = q.Boosted + q.Fee + fees.Dust
+	return q, nil
+}
+
+// boosts reach at most that many people, the tx of 1M outputs is already 32MB
+const maxBoostOutputs = 1_000_000
+
+type feeRequest struct {
+	PartialTx    string `json:"tx"`
+	PricePerHead int    `json:"pph"`
+	Limit        int    `json:"limit"`
+}
+
+// HandleBoostFee quotes a boost before the client signs its inputs, the
+// partial tx can have empty unlocking scripts. limit is the most people the
+// boost can reach, so the fee is an upper bound
+func (s *Server) HandleBoostFee(w http.ResponseWriter, r *http.Request) {
+	res, err := s.handleBoostFee(r.Context(), r)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	writeJson(w, res)
+}
+
+func (s *Server) handleBoostFee(ctx context.Context, r *http.Request) (*BoostQuote, error) {
+	var fr feeRequest
+	if err := json.NewDecoder(r.Body).Decode(&fr); err != nil {
+		return nil, bodyError(codeInvalidJson, "error decoding feeRequest", err)
+	}
+	if fr.PricePerHead <= 0 || fr.PricePerHead > math.MaxUint32 {
+		return nil, badRequest(codeInvalidRequest, fmt.Sprintf("invalid price per head: %v", fr.PricePerHead), nil)
+	}
+	txbuf, err := base64.StdEncoding.DecodeString(fr.PartialTx)
+	if err != nil {
+		return nil, badRequest(codeInvalidRequest, "error decoding base64 partial tx", err)
+	}
+	tx, err := ParseTx(txbuf)
+	if err != nil {
+		return nil, badRequest(codeInvalidRequest, "error parsing partial tx", err)
+	}
+	q, err := QuoteBoost(tx, fr.Limit, uint64(fr.PricePerHead), s.FeePolicy(ctx))
+	if err != nil {
+		return nil, badRequest(codeInvalidRequest, "error quoting boost", err)
+	}
+	return q, nil
+}
+
+// FeePolicy is the quote of the first provider that gives one
+func (m *MultiBroadcaster) FeePolicy(ctx context.Context) (*FeePolicy, error) {
+	err := errNoFeeQuote
+	for _, p := range m.Providers {
+		q, ok := p.(FeeQuoter)
+		if !ok {
+			continue
+		}
+		var fees *FeePolicy
+		if fees, err = q.FeePolicy(ctx); err == nil {
+			return fees, nil
+		} else if !errors.Is(err, errNoFeeQuote) {
+			log.Printf("error getting a fee quote: %v\n", err)
+		}
+	}
+	return nil, err
+}
+
+// ARC policies barely move, they're asked again after that long
+const arcPolicyTTL = time.Minute
+
+type arcPolicy struct {
+	Policy struct {
+		MiningFee struct {
+			Satoshis uint64 `json:"satoshis"`
+			Bytes    uint64 `json:"bytes"`
+		} `json:"miningFee"`
+	} `json:"policy"`
+}
+
+// FeePolicy reads the mining fee of /v1/policy, ARC has no dust or minimum
+// fee of its own so they are left to the config
+func (a *ARCBroadcaster) FeePolicy(ctx context.Context) (*FeePolicy, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.policy != nil && time.Since(a.policyAt) < arcPolicyTTL {
+		return a.policy, nil
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimSuffix(a.BaseURL, "/")+"/v1/policy", nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(a.APIKey) > 0 {
+		req.Header.Set("Authorization", "Bearer "+a.APIKey)
+	}
+	status, body, err := doBroadcast(ctx, a.Client, providerARC, req)
+	if err != nil {
+		return nil, err
+	}
+	if status != 200 {
+		return nil, fmt.Errorf("arc: unexpected policy response %d: %s", status, string(body))
+	}
+	var ap arcPolicy
+	if err := json.Unmarshal(body, &ap); err != nil {
+		return nil, fmt.Errorf("arc: error decoding policy: %v", err)
+	}
+	fee := ap.Policy.MiningFee
+	if fee.Bytes == 0 || fee.Satoshis > math.MaxUint32 {
+		return nil, fmt.Errorf("arc: invalid mining fee %d sats per %d bytes", fee.Satoshis, fee.Bytes)
+	}
+	a.policy = &FeePolicy{SatsPerKB: (fee.Satoshis*1000 + fee.Bytes - 1) / fee.Bytes}
+	a.policyAt = time.Now()
+	return a.policy, nil
+}
+
+// FeePolicy is Fees, or no quote at all when it isn't set
+func (m *MockBroadcaster) FeePolicy(ctx context.Context) (*FeePolicy, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.Fees == nil {
+		return nil, errNoFeeQuote
+	}
+	return m.Fees, nil
+}
@@ -0,0 +1,149 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+func TestBoostTxSize(t *testing.T) {
+	key, _ := btcec.NewPrivateKey()
+	// 252 outputs and the change still count in 1 byte, 253 need 3
+	for _, nout := range []int{1, 251, 252, 300} {
+		partial := signedPartialTx(t, key, 50000, sig_none)
+		size := BoostTxSize(partial, nout)
+		boostTx, err := BoostScript(partial, RandomBytes(20), nout, 100, 50000, RandomBytes(20), defaultFees)
+		if err != nil {
+			t.Fatalf("%d: error building boost tx: %v\n", nout, err)
+		}
+		if raw := boostTx.Raw(); size != len(raw) {
+			t.Fatalf("%d: estimated %d bytes, got %d\n", nout, size, len(raw))
+		}
+	}
+
+	// unsigned inputs count as the biggest p2pkh unlocking script
+	signed, err := ParseTx(testPartialTx(t))
+	if err != nil {
+		t.Fatalf("error parsing partial tx: %v\n", err)
+	}
+	unsigned, _ := ParseTx(testPartialTx(t))
+	unsigned.txins[0].script, unsigned.txins[0].scriptLen = nil, makeVarInt(0)
+	if grow := BoostTxSize(unsigned, 3) - BoostTxSize(signed, 3); grow < 0 || grow > 2 {
+		t.Fatalf("expected the unsigned estimate within 2 bytes over the signed size, got %d\n", grow)
+	}
+}
+
+func TestFeePolicy(t *testing.T) {
+	fees := FeePolicy{SatsPerKB: 50, MinFee: 10, Dust: 1}
+	for size, want := range map[int]uint64{0: 10, 100: 10, 1000: 50, 1001: 51, 20000: 1000} {
+		if got := fees.Fee(size); got != want {
+			t.Errorf("%d bytes: expected %d sats, got %d\n", size, want, got)
+		}
+	}
+	if got := fees.stricter(FeePolicy{SatsPerKB: 100, Dust: 546}); got != (FeePolicy{100, 10, 546}) {
+		t.Fatalf("unexpected stricter policy %+v\n", got)
+	}
+	if err := (FeePolicy{SatsPerKB: 1}).Validate(); err == nil {
+		t.Fatal("expected an error without dust")
+	}
+
+	tx, _ := ParseTx(testPartialTx(t))
+	q, err := QuoteBoost(tx, 3, 100, FeePolicy{SatsPerKB: 1, MinFee: 10, Dust: 1})
+	if err != nil || q.Fee != 10 || q.Boosted != 300 || q.Required != 311 {
+		t.Fatalf("unexpected quote %+v: %v\n", q, err)
+	}
+	if _, err := QuoteBoost(tx, 3, 100, FeePolicy{SatsPerKB: 1, Dust: 546}); err == nil {
+		t.Fatal("expected an error for outputs under dust")
+	}
+	if _, err := QuoteBoost(tx, 0, 100, fees); err == nil {
+		t.Fatal("expected an error without outputs")
+	}
+}
+
+func TestARCFeePolicy(t *testing.T) {
+	ctx := context.Background()
+	calls, policy := 0, `{"policy": {"maxtxsizepolicy": 10000000, "miningFee": {"satoshis": 1, "bytes": 20}}}`
+	arc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Method != "GET" || r.URL.Path != "/v1/policy" || r.Header.Get("Authorization") != "Bearer key" {
+			t.Errorf("unexpected request %s %s\n", r.Method, r.URL)
+		}
+		w.Write([]byte(policy))
+	}))
+	defer arc.Close()
+
+	m := &MultiBroadcaster{Providers: []Broadcaster{
+		&WhatsOnChainBroadcaster{BaseURL: arc.URL},
+		&ARCBroadcaster{BaseURL: arc.URL, APIKey: "key"},
+	}}
+	for i := 0; i < 2; i++ {
+		fees, err := m.FeePolicy(ctx)
+		if err != nil || fees.SatsPerKB != 50 {
+			t.Fatalf("unexpected policy %+v: %v\n", fees, err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected the policy to be cached, got %d calls\n", calls)
+	}
+
+	policy = `{"policy": {"miningFee": {"satoshis": 1, "bytes": 0}}}`
+	if _, err := (&ARCBroadcaster{BaseURL: arc.URL, APIKey: "key"}).FeePolicy(ctx); err == nil {
+		t.Fatal("expected an error for a fee per 0 bytes")
+	}
+	if _, err := (&MultiBroadcaster{Providers: []Broadcaster{NewMockBroadcaster()}}).FeePolicy(ctx); err != errNoFeeQuote {
+		t.Fatalf("expected %v, got %v\n", errNoFeeQuote, err)
+	}
+
+	// the configured fees are a floor and what's left when quotes fail
+	s := &Server{Fees: FeePolicy{SatsPerKB: 10, Dust: 1}, Broadcaster: m}
+	if got := s.FeePolicy(ctx); got.SatsPerKB != 50 {
+		t.Fatalf("expected the quoted rate, got %+v\n", got)
+	}
+	s.Broadcaster = &MultiBroadcaster{Providers: []Broadcaster{&ARCBroadcaster{BaseURL: arc.URL, APIKey: "key"}}}
+	if got := s.FeePolicy(ctx); got != s.Fees {
+		t.Fatalf("expected the configured fees, got %+v\n", got)
+	}
+}
+
+func TestBoostFee(t *testing.T) {
+	c := newTestServer(t)
+	c.Broadcaster.(*MockBroadcaster).Fees = &FeePolicy{SatsPerKB: 500}
+
+	unsigned, _ := ParseTx(testPartialTx(t))
+	unsigned.txins[0].script, unsigned.txins[0].scriptLen = nil, makeVarInt(0)
+	tx := base64.StdEncoding.EncodeToString(unsigned.Raw())
+
+	quote := func(fr feeRequest) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(fr)
+		w := httptest.NewRecorder()
+		c.HandleBoostFee(w, asUser(httptest.NewRequest("POST", "/boost/fee", bytes.NewReader(b)), "jones"))
+		return w
+	}
+
+	w := quote(feeRequest{PartialTx: tx, PricePerHead: 100, Limit: 1000})
+	var q BoostQuote
+	if err := json.Unmarshal(w.Body.Bytes(), &q); w.Code != 200 || err != nil {
+		t.Fatalf("unexpected response %d %s\n", w.Code, w.Body.String())
+	}
+	size := BoostTxSize(unsigned, 1000)
+	if q.Size != size || q.Fees.SatsPerKB != 500 || q.Fee != uint64(size+1)/2 || q.Required != 100000+q.Fee+q.Fees.Dust {
+		t.Fatalf("unexpected quote %+v for %d bytes\n", q, size)
+	}
+
+	for name, fr := range map[string]feeRequest{
+		"no limit":  {PartialTx: tx, PricePerHead: 100},
+		"no price":  {PartialTx: tx, Limit: 10},
+		"bad tx":    {PartialTx: "AAEC", PricePerHead: 100, Limit: 10},
+		"too large": {PartialTx: tx, PricePerHead: 100, Limit: maxBoostOutputs + 1},
+	} {
+		if w := quote(fr); w.Code != 400 || !bytes.Contains(w.Body.Bytes(), []byte(codeInvalidRequest)) {
+			t.Errorf("%s: expected 400 %s, got %d %s\n", name, codeInvalidRequest, w.Code, w.Body.String())
+		}
+	}
+}
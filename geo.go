@@ -0,0 +1,410 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/mmcloughlin/geohash"
+)
+
+// ring is a closed line of points, the last one joins the first. Areas are
+// small enough that lat/lon are taken as planar, they can't cross the
+// antimeridian
+type ring []latlon
+
+// polygon is an outer ring with the holes cut out of it
+type polygon struct {
+	Outer ring   `json:"outer"`
+	Holes []ring `json:"holes"`
+}
+
+// kinds of areas
+const (
+	areaPolygon = "polygon"
+	areaCircle  = "circle"
+	areaBox     = "box"
+)
+
+// area is a shape of Type. A polygon is a multi-polygon of Polygons and
+// Perim, the outer ring of a polygon without holes older clients send, it
+// is the kind of areas without a type. A circle is RadiusKm around Center
+// and a box is Box. Center orders the cells of the cover, nearest first,
+// it is the middle of the bounds when unset
+type area struct {
+	Type     string       `json:"type"`
+	Center   latlon       `json:"center"`
+	RadiusKm float64      `json:"radiusKm"`
+	Box      *boundingBox `json:"box"`
+	Perim    []latlon     `json:"perim"`
+	Polygons []polygon    `json:"polygons"`
+}
+
+type boundingBox struct {
+	South float64 `json:"south"`
+	West  float64 `json:"west"`
+	North float64 `json:"north"`
+	East  float64 `json:"east"`
+}
+
+// shape is what an area covers, contains decides for users. Cells a shape
+// intersects are in the cover, the ones it covers whole aren't split
+type shape interface {
+	contains(p latlon) bool
+	intersects(cell geohash.Box) bool
+	covers(cell geohash.Box) bool
+	bounds() geohash.Box
+}
+
+type multiPolygon []polygon
+
+type circle struct {
+	center   latlon
+	radiusKm float64
+}
+
+type box geohash.Box
+
+// users are indexed under every prefix of their geohash, in geohash1 to
+// geohash6, so cells of any precision are a single in filter. The prefix
+// of precision is the geohash field older clients write, users nobody
+// indexed since are only found in cells of that precision until
+// BackfillGeohashes runs
+const (
+	minPrecision = 1
+	maxPrecision = 6
+)
+
+// a cover aims for that many cells, four in filters
+const coverCells = 40
+
+func geohashField(chars int) string {
+	if chars == precision {
+		return "geohash"
+	}
+	return "geohash" + strconv.Itoa(chars)
+}
+
+// geohashes are the fields that index a user at lat, lon
+func geohashes(lat, lon float64) map[string]interface{} {
+	h := geohash.EncodeWithPrecision(lat, lon, maxPrecision)
+	fields := map[string]interface{}{}
+	for i := minPrecision; i <= maxPrecision; i++ {
+		fields[geohashField(i)] = h[:i]
+	}
+	return fields
+}
+
+// km in a degree of latitude, circles are bounded with it
+const kmPerDegree = 6371.0 * math.Pi / 180
+
+// contains is ray casting, points right on an edge can go either way
+func (r ring) contains(p latlon) bool {
+	in := false
+	for i, j := 0, len(r)-1; i < len(r); j, i = i, i+1 {
+		a, b := r[i], r[j]
+		if (a.Lat > p.Lat) != (b.Lat > p.Lat) && p.Lon < (b.Lon-a.Lon)*(p.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+			in = !in
+		}
+	}
+	return in
+}
+
+func (p polygon) contains(pt latlon) bool {
+	return p.Outer.contains(pt) && !Any(p.Holes, func(h ring) bool { return h.contains(pt) })
+}
+
+func (p polygon) rings() []ring {
+	return append([]ring{p.Outer}, p.Holes...)
+}
+
+func validPoint(p latlon) bool {
+	return !math.IsNaN(p.Lat) && !math.IsNaN(p.Lon) && math.Abs(p.Lat) <= 90 && math.Abs(p.Lon) <= 180
+}
+
+// shape checks the fields of the type of a
+func (a area) shape() (shape, error) {
+	switch a.Type {
+	case "", areaPolygon:
+		mp := multiPolygon(a.Polygons)
+		if len(a.Perim) > 0 {
+			mp = append(multiPolygon{{Outer: a.Perim}}, mp...)
+		}
+		if len(mp) == 0 {
+			return nil, errors.New("area has no polygon")
+		}
+		for i, pl := range mp {
+			for _, r := range pl.rings() {
+				if len(r) < 3 {
+					return nil, fmt.Errorf("polygon %d has a ring of %d points", i, len(r))
+				}
+				if !Every(r, validPoint) {
+					return nil, fmt.Errorf("polygon %d has an invalid point", i)
+				}
+			}
+		}
+		return mp, nil
+	case areaCircle:
+		if !validPoint(a.Center) {
+			return nil, fmt.Errorf("invalid circle center %v,%v", a.Center.Lat, a.Center.Lon)
+		}
+		if !(a.RadiusKm > 0) {
+			return nil, fmt.Errorf("invalid circle radius %v km", a.RadiusKm)
+		}
+		return circle{center: a.Center, radiusKm: a.RadiusKm}, nil
+	case areaBox:
+		if a.Box == nil {
+			return nil, errors.New("box area without a box")
+		}
+		b := box{MinLat: a.Box.South, MaxLat: a.Box.North, MinLng: a.Box.West, MaxLng: a.Box.East}
+		if !validPoint(latlon{Lat: b.MinLat, Lon: b.MinLng}) || !validPoint(latlon{Lat: b.MaxLat, Lon: b.MaxLng}) ||
+			b.MinLat >= b.MaxLat || b.MinLng >= b.MaxLng {
+			return nil, fmt.Errorf("invalid box %+v", *a.Box)
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("unknown area type %q", a.Type)
+}
+
+func (a area) Validate() error {
+	_, err := a.shape()
+	return err
+}
+
+// contains is false for invalid areas
+func (a area) contains(p latlon) bool {
+	s, err := a.shape()
+	return err == nil && s.contains(p)
+}
+
+func (a area) center() latlon {
+	if a.Type == areaCircle || a.Center.Lat != 0 || a.Center.Lon != 0 {
+		return a.Center
+	}
+	s, err := a.shape()
+	if err != nil {
+		return a.Center
+	}
+	lat, lon := s.bounds().Center()
+	return latlon{Lat: lat, Lon: lon}
+}
+
+// coverAt is every cell of chars characters the area intersects, nearest
+// to its center first, none for invalid areas
+func (a area) coverAt(chars uint) []string {
+	s, err := a.shape()
+	if err != nil {
+		return nil
+	}
+	return a.nearestFirst(cellsAt(s, chars))
+}
+
+// cover is the cells of the area, of mixed precisions, nearest to its
+// center first. From the coarsest cells, the largest one on the edge of the
+// area is split in the children that intersect it as long as the cover
+// stays under maxCells. Cells the area covers whole stay large and small
+// areas get small cells
+func (a area) cover(maxCells int) []string {
+	s, err := a.shape()
+	if err != nil {
+		return nil
+	}
+	cells := cellsAt(s, minPrecision)
+	for {
+		split := -1
+		for i, c := range cells {
+			if len(c) < maxPrecision && (split < 0 || len(c) < len(cells[split])) && !s.covers(geohash.BoundingBox(c)) {
+				split = i
+			}
+		}
+		if split < 0 {
+			break
+		}
+		children := make([]string, 0, len(geohashAlphabet))
+		for _, ch := range geohashAlphabet {
+			if child := cells[split] + string(ch); s.intersects(geohash.BoundingBox(child)) {
+				children = append(children, child)
+			}
+		}
+		if len(cells)-1+len(children) > maxCells {
+			break
+		}
+		cells = append(append(cells[:split:split], cells[split+1:]...), children...)
+	}
+	return a.nearestFirst(cells)
+}
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+func cellsAt(s shape, chars uint) []string {
+	b := s.bounds()
+	cells := []string{}
+	row := geohash.EncodeWithPrecision(b.MinLat, b.MinLng, chars)
+	for {
+		rb := geohash.BoundingBox(row)
+		for cell := row; ; cell = geohash.Neighbor(cell, geohash.East) {
+			cb := geohash.BoundingBox(cell)
+			if s.intersects(cb) {
+				cells = append(cells, cell)
+			}
+			if cb.MaxLng >= b.MaxLng {
+				break
+			}
+		}
+		if rb.MaxLat >= b.MaxLat {
+			break
+		}
+		row = geohash.Neighbor(row, geohash.North)
+	}
+	return cells
+}
+
+func (a area) nearestFirst(cells []string) []string {
+	c := a.center()
+	dist := make(map[string]float64, len(cells))
+	for _, cell := range cells {
+		lat, lon := geohash.DecodeCenter(cell)
+		dist[cell] = geoDist(c, latlon{Lat: lat, Lon: lon})
+	}
+	sort.Slice(cells, func(i, j int) bool {
+		if dist[cells[i]] != dist[cells[j]] {
+			return dist[cells[i]] < dist[cells[j]]
+		}
+		return cells[i] < cells[j]
+	})
+	return cells
+}
+
+func (mp multiPolygon) contains(p latlon) bool {
+	return Any(mp, func(pl polygon) bool { return pl.contains(p) })
+}
+
+// intersects is true when the polygons and the cell share a point, either
+// an edge runs through the cell or the cell is entirely in or out
+func (mp multiPolygon) intersects(cell geohash.Box) bool {
+	for _, pl := range mp {
+		for _, r := range pl.rings() {
+			for i, j := 0, len(r)-1; i < len(r); j, i = i, i+1 {
+				if segmentTouchesBox(r[j], r[i], cell) {
+					return true
+				}
+			}
+		}
+	}
+	lat, lon := cell.Center()
+	return mp.contains(latlon{Lat: lat, Lon: lon})
+}
+
+func (mp multiPolygon) covers(cell geohash.Box) bool {
+	for _, pl := range mp {
+		for _, r := range pl.rings() {
+			for i, j := 0, len(r)-1; i < len(r); j, i = i, i+1 {
+				if segmentTouchesBox(r[j], r[i], cell) {
+					return false
+				}
+			}
+		}
+	}
+	lat, lon := cell.Center()
+	return mp.contains(latlon{Lat: lat, Lon: lon})
+}
+
+// bounds of the outer rings
+func (mp multiPolygon) bounds() geohash.Box {
+	b := geohash.Box{MinLat: math.Inf(1), MaxLat: math.Inf(-1), MinLng: math.Inf(1), MaxLng: math.Inf(-1)}
+	for _, pl := range mp {
+		for _, p := range pl.Outer {
+			b.MinLat, b.MaxLat = math.Min(b.MinLat, p.Lat), math.Max(b.MaxLat, p.Lat)
+			b.MinLng, b.MaxLng = math.Min(b.MinLng, p.Lon), math.Max(b.MaxLng, p.Lon)
+		}
+	}
+	return b
+}
+
+func (c circle) contains(p latlon) bool {
+	return geoDist(c.center, p) <= c.radiusKm
+}
+
+// intersects measures to the point of the cell nearest to the center
+func (c circle) intersects(cell geohash.Box) bool {
+	nearest := latlon{
+		Lat: math.Max(cell.MinLat, math.Min(c.center.Lat, cell.MaxLat)),
+		Lon: math.Max(cell.MinLng, math.Min(c.center.Lon, cell.MaxLng)),
+	}
+	return c.contains(nearest)
+}
+
+// covers checks the corners, the farthest points of the cell
+func (c circle) covers(cell geohash.Box) bool {
+	return c.contains(latlon{Lat: cell.MinLat, Lon: cell.MinLng}) && c.contains(latlon{Lat: cell.MinLat, Lon: cell.MaxLng}) &&
+		c.contains(latlon{Lat: cell.MaxLat, Lon: cell.MinLng}) && c.contains(latlon{Lat: cell.MaxLat, Lon: cell.MaxLng})
+}
+
+// bounds widen with latitude, circles over a pole span every longitude
+func (c circle) bounds() geohash.Box {
+	dLat := c.radiusKm / kmPerDegree
+	b := geohash.Box{MinLat: math.Max(c.center.Lat-dLat, -90), MaxLat: math.Min(c.center.Lat+dLat, 90), MinLng: -180, MaxLng: 180}
+	if b.MinLat > -90 && b.MaxLat < 90 {
+		dLon := dLat / math.Cos(degToRad(math.Max(math.Abs(b.MinLat), math.Abs(b.MaxLat))))
+		b.MinLng, b.MaxLng = math.Max(c.center.Lon-dLon, -180), math.Min(c.center.Lon+dLon, 180)
+	}
+	return b
+}
+
+func (b box) contains(p latlon) bool {
+	return inBox(p, geohash.Box(b))
+}
+
+func (b box) intersects(cell geohash.Box) bool {
+	return b.MinLat <= cell.MaxLat && cell.MinLat <= b.MaxLat && b.MinLng <= cell.MaxLng && cell.MinLng <= b.MaxLng
+}
+
+func (b box) covers(cell geohash.Box) bool {
+	return b.MinLat <= cell.MinLat && cell.MaxLat <= b.MaxLat && b.MinLng <= cell.MinLng && cell.MaxLng <= b.MaxLng
+}
+
+func (b box) bounds() geohash.Box {
+	return geohash.Box(b)
+}
+
+func inBox(p latlon, b geohash.Box) bool {
+	return p.Lat >= b.MinLat && p.Lat <= b.MaxLat && p.Lon >= b.MinLng && p.Lon <= b.MaxLng
+}
+
+func segmentTouchesBox(p, q latlon, b geohash.Box) bool {
+	if inBox(p, b) || inBox(q, b) {
+		return true
+	}
+	sw, se := latlon{Lat: b.MinLat, Lon: b.MinLng}, latlon{Lat: b.MinLat, Lon: b.MaxLng}
+	nw, ne := latlon{Lat: b.MaxLat, Lon: b.MinLng}, latlon{Lat: b.MaxLat, Lon: b.MaxLng}
+	return segmentsCross(p, q, sw, se) || segmentsCross(p, q, se, ne) ||
+		segmentsCross(p, q, ne, nw) || segmentsCross(p, q, nw, sw)
+}
+
+// orientation of c to the line a->b, 0 when collinear
+func orientation(a, b, c latlon) int {
+	v := (b.Lon-a.Lon)*(c.Lat-a.Lat) - (b.Lat-a.Lat)*(c.Lon-a.Lon)
+	if v > 0 {
+		return 1
+	} else if v < 0 {
+		return -1
+	}
+	return 0
+}
+
+func onSegment(a, b, p latlon) bool {
+	return math.Min(a.Lon, b.Lon) <= p.Lon && p.Lon <= math.Max(a.Lon, b.Lon) &&
+		math.Min(a.Lat, b.Lat) <= p.Lat && p.Lat <= math.Max(a.Lat, b.Lat)
+}
+
+func segmentsCross(p1, p2, q1, q2 latlon) bool {
+	o1, o2 := orientation(p1, p2, q1), orientation(p1, p2, q2)
+	o3, o4 := orientation(q1, q2, p1), orientation(q1, q2, p2)
+	if o1 != o2 && o3 != o4 {
+		return true
+	}
+	return (o1 == 0 && onSegment(p1, p2, q1)) || (o2 == 0 && onSegment(p1, p2, q2)) ||
+		(o3 == 0 && onSegment(q1, q2, p1)) || (o4 == 0 && onSegment(q1, q2, p2))
+}
@@ -0,0 +1,182 @@
+package backend
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/mmcloughlin/geohash"
+)
+
+// rect is the ring of the box from (lat0, lon0) to (lat1, lon1)
+func rect(lat0, lon0, lat1, lon1 float64) ring {
+	return ring{{Lat: lat0, Lon: lon0}, {Lat: lat0, Lon: lon1}, {Lat: lat1, Lon: lon1}, {Lat: lat1, Lon: lon0}}
+}
+
+func TestPolygonCover(t *testing.T) {
+	// a 3x3 block of precision 4 cells around f2xv, w and h are their size
+	mid := geohash.BoundingBox("f2xv")
+	w, h := mid.MaxLng-mid.MinLng, mid.MaxLat-mid.MinLat
+	cell := func(row, col int) string {
+		return geohash.EncodeWithPrecision(mid.MinLat+(float64(row)+0.5)*h, mid.MinLng+(float64(col)+0.5)*w, precision)
+	}
+	// a point inside the cell at row, col of the block, in fractions of a cell
+	at := func(row, col float64) latlon { return latlon{Lat: mid.MinLat + row*h, Lon: mid.MinLng + col*w} }
+	box := func(r0, c0, r1, c1 float64) ring {
+		sw, ne := at(r0, c0), at(r1, c1)
+		return rect(sw.Lat, sw.Lon, ne.Lat, ne.Lon)
+	}
+
+	// an L over the west and south cells of a 2x2 block, its notch is
+	// the north east cell. Distance to a center would take the notch in
+	l := ring{at(0.2, 0.2), at(0.2, 1.8), at(0.8, 1.8), at(0.8, 0.8), at(1.8, 0.8), at(1.8, 0.2)}
+
+	for name, tc := range map[string]struct {
+		a     area
+		cells []string
+	}{
+		"inside a cell":  {area{Polygons: []polygon{{Outer: box(0.2, 0.2, 0.8, 0.8)}}}, []string{cell(0, 0)}},
+		"over 2x2 cells": {area{Polygons: []polygon{{Outer: box(0.5, 0.5, 1.5, 1.5)}}}, []string{cell(0, 0), cell(0, 1), cell(1, 0), cell(1, 1)}},
+		"concave":        {area{Perim: l}, []string{cell(0, 0), cell(0, 1), cell(1, 0)}},
+		"hole over the middle cell": {
+			area{Polygons: []polygon{{Outer: box(-0.9, -0.9, 1.9, 1.9), Holes: []ring{box(-0.1, -0.1, 1.1, 1.1)}}}},
+			[]string{cell(-1, -1), cell(-1, 0), cell(-1, 1), cell(0, -1), cell(0, 1), cell(1, -1), cell(1, 0), cell(1, 1)},
+		},
+		"two polygons": {
+			area{Polygons: []polygon{{Outer: box(-0.8, -0.8, -0.2, -0.2)}, {Outer: box(1.2, 1.2, 1.8, 1.8)}}},
+			[]string{cell(-1, -1), cell(1, 1)},
+		},
+	} {
+		if err := tc.a.Validate(); err != nil {
+			t.Fatalf("%s: unexpected invalid area: %v\n", name, err)
+		}
+		if got := tc.a.coverAt(precision); !sameCells(got, tc.cells) {
+			t.Errorf("%s: expected cover %v, got %v\n", name, tc.cells, got)
+		}
+	}
+
+	concave := area{Perim: l}
+	for p, in := range map[latlon]bool{at(0.5, 0.5): true, at(0.5, 1.5): true, at(1.5, 0.5): true, at(1.5, 1.5): false, at(1, 1): false, at(2, 2): false} {
+		if concave.contains(p) != in {
+			t.Errorf("expected %v in the L to be %v\n", p, in)
+		}
+	}
+	holed := polygon{Outer: box(-0.9, -0.9, 1.9, 1.9), Holes: []ring{box(-0.1, -0.1, 1.1, 1.1)}}
+	if holed.contains(at(0.5, 0.5)) || !holed.contains(at(-0.5, 0.5)) {
+		t.Error("expected the hole out of the polygon and the rest in")
+	}
+
+	// the nearest cells to the center come first
+	a := area{Center: at(1.5, 1.5), Polygons: []polygon{{Outer: box(0.5, 0.5, 1.5, 1.5)}}}
+	if got := a.coverAt(precision); got[0] != cell(1, 1) || got[3] != cell(0, 0) {
+		t.Errorf("expected the cover from %s to %s, got %v\n", cell(1, 1), cell(0, 0), got)
+	}
+
+	for name, a := range map[string]area{
+		"no polygon":   {},
+		"2 points":     {Perim: []latlon{{Lat: 1, Lon: 1}, {Lat: 2, Lon: 2}}},
+		"bad latitude": {Perim: rect(80, 0, 91, 1)},
+		"bad hole":     {Polygons: []polygon{{Outer: rect(0, 0, 1, 1), Holes: []ring{{}}}}},
+	} {
+		if err := a.Validate(); err == nil {
+			t.Errorf("%s: expected an error\n", name)
+		}
+	}
+}
+
+func TestShapeCover(t *testing.T) {
+	mid := geohash.BoundingBox("f2xv")
+	lat, lon := mid.Center()
+	center := latlon{Lat: lat, Lon: lon}
+
+	// cells are ~19.5 km high and ~25.8 km wide there, 10 km around the
+	// center reach the cells north and south but not east and west
+	c := area{Type: areaCircle, Center: center, RadiusKm: 10}
+	got := c.coverAt(precision)
+	want := []string{"f2xv", geohash.Neighbor("f2xv", geohash.North), geohash.Neighbor("f2xv", geohash.South)}
+	if got[0] != "f2xv" || !sameCells(got, want) {
+		t.Fatalf("expected circle cover %v, got %v\n", want, got)
+	}
+	if !c.contains(latlon{Lat: lat + 9.9/kmPerDegree, Lon: lon}) || c.contains(latlon{Lat: lat + 10.1/kmPerDegree, Lon: lon}) {
+		t.Fatal("expected the circle to end at 10 km")
+	}
+	if got := (area{Type: areaCircle, Center: center, RadiusKm: 2}).coverAt(precision); !sameCells(got, []string{"f2xv"}) {
+		t.Fatalf("expected a 2 km circle in its cell, got %v\n", got)
+	}
+
+	w, h := mid.MaxLng-mid.MinLng, mid.MaxLat-mid.MinLat
+	b := area{Type: areaBox, Box: &boundingBox{South: lat, West: lon, North: lat + h, East: lon + w}}
+	want = []string{"f2xv", geohash.Neighbor("f2xv", geohash.North), geohash.Neighbor("f2xv", geohash.East), geohash.Neighbor("f2xv", geohash.NorthEast)}
+	if got := b.coverAt(precision); !sameCells(got, want) {
+		t.Fatalf("expected box cover %v, got %v\n", want, got)
+	}
+	if !b.contains(latlon{Lat: lat + h/2, Lon: lon + w/2}) || !b.contains(center) || b.contains(latlon{Lat: lat - 0.01, Lon: lon}) {
+		t.Fatal("unexpected box bounds")
+	}
+
+	for name, a := range map[string]area{
+		"no radius":       {Type: areaCircle, Center: center},
+		"bad center":      {Type: areaCircle, Center: latlon{Lat: 100}, RadiusKm: 1},
+		"no box":          {Type: areaBox},
+		"upside down box": {Type: areaBox, Box: &boundingBox{South: 2, West: 0, North: 1, East: 1}},
+		"unknown type":    {Type: "hexagon", Perim: rect(0, 0, 1, 1)},
+	} {
+		if err := a.Validate(); err == nil {
+			t.Errorf("%s: expected an error\n", name)
+		}
+	}
+}
+
+func TestAdaptiveCover(t *testing.T) {
+	lat, lon := geohash.BoundingBox("f2xv").Center()
+	center := latlon{Lat: lat, Lon: lon}
+	inCover := func(cells []string, p latlon) bool {
+		h := geohash.EncodeWithPrecision(p.Lat, p.Lon, maxPrecision)
+		return Any(cells, func(c string) bool { return strings.HasPrefix(h, c) })
+	}
+
+	// a small area goes down to the finest cells
+	small := area{Type: areaCircle, Center: center, RadiusKm: 1}
+	got := small.cover(coverCells)
+	if len(got) == 0 || len(got) > coverCells || !inCover(got, center) {
+		t.Fatalf("unexpected cover of a small circle %v\n", got)
+	}
+	if !Every(got, func(c string) bool { return len(c) >= 5 }) {
+		t.Fatalf("expected fine cells around a 1 km circle, got %v\n", got)
+	}
+
+	// a continent is a few coarse cells
+	huge := area{Type: areaCircle, Center: center, RadiusKm: 2000}
+	if err := huge.Validate(); err != nil {
+		t.Fatalf("unexpected invalid area: %v\n", err)
+	}
+	got = huge.cover(coverCells)
+	if len(got) == 0 || len(got) > coverCells || !Every(got, func(c string) bool { return len(c) <= 2 }) {
+		t.Fatalf("expected a few coarse cells over a huge circle, got %v\n", got)
+	}
+	for _, p := range []latlon{center, {Lat: lat + 15, Lon: lon}, {Lat: lat - 15, Lon: lon}, {Lat: lat, Lon: lon + 20}} {
+		if !inCover(got, p) {
+			t.Errorf("expected %v in the cover\n", p)
+		}
+	}
+
+	// cells a box covers whole aren't split, the ones on its edge are
+	b := geohash.BoundingBox("f2")
+	edge := 0.1
+	over := area{Type: areaBox, Box: &boundingBox{South: b.MinLat, West: b.MinLng, North: b.MaxLat + edge, East: b.MaxLng}}
+	got = over.cover(coverCells)
+	if !Contains("f2", got) || len(got) > coverCells {
+		t.Fatalf("expected f2 whole in the cover, got %v\n", got)
+	}
+	if !Any(got, func(c string) bool { return len(c) > 2 }) || !inCover(got, latlon{Lat: b.MaxLat + edge/2, Lon: lon}) {
+		t.Fatalf("expected finer cells north of f2, got %v\n", got)
+	}
+}
+
+func sameCells(a, b []string) bool {
+	a, b = append([]string{}, a...), append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return reflect.DeepEqual(a, b)
+}
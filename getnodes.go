@@ -11,13 +11,8 @@ import (
 	"net/http"
 )
 
-func init() {
-	ctx := context.Background()
-	ServerInit(ctx)
-}
-
-func getFullId(ctx context.Context, unique string, sc chan *string) {
-	ref, err := Client.Firestore.Collection("users").Doc(unique).Get(ctx)
+func (s *Server) getFullId(ctx context.Context, unique string, sc chan *string) {
+	ref, err := s.Firestore.Get(ctx, "users", unique)
 	if err != nil {
 		msg := fmt.Sprintf("error getting doc at user/%s", unique)
 		NonFatal(err, msg)
@@ -42,17 +37,20 @@ func getFullId(ctx context.Context, unique string, sc chan *string) {
 	}
 }
 
-func GetNodes(w http.ResponseWriter, r *http.Request) {
+func (s *Server) GetNodes(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
 	raw, err := io.ReadAll(r.Body)
-	Fatal(err, "error reading request body")
+	if err != nil {
+		WriteError(w, bodyError(codeInvalidRequest, "error reading request body", err))
+		return
+	}
 
 	usernames := strings.Split(string(raw), " ")
 	sc := make(chan *string, len(usernames))
 	fullIds := make([]*string, 0, len(usernames))
 
 	for _, v := range usernames {
-		go getFullId(ctx, v, sc)
+		go s.getFullId(ctx, v, sc)
 	}
 
 	for range usernames {
@@ -68,7 +66,7 @@ func GetNodes(w http.ResponseWriter, r *http.Request) {
 	nodes := make([]*map[string]interface{}, 0, len(fullIds))
 	for _, id := range fullIds {
 		fmt.Printf("getting node for id=%s\n", *id)
-		go getNode(ctx, *id, nc)
+		go s.getNode(ctx, *id, nc)
 	}
 
 	for range fullIds {
@@ -82,7 +80,8 @@ func GetNodes(w http.ResponseWriter, r *http.Request) {
 
 	marsh, err := json.Marshal(nodes)
 	if err != nil {
-		log.Fatalf("error marshaling nodes: %v\n", err)
+		WriteError(w, internal(codeInternal, "error marshaling nodes", err))
+		return
 	}
 
 	if _, err := w.Write(marsh); err != nil {
@@ -90,13 +89,16 @@ func GetNodes(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func getNodeMedia(ctx context.Context, id *ComposedId) (string, map[string]string, error) {
-	bckt := id.ServerShard().StaticBucket
-	sUrl, err := bckt.SignedURL(id.Unik, Client.SignedOpts)
+func (s *Server) getNodeMedia(ctx context.Context, id *ComposedId) (string, map[string]string, error) {
+	shrd, err := s.ServerShard(id)
+	if err != nil {
+		return "", nil, err
+	}
+	bckt := shrd.StaticBucket
+	sUrl, err := bckt.SignedURL(id.Unik, s.SignedOpts)
 	NonFatal(err, fmt.Sprintf("could not get signed url for mediaId=%s", id.ToString()))
 
-	obj := bckt.Object(id.Unik)
-	attrs, err := obj.Attrs(ctx)
+	attrs, err := bckt.Attrs(ctx, id.Unik)
 	if err != nil {
 		return "", nil, err
 	}
@@ -104,7 +106,7 @@ func getNodeMedia(ctx context.Context, id *ComposedId) (string, map[string]strin
 	return sUrl, attrs.Metadata, nil
 }
 
-func getNode(ctx context.Context, idStr string, nc chan *map[string]interface{}) {
+func (s *Server) getNode(ctx context.Context, idStr string, nc chan *map[string]interface{}) {
 	var full map[string]interface{} = make(map[string]interface{}, 3)
 
 	cps := ParseRoot(idStr)
@@ -115,9 +117,14 @@ func getNode(ctx context.Context, idStr string, nc chan *map[string]interface{})
 	}
 
 	id := cps[0]
-	db := id.ServerShard().RealtimeDB
+	shrd, err := s.ServerShard(id)
+	if err != nil {
+		log.Printf("could not get node: %v\n", err)
+		nc <- nil
+		return
+	}
 	var node map[string]interface{}
-	if err := db.NewRef("roots/"+id.Unik+"/node").Get(ctx, &node); err != nil {
+	if err := shrd.RealtimeDB.NewRef("roots/"+id.Unik+"/node").Get(ctx, &node); err != nil {
 		nc <- nil
 		return
 	}
@@ -132,7 +139,7 @@ func getNode(ctx context.Context, idStr string, nc chan *map[string]interface{})
 
 	mediaId := ParseMediaId(mediaIdStr)
 
-	link, metadata, err := getNodeMedia(ctx, mediaId)
+	link, metadata, err := s.getNodeMedia(ctx, mediaId)
 	if err != nil {
 		log.Printf("could not get node media and link: %v\n", err)
 		nc <- &full
@@ -0,0 +1,826 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"golang.org/x/crypto/ripemd160"
+)
+
+// SigChecker backs OP_CHECKSIG, sig still has its sighash byte and
+// subscript is the locking script from the last OP_CODESEPARATOR on
+type SigChecker interface {
+	CheckSig(sig, pubKey, subscript []byte) (bool, error)
+}
+
+// limits, way under what nodes allow but way over anything we build
+const (
+	maxStackSize    = 1000
+	maxScriptNumLen = 750000
+)
+
+var errPushOnly = errors.New("unlocking script is not push only")
+
+// VerifyScript runs the unlocking script then the locking script on the same
+// stack, like a node validating an input after genesis. checker can be nil
+// when the locking script has no OP_CHECKSIG, like boost hash puzzles
+func VerifyScript(unlocking, locking []byte, checker SigChecker) error {
+	us, err := ParseScript(unlocking)
+	if err != nil {
+		return fmt.Errorf("error parsing unlocking script: %v", err)
+	}
+	if !Every(us, func(c Chunk) bool { return c.Op <= op_16 && c.Op != op_reserved }) {
+		return errPushOnly
+	}
+
+	vm := &interpreter{checker: checker}
+	if err := vm.execute(unlocking); err != nil {
+		return fmt.Errorf("error running unlocking script: %v", err)
+	}
+	if err := vm.execute(locking); err != nil {
+		return fmt.Errorf("error running locking script: %v", err)
+	}
+	if len(vm.stack) == 0 || !castToBool(vm.stack[len(vm.stack)-1]) {
+		return errors.New("script evaluated to false")
+	}
+	return nil
+}
+
+type interpreter struct {
+	checker    SigChecker
+	stack, alt [][]byte
+	conds      []bool
+	script     []byte
+	codeSep    int
+}
+
+func (vm *interpreter) executing() bool {
+	return Every(vm.conds, func(b bool) bool { return b })
+}
+
+func (vm *interpreter) push(b []byte) error {
+	if len(vm.stack)+len(vm.alt) >= maxStackSize {
+		return errors.New("stack overflow")
+	}
+	vm.stack = append(vm.stack, b)
+	return nil
+}
+
+func (vm *interpreter) pop() ([]byte, error) {
+	if len(vm.stack) == 0 {
+		return nil, errors.New("stack underflow")
+	}
+	b := vm.stack[len(vm.stack)-1]
+	vm.stack = vm.stack[:len(vm.stack)-1]
+	return b, nil
+}
+
+// peek is the item i from the top, 0 is the top
+func (vm *interpreter) peek(i int) ([]byte, error) {
+	if i < 0 || i >= len(vm.stack) {
+		return nil, errors.New("stack underflow")
+	}
+	return vm.stack[len(vm.stack)-1-i], nil
+}
+
+func (vm *interpreter) need(n int) error {
+	if len(vm.stack) < n {
+		return errors.New("stack underflow")
+	}
+	return nil
+}
+
+func (vm *interpreter) popNum() (*big.Int, error) {
+	b, err := vm.pop()
+	if err != nil {
+		return nil, err
+	}
+	return bytesToNum(b)
+}
+
+func (vm *interpreter) popBool() (bool, error) {
+	b, err := vm.pop()
+	return castToBool(b), err
+}
+
+func (vm *interpreter) pushBool(v bool) error {
+	if v {
+		return vm.push([]byte{1})
+	}
+	return vm.push(nil)
+}
+
+func (vm *interpreter) execute(script []byte) error {
+	sc, err := ParseScript(script)
+	if err != nil {
+		return err
+	}
+	vm.script, vm.codeSep, vm.conds = script, 0, nil
+
+	pos := 0
+	for _, c := range sc {
+		pos += chunkLen(c)
+		done, err := vm.step(c, pos)
+		if err != nil {
+			return fmt.Errorf("%s: %v", opName(c.Op), err)
+		}
+		if done {
+			return nil
+		}
+	}
+	if len(vm.conds) > 0 {
+		return errors.New("unbalanced conditional")
+	}
+	return nil
+}
+
+func chunkLen(c Chunk) int {
+	switch {
+	case !c.isPush():
+		return 1
+	case c.Op < op_pushdata1:
+		return 1 + len(c.Data)
+	case c.Op == op_pushdata1:
+		return 2 + len(c.Data)
+	case c.Op == op_pushdata2:
+		return 3 + len(c.Data)
+	default:
+		return 5 + len(c.Data)
+	}
+}
+
+// step runs one chunk, pos is the offset right after it. done is true when
+// an OP_RETURN ends the script early
+func (vm *interpreter) step(c Chunk, pos int) (bool, error) {
+	exec := vm.executing()
+
+	switch c.Op {
+	case op_if, op_notif:
+		v := false
+		if exec {
+			b, err := vm.popBool()
+			if err != nil {
+				return false, err
+			}
+			v = b == (c.Op == op_if)
+		}
+		vm.conds = append(vm.conds, v)
+		return false, nil
+	case op_else:
+		if len(vm.conds) == 0 {
+			return false, errors.New("no matching OP_IF")
+		}
+		vm.conds[len(vm.conds)-1] = !vm.conds[len(vm.conds)-1]
+		return false, nil
+	case op_endif:
+		if len(vm.conds) == 0 {
+			return false, errors.New("no matching OP_IF")
+		}
+		vm.conds = vm.conds[:len(vm.conds)-1]
+		return false, nil
+	}
+	if !exec {
+		return false, nil
+	}
+
+	switch {
+	case c.Op == op_false || c.isPush():
+		return false, vm.push(c.Data)
+	case c.Op == op_one_negate:
+		return false, vm.push([]byte{0x81})
+	case c.Op >= op_true && c.Op <= op_16:
+		return false, vm.push([]byte{c.Op - op_true + 1})
+	}
+
+	switch c.Op {
+	case op_nop:
+	case op_verify:
+		v, err := vm.popBool()
+		if err != nil {
+			return false, err
+		}
+		if !v {
+			return false, errors.New("verify failed")
+		}
+	case op_return:
+		if len(vm.conds) > 0 {
+			return false, errors.New("OP_RETURN inside a conditional")
+		}
+		return true, nil
+
+	case op_to_alt_stack:
+		b, err := vm.pop()
+		if err != nil {
+			return false, err
+		}
+		vm.alt = append(vm.alt, b)
+	case op_from_alt_stack:
+		if len(vm.alt) == 0 {
+			return false, errors.New("alt stack underflow")
+		}
+		b := vm.alt[len(vm.alt)-1]
+		vm.alt = vm.alt[:len(vm.alt)-1]
+		return false, vm.push(b)
+	case op_drop2:
+		if err := vm.need(2); err != nil {
+			return false, err
+		}
+		vm.stack = vm.stack[:len(vm.stack)-2]
+	case op_dup2, op_dup3, op_over2:
+		n, from := 2, 1
+		if c.Op == op_dup3 {
+			n, from = 3, 2
+		} else if c.Op == op_over2 {
+			from = 3
+		}
+		if err := vm.need(from + 1); err != nil {
+			return false, err
+		}
+		for i := 0; i < n; i++ {
+			b, _ := vm.peek(from)
+			if err := vm.push(b); err != nil {
+				return false, err
+			}
+		}
+	case op_rot2:
+		if err := vm.need(6); err != nil {
+			return false, err
+		}
+		l := len(vm.stack)
+		x1, x2 := vm.stack[l-6], vm.stack[l-5]
+		vm.stack = append(vm.stack[:l-6], vm.stack[l-4:]...)
+		vm.stack = append(vm.stack, x1, x2)
+	case op_swap2:
+		if err := vm.need(4); err != nil {
+			return false, err
+		}
+		l := len(vm.stack)
+		vm.stack[l-4], vm.stack[l-3], vm.stack[l-2], vm.stack[l-1] =
+			vm.stack[l-2], vm.stack[l-1], vm.stack[l-4], vm.stack[l-3]
+	case op_ifdup:
+		b, err := vm.peek(0)
+		if err != nil {
+			return false, err
+		}
+		if castToBool(b) {
+			return false, vm.push(b)
+		}
+	case op_depth:
+		return false, vm.push(numToBytes(big.NewInt(int64(len(vm.stack)))))
+	case op_drop:
+		_, err := vm.pop()
+		return false, err
+	case op_dup:
+		b, err := vm.peek(0)
+		if err != nil {
+			return false, err
+		}
+		return false, vm.push(b)
+	case op_nip:
+		if err := vm.need(2); err != nil {
+			return false, err
+		}
+		l := len(vm.stack)
+		vm.stack = append(vm.stack[:l-2], vm.stack[l-1])
+	case op_over:
+		b, err := vm.peek(1)
+		if err != nil {
+			return false, err
+		}
+		return false, vm.push(b)
+	case op_pick, op_roll:
+		n, err := vm.popNum()
+		if err != nil {
+			return false, err
+		}
+		if !n.IsInt64() || n.Int64() < 0 || n.Int64() >= int64(len(vm.stack)) {
+			return false, fmt.Errorf("invalid depth %v", n)
+		}
+		i := int(n.Int64())
+		b, _ := vm.peek(i)
+		if c.Op == op_roll {
+			at := len(vm.stack) - 1 - i
+			vm.stack = append(vm.stack[:at], vm.stack[at+1:]...)
+		}
+		return false, vm.push(b)
+	case op_rot:
+		if err := vm.need(3); err != nil {
+			return false, err
+		}
+		l := len(vm.stack)
+		vm.stack[l-3], vm.stack[l-2], vm.stack[l-1] = vm.stack[l-2], vm.stack[l-1], vm.stack[l-3]
+	case op_swap:
+		if err := vm.need(2); err != nil {
+			return false, err
+		}
+		l := len(vm.stack)
+		vm.stack[l-2], vm.stack[l-1] = vm.stack[l-1], vm.stack[l-2]
+	case op_tuck:
+		if err := vm.need(2); err != nil {
+			return false, err
+		}
+		l := len(vm.stack)
+		top := vm.stack[l-1]
+		vm.stack = append(vm.stack[:l-2], top, vm.stack[l-2], top)
+
+	case op_cat:
+		b, err := vm.pop()
+		if err != nil {
+			return false, err
+		}
+		a, err := vm.pop()
+		if err != nil {
+			return false, err
+		}
+		return false, vm.push(append(bytes.Clone(a), b...))
+	case op_split:
+		n, err := vm.popNum()
+		if err != nil {
+			return false, err
+		}
+		a, err := vm.pop()
+		if err != nil {
+			return false, err
+		}
+		if !n.IsInt64() || n.Int64() < 0 || n.Int64() > int64(len(a)) {
+			return false, fmt.Errorf("invalid split position %v", n)
+		}
+		i := int(n.Int64())
+		if err := vm.push(bytes.Clone(a[:i])); err != nil {
+			return false, err
+		}
+		return false, vm.push(bytes.Clone(a[i:]))
+	case op_num2bin:
+		size, err := vm.popNum()
+		if err != nil {
+			return false, err
+		}
+		a, err := vm.pop()
+		if err != nil {
+			return false, err
+		}
+		b, err := num2bin(a, size)
+		if err != nil {
+			return false, err
+		}
+		return false, vm.push(b)
+	case op_bin2num:
+		a, err := vm.pop()
+		if err != nil {
+			return false, err
+		}
+		n := rawToNum(a)
+		b := numToBytes(n)
+		if len(b) > maxScriptNumLen {
+			return false, errors.New("number too large")
+		}
+		return false, vm.push(b)
+	case op_size:
+		b, err := vm.peek(0)
+		if err != nil {
+			return false, err
+		}
+		return false, vm.push(numToBytes(big.NewInt(int64(len(b)))))
+
+	case op_invert:
+		a, err := vm.pop()
+		if err != nil {
+			return false, err
+		}
+		inv := make([]byte, len(a))
+		for i := range a {
+			inv[i] = ^a[i]
+		}
+		return false, vm.push(inv)
+	case op_and, op_or, op_xor:
+		b, err := vm.pop()
+		if err != nil {
+			return false, err
+		}
+		a, err := vm.pop()
+		if err != nil {
+			return false, err
+		}
+		if len(a) != len(b) {
+			return false, errors.New("operands of different sizes")
+		}
+		r := make([]byte, len(a))
+		for i := range a {
+			switch c.Op {
+			case op_and:
+				r[i] = a[i] & b[i]
+			case op_or:
+				r[i] = a[i] | b[i]
+			default:
+				r[i] = a[i] ^ b[i]
+			}
+		}
+		return false, vm.push(r)
+	case op_lshift, op_rshift:
+		n, err := vm.popNum()
+		if err != nil {
+			return false, err
+		}
+		a, err := vm.pop()
+		if err != nil {
+			return false, err
+		}
+		if n.Sign() < 0 {
+			return false, errors.New("negative shift")
+		}
+		return false, vm.push(shiftBytes(a, n, c.Op == op_lshift))
+	case op_equal, op_equal_verify:
+		b, err := vm.pop()
+		if err != nil {
+			return false, err
+		}
+		a, err := vm.pop()
+		if err != nil {
+			return false, err
+		}
+		if c.Op == op_equal_verify {
+			if !bytes.Equal(a, b) {
+				return false, errors.New("equal verify failed")
+			}
+			return false, nil
+		}
+		return false, vm.pushBool(bytes.Equal(a, b))
+
+	case op_add1, op_sub1, op_negate, op_abs, op_not, op_zero_notequal:
+		n, err := vm.popNum()
+		if err != nil {
+			return false, err
+		}
+		r := new(big.Int)
+		switch c.Op {
+		case op_add1:
+			r.Add(n, big.NewInt(1))
+		case op_sub1:
+			r.Sub(n, big.NewInt(1))
+		case op_negate:
+			r.Neg(n)
+		case op_abs:
+			r.Abs(n)
+		case op_not:
+			return false, vm.pushBool(n.Sign() == 0)
+		default:
+			return false, vm.pushBool(n.Sign() != 0)
+		}
+		return false, vm.pushNum(r)
+	case op_add, op_sub, op_mul, op_div, op_mod, op_bool_and, op_bool_or,
+		op_num_equal, op_num_equal_verify, op_num_not_equal, op_less_than, op_greater_than,
+		op_less_than_or_equal, op_greater_than_or_equal, op_min, op_max:
+		b, err := vm.popNum()
+		if err != nil {
+			return false, err
+		}
+		a, err := vm.popNum()
+		if err != nil {
+			return false, err
+		}
+		return false, vm.arith(c.Op, a, b)
+	case op_within:
+		max, err := vm.popNum()
+		if err != nil {
+			return false, err
+		}
+		min, err := vm.popNum()
+		if err != nil {
+			return false, err
+		}
+		x, err := vm.popNum()
+		if err != nil {
+			return false, err
+		}
+		return false, vm.pushBool(x.Cmp(min) >= 0 && x.Cmp(max) < 0)
+
+	case op_ripemd160, op_sha1, op_sha256, op_hash160, op_hash256:
+		a, err := vm.pop()
+		if err != nil {
+			return false, err
+		}
+		return false, vm.push(hashOp(c.Op, a))
+	case op_code_separator:
+		vm.codeSep = pos
+	case op_check_sig, op_check_sig_verify:
+		pub, err := vm.pop()
+		if err != nil {
+			return false, err
+		}
+		sig, err := vm.pop()
+		if err != nil {
+			return false, err
+		}
+		ok, err := vm.checkSig(sig, pub)
+		if err != nil {
+			return false, err
+		}
+		if c.Op == op_check_sig_verify {
+			if !ok {
+				return false, errors.New("checksig verify failed")
+			}
+			return false, nil
+		}
+		return false, vm.pushBool(ok)
+	case op_check_multi_sig, op_check_multi_sig_verify:
+		ok, err := vm.checkMultiSig()
+		if err != nil {
+			return false, err
+		}
+		if c.Op == op_check_multi_sig_verify {
+			if !ok {
+				return false, errors.New("checkmultisig verify failed")
+			}
+			return false, nil
+		}
+		return false, vm.pushBool(ok)
+	default:
+		return false, errors.New("invalid opcode")
+	}
+	return false, nil
+}
+
+func (vm *interpreter) pushNum(n *big.Int) error {
+	b := numToBytes(n)
+	if len(b) > maxScriptNumLen {
+		return errors.New("number too large")
+	}
+	return vm.push(b)
+}
+
+func (vm *interpreter) arith(op byte, a, b *big.Int) error {
+	switch op {
+	case op_add:
+		return vm.pushNum(new(big.Int).Add(a, b))
+	case op_sub:
+		return vm.pushNum(new(big.Int).Sub(a, b))
+	case op_mul:
+		return vm.pushNum(new(big.Int).Mul(a, b))
+	case op_div, op_mod:
+		if b.Sign() == 0 {
+			return errors.New("division by zero")
+		}
+		// truncated like c, not euclidean like big.Int.Div
+		if op == op_div {
+			return vm.pushNum(new(big.Int).Quo(a, b))
+		}
+		return vm.pushNum(new(big.Int).Rem(a, b))
+	case op_bool_and:
+		return vm.pushBool(a.Sign() != 0 && b.Sign() != 0)
+	case op_bool_or:
+		return vm.pushBool(a.Sign() != 0 || b.Sign() != 0)
+	case op_num_equal:
+		return vm.pushBool(a.Cmp(b) == 0)
+	case op_num_equal_verify:
+		if a.Cmp(b) != 0 {
+			return errors.New("numequal verify failed")
+		}
+		return nil
+	case op_num_not_equal:
+		return vm.pushBool(a.Cmp(b) != 0)
+	case op_less_than:
+		return vm.pushBool(a.Cmp(b) < 0)
+	case op_greater_than:
+		return vm.pushBool(a.Cmp(b) > 0)
+	case op_less_than_or_equal:
+		return vm.pushBool(a.Cmp(b) <= 0)
+	case op_greater_than_or_equal:
+		return vm.pushBool(a.Cmp(b) >= 0)
+	case op_min:
+		if a.Cmp(b) <= 0 {
+			return vm.pushNum(a)
+		}
+		return vm.pushNum(b)
+	default: // op_max
+		if a.Cmp(b) >= 0 {
+			return vm.pushNum(a)
+		}
+		return vm.pushNum(b)
+	}
+}
+
+// subscript is what signatures commit to, the locking script after the
+// last OP_CODESEPARATOR
+func (vm *interpreter) subscript() []byte {
+	return vm.script[vm.codeSep:]
+}
+
+// checkSig fails the script on a bad non empty signature, like NULLFAIL
+func (vm *interpreter) checkSig(sig, pub []byte) (bool, error) {
+	if vm.checker == nil {
+		return false, errors.New("no signature checker")
+	}
+	if len(sig) == 0 {
+		return false, nil
+	}
+	ok, err := vm.checker.CheckSig(sig, pub, vm.subscript())
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, errors.New("signature check failed with a non empty signature")
+	}
+	return true, nil
+}
+
+// checkMultiSig pops <dummy> <sig1..m> m <pub1..n> n, sigs have to be in
+// the same order as their pubkeys and the dummy has to be empty
+func (vm *interpreter) checkMultiSig() (bool, error) {
+	popCount := func(max int) (int, error) {
+		n, err := vm.popNum()
+		if err != nil {
+			return 0, err
+		}
+		if !n.IsInt64() || n.Int64() < 0 || n.Int64() > int64(max) {
+			return 0, fmt.Errorf("invalid count %v", n)
+		}
+		return int(n.Int64()), nil
+	}
+	popN := func(n int) ([][]byte, error) {
+		if err := vm.need(n); err != nil {
+			return nil, err
+		}
+		l := len(vm.stack)
+		items := make([][]byte, n)
+		for i := 0; i < n; i++ {
+			items[i] = vm.stack[l-1-i]
+		}
+		vm.stack = vm.stack[:l-n]
+		return items, nil
+	}
+
+	nKeys, err := popCount(len(vm.stack))
+	if err != nil {
+		return false, err
+	}
+	pubs, err := popN(nKeys)
+	if err != nil {
+		return false, err
+	}
+	nSigs, err := popCount(nKeys)
+	if err != nil {
+		return false, err
+	}
+	sigs, err := popN(nSigs)
+	if err != nil {
+		return false, err
+	}
+	dummy, err := vm.pop()
+	if err != nil {
+		return false, err
+	}
+	if len(dummy) != 0 {
+		return false, errors.New("non empty dummy")
+	}
+	if vm.checker == nil {
+		return false, errors.New("no signature checker")
+	}
+
+	// items were popped top first, so walk both from the end
+	ok, s, k := true, len(sigs)-1, len(pubs)-1
+	for ok && s >= 0 {
+		if k < s {
+			ok = false
+			break
+		}
+		good := false
+		if len(sigs[s]) > 0 {
+			if good, err = vm.checker.CheckSig(sigs[s], pubs[k], vm.subscript()); err != nil {
+				return false, err
+			}
+		}
+		if good {
+			s--
+		}
+		k--
+	}
+	if !ok && Any(sigs, func(sig []byte) bool { return len(sig) > 0 }) {
+		return false, errors.New("multisig check failed with non empty signatures")
+	}
+	return ok, nil
+}
+
+func hashOp(op byte, b []byte) []byte {
+	switch op {
+	case op_ripemd160:
+		h := ripemd160.New()
+		h.Write(b)
+		return h.Sum(nil)
+	case op_sha1:
+		h := sha1.Sum(b)
+		return h[:]
+	case op_sha256:
+		h := sha256.Sum256(b)
+		return h[:]
+	case op_hash160:
+		return btcutil.Hash160(b)
+	default:
+		return Txid(b)
+	}
+}
+
+// castToBool is false for any encoding of zero, negative zero included
+func castToBool(b []byte) bool {
+	for i := range b {
+		if b[i] != 0 {
+			return i != len(b)-1 || b[i] != 0x80
+		}
+	}
+	return false
+}
+
+// bytesToNum decodes a minimally encoded script number
+func bytesToNum(b []byte) (*big.Int, error) {
+	if len(b) > maxScriptNumLen {
+		return nil, errors.New("number too large")
+	}
+	// the last byte can only be 0x00 or 0x80 to make room for the sign bit
+	if l := len(b); l > 0 && b[l-1]&0x7f == 0 && (l == 1 || b[l-2]&0x80 == 0) {
+		return nil, fmt.Errorf("non minimal number %x", b)
+	}
+	return rawToNum(b), nil
+}
+
+func rawToNum(b []byte) *big.Int {
+	if len(b) == 0 {
+		return new(big.Int)
+	}
+	be := make([]byte, len(b))
+	for i := range b {
+		be[len(b)-1-i] = b[i]
+	}
+	neg := be[0]&0x80 != 0
+	be[0] &= 0x7f
+	n := new(big.Int).SetBytes(be)
+	if neg {
+		n.Neg(n)
+	}
+	return n
+}
+
+// numToBytes is the minimal little endian sign-magnitude encoding of n
+func numToBytes(n *big.Int) []byte {
+	if n.Sign() == 0 {
+		return nil
+	}
+	be := new(big.Int).Abs(n).Bytes()
+	le := make([]byte, len(be), len(be)+1)
+	for i := range be {
+		le[len(be)-1-i] = be[i]
+	}
+	if le[len(le)-1]&0x80 != 0 {
+		le = append(le, 0)
+	}
+	if n.Sign() < 0 {
+		le[len(le)-1] |= 0x80
+	}
+	return le
+}
+
+func num2bin(a []byte, size *big.Int) ([]byte, error) {
+	if !size.IsInt64() || size.Int64() < 0 || size.Int64() > maxScriptNumLen {
+		return nil, fmt.Errorf("invalid size %v", size)
+	}
+	n := rawToNum(a)
+	b := numToBytes(n)
+	sz := int(size.Int64())
+	if len(b) > sz {
+		return nil, fmt.Errorf("%d bytes don't fit in %d", len(b), sz)
+	}
+	if len(b) == sz {
+		return b, nil
+	}
+	out := make([]byte, sz)
+	copy(out, b)
+	if len(b) > 0 && n.Sign() < 0 {
+		// move the sign bit to the new last byte
+		out[len(b)-1] &= 0x7f
+		out[sz-1] = 0x80
+	}
+	return out, nil
+}
+
+// shiftBytes shifts a as a big endian bit string, keeping its size
+func shiftBytes(a []byte, n *big.Int, left bool) []byte {
+	out := make([]byte, len(a))
+	if !n.IsInt64() || n.Int64() >= int64(len(a))*8 {
+		return out
+	}
+	v := new(big.Int).SetBytes(a)
+	if left {
+		v.Lsh(v, uint(n.Int64()))
+	} else {
+		v.Rsh(v, uint(n.Int64()))
+	}
+	vb := v.Bytes()
+	if len(vb) > len(out) {
+		vb = vb[len(vb)-len(out):]
+	}
+	copy(out[len(out)-len(vb):], vb)
+	return out
+}
@@ -0,0 +1,166 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"testing"
+)
+
+type fakeChecker struct {
+	sig, pub []byte
+}
+
+func (f fakeChecker) CheckSig(sig, pub, subscript []byte) (bool, error) {
+	return bytes.Equal(sig, f.sig) && bytes.Equal(pub, f.pub), nil
+}
+
+func TestVerifyBoostPuzzle(t *testing.T) {
+	const nOuts = 5
+	br := testBoostRequest()
+	s1, _ := base64.StdEncoding.DecodeString(br.S1)
+	addr, _ := Testnet.DecodeAddress(br.ChangeAddress)
+	tx, err := ParseTx(testPartialTx(t))
+	if err != nil {
+		t.Fatalf("error parsing partial tx: %v\n", err)
+	}
+	boostTx, err := BoostScript(tx, s1, nOuts, 100, 49049, addr, defaultFees)
+	if err != nil {
+		t.Fatalf("error building boost tx: %v\n", err)
+	}
+
+	s2Of := func(i uint32) []byte {
+		h := sha1.New()
+		h.Write(s1)
+		binary.Write(h, binary.BigEndian, i)
+		return h.Sum(nil)
+	}
+	unlock := func(s2 []byte) []byte {
+		sc, _ := NewScriptBuilder().AddData(s2).Script()
+		return sc
+	}
+
+	for i := 0; i < nOuts; i++ {
+		locking := boostTx.txouts[i].script
+		if err := VerifyScript(unlock(s2Of(uint32(i))), locking, nil); err != nil {
+			t.Fatalf("out %d: expected s2 to unlock, got %v\n", i, err)
+		}
+		if err := VerifyScript(unlock(s2Of(uint32(i+1))), locking, nil); err == nil {
+			t.Fatalf("out %d: expected the s2 of another output to fail\n", i)
+		}
+		if err := VerifyScript(unlock(s1), locking, nil); err == nil {
+			t.Fatalf("out %d: expected s1 to fail\n", i)
+		}
+	}
+
+	// the unlocking script could otherwise hash s1 itself
+	notPushOnly, _ := NewScriptBuilder().AddData(s2Of(0)).AddOp(op_sha1, op_sha1).Script()
+	if err := VerifyScript(notPushOnly, boostTx.txouts[0].script, nil); err != errPushOnly {
+		t.Fatalf("expected %v, got %v\n", errPushOnly, err)
+	}
+}
+
+func TestVerifyP2PKH(t *testing.T) {
+	pub := bytes.Repeat([]byte{2}, 33)
+	sig := []byte{0x30, 0x01, 0x41}
+	locking, _ := p2pkh(hashOp(op_hash160, pub))
+	good, _ := NewScriptBuilder().AddData(sig).AddData(pub).Script()
+	checker := fakeChecker{sig: sig, pub: pub}
+
+	if err := VerifyScript(good, locking, checker); err != nil {
+		t.Fatalf("expected p2pkh to verify, got %v\n", err)
+	}
+	if err := VerifyScript(good, locking, nil); err == nil {
+		t.Fatal("expected an error without a checker")
+	}
+
+	badSig, _ := NewScriptBuilder().AddData([]byte{0x30, 0x02, 0x41}).AddData(pub).Script()
+	emptySig, _ := NewScriptBuilder().AddData(nil).AddData(pub).Script()
+	otherPub, _ := NewScriptBuilder().AddData(sig).AddData(bytes.Repeat([]byte{3}, 33)).Script()
+	for name, unlocking := range map[string][]byte{"bad sig": badSig, "empty sig": emptySig, "other pub": otherPub} {
+		if err := VerifyScript(unlocking, locking, checker); err == nil {
+			t.Errorf("%s: expected an error\n", name)
+		}
+	}
+}
+
+func TestInterpreter(t *testing.T) {
+	valids := []string{
+		"OP_1 OP_2 OP_ADD OP_3 OP_EQUAL",
+		"OP_5 OP_7 OP_SUB -1 OP_NEGATE OP_SUB OP_3 OP_NEGATE OP_NUMEQUAL",
+		"OP_16 OP_16 OP_MUL 0001 OP_EQUAL",
+		"-1 OP_5 OP_MUL OP_2 OP_DIV OP_2 OP_NEGATE OP_NUMEQUAL",
+		"-1 OP_5 OP_MUL OP_2 OP_MOD -1 OP_NUMEQUAL",
+		"OP_3 OP_1 OP_5 OP_WITHIN",
+		"OP_2 OP_9 OP_MAX OP_4 OP_MIN OP_4 OP_NUMEQUAL",
+		"OP_0 OP_NOT OP_0 OP_0NOTEQUAL OP_BOOLOR",
+		"OP_1 OP_IF OP_2 OP_ELSE OP_3 OP_ENDIF OP_2 OP_EQUAL",
+		"OP_0 OP_IF OP_2 OP_ELSE OP_3 OP_ENDIF OP_3 OP_EQUAL",
+		"OP_0 OP_NOTIF OP_1 OP_IF OP_7 OP_ENDIF OP_ENDIF OP_7 OP_EQUAL",
+		"OP_0 OP_IF OP_RETURN OP_ENDIF OP_1",
+		"OP_1 OP_2 OP_3 OP_ROT OP_1 OP_EQUALVERIFY OP_3 OP_EQUALVERIFY OP_2 OP_EQUAL",
+		"OP_1 OP_2 OP_SWAP OP_1 OP_EQUALVERIFY OP_2 OP_EQUAL",
+		"OP_1 OP_2 OP_3 OP_2 OP_PICK OP_1 OP_EQUALVERIFY OP_DEPTH OP_3 OP_EQUAL",
+		"OP_1 OP_2 OP_3 OP_2 OP_ROLL OP_1 OP_EQUALVERIFY OP_DEPTH OP_2 OP_EQUAL",
+		"OP_1 OP_2 OP_TUCK OP_DEPTH OP_3 OP_EQUALVERIFY OP_2DROP OP_2 OP_EQUAL",
+		"OP_1 OP_2 OP_2DUP OP_3DUP OP_DEPTH OP_7 OP_EQUAL",
+		"OP_1 OP_TOALTSTACK OP_2 OP_FROMALTSTACK OP_1 OP_EQUALVERIFY OP_2 OP_EQUAL",
+		"0102 03 OP_CAT 010203 OP_EQUAL",
+		"010203 OP_1 OP_SPLIT 0203 OP_EQUALVERIFY 01 OP_EQUAL",
+		"OP_2 OP_4 OP_NUM2BIN 02000000 OP_EQUAL",
+		"-1 OP_2 OP_NUM2BIN 0180 OP_EQUAL",
+		"01000080 OP_BIN2NUM -1 OP_EQUAL",
+		"ff00 OP_INVERT 00ff OP_EQUAL",
+		"0f OP_4 OP_LSHIFT f0 OP_EQUAL",
+		"abcd OP_SIZE OP_2 OP_EQUALVERIFY abcd OP_EQUAL",
+		"00 OP_SHA1 5ba93c9db0cff93f52b521d7420e43f6eda2784f OP_EQUAL",
+		"00 OP_SHA256 6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d OP_EQUAL",
+		"OP_0 OP_RIPEMD160 9c1185a5c5e9fc54612808977ee8f548b2258d31 OP_EQUAL",
+		"OP_0 OP_HASH160 b472a266d0bd89c13706a4132ccfb16f7c3b9fcb OP_EQUAL",
+		"OP_0 OP_HASH256 5df6e0e2761359d30a8275058e299fcc0381534545f55cf43e41983f5d4c9456 OP_EQUAL",
+		"OP_1 OP_RETURN OP_0",
+	}
+	for _, asm := range valids {
+		locking, err := Assemble(asm)
+		if err != nil {
+			t.Fatalf("%s: error assembling: %v\n", asm, err)
+		}
+		if err := VerifyScript(nil, locking, nil); err != nil {
+			t.Errorf("%s: expected to verify, got %v\n", asm, err)
+		}
+	}
+
+	invalids := []string{
+		"",
+		"OP_0",
+		"OP_1 OP_2 OP_ADD OP_4 OP_EQUAL",
+		"OP_ADD",
+		"OP_1 OP_0 OP_DIV",
+		"OP_1 OP_IF OP_1",
+		"OP_1 OP_ENDIF",
+		"OP_1 OP_IF OP_RETURN OP_ENDIF",
+		"0100 OP_1ADD",
+		"OP_1 OP_VERIFY OP_0 OP_VERIFY OP_1",
+		"0102 03 OP_AND",
+		"OP_1 OP_RESERVED",
+		"OP_1 OP_UNKNOWN_ba",
+		"OP_0 OP_0 OP_0 OP_CHECKMULTISIG",
+		"80 OP_IF OP_1 OP_ENDIF",
+	}
+	for _, asm := range invalids {
+		locking, err := Assemble(asm)
+		if err != nil {
+			t.Fatalf("%s: error assembling: %v\n", asm, err)
+		}
+		if err := VerifyScript(nil, locking, nil); err == nil {
+			t.Errorf("%s: expected an error\n", asm)
+		}
+	}
+
+	// nothing runs past the stack limit
+	bomb := bytes.Repeat([]byte{op_true, op_dup}, maxStackSize)
+	if err := VerifyScript(nil, bomb, nil); err == nil {
+		t.Fatal("expected a stack overflow")
+	}
+}
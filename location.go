@@ -0,0 +1,114 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"google.golang.org/api/iterator"
+)
+
+type locationRequest struct {
+	UserID string  `json:"userID"`
+	Lat    float64 `json:"lat"`
+	Lon    float64 `json:"lon"`
+}
+
+// HandleUpdateLocation moves the caller to lat, lon and indexes them under
+// every geohash prefix boosts query, see geohashes
+func (s *Server) HandleUpdateLocation(w http.ResponseWriter, r *http.Request) {
+	if err := s.handleUpdateLocation(r.Context(), r); err != nil {
+		WriteError(w, err)
+		return
+	}
+	writeJson(w, map[string]string{"status": "ok"})
+}
+
+func (s *Server) handleUpdateLocation(ctx context.Context, r *http.Request) error {
+	var lr locationRequest
+	if err := json.NewDecoder(r.Body).Decode(&lr); err != nil {
+		return bodyError(codeInvalidJson, "error decoding locationRequest", err)
+	}
+	id, err := identityFrom(ctx)
+	if err != nil {
+		return err
+	}
+	if !id.is(lr.UserID) {
+		return forbidden("user " + lr.UserID + " is not the caller")
+	}
+	p := latlon{Lat: lr.Lat, Lon: lr.Lon}
+	if !validPoint(p) {
+		return badRequest(codeInvalidRequest, "invalid location", nil)
+	}
+	fields := geohashes(p.Lat, p.Lon)
+	fields["latitude"], fields["longitude"] = p.Lat, p.Lon
+	err = s.Firestore.Update(ctx, "users", ParseRoot(lr.UserID)[0].Unik, fields)
+	if errors.Is(err, errDocNotFound) {
+		return notFound(codeNoUser, "no user "+lr.UserID, err)
+	} else if err != nil {
+		return internal(codeWriteFailed, "error updating location", err)
+	}
+	return nil
+}
+
+// BackfillGeohashes indexes the users written before geohash1 to geohash6
+// existed under them, boosts don't find users without. Users whose prefixes
+// disagree with their position, like ones an older client moved by writing
+// geohash alone, are indexed again. It reads users by id a page at a time
+// and returns how many it indexed
+func (s *Server) BackfillGeohashes(ctx context.Context) (int, error) {
+	n := 0
+	var cursor []interface{}
+	for {
+		q := &DocQuery{Collection: "users", OrderBy: []string{"id"}, StartAfter: cursor, Limit: queryPage}
+		it := s.Firestore.Query(ctx, q)
+		read := 0
+		var err error
+		for {
+			var doc Document
+			if doc, err = it.Next(); err != nil {
+				break
+			}
+			read++
+			var u struct {
+				Id       string  `firestore:"id"`
+				Lat      float64 `firestore:"latitude"`
+				Lon      float64 `firestore:"longitude"`
+				Geohash  string  `firestore:"geohash"`
+				Geohash6 string  `firestore:"geohash6"`
+			}
+			if err = doc.DataTo(&u); err != nil {
+				err = fmt.Errorf("error decoding user: %v", err)
+				break
+			}
+			cursor = []interface{}{u.Id}
+			if !validPoint(latlon{Lat: u.Lat, Lon: u.Lon}) {
+				continue
+			}
+			fields := geohashes(u.Lat, u.Lon)
+			if u.Geohash6 == fields[geohashField(maxPrecision)] && u.Geohash == fields[geohashField(precision)] {
+				continue
+			}
+			cp, perr := parseUserId(u.Id)
+			if perr != nil {
+				NonFatal(perr, "skipping user "+u.Id)
+				continue
+			}
+			if err = s.Firestore.Update(ctx, "users", cp.Unik, fields); err != nil {
+				err = fmt.Errorf("error indexing user %s: %v", u.Id, err)
+				break
+			}
+			n++
+		}
+		it.Stop()
+		if err != nil && err != iterator.Done {
+			return n, err
+		} else if read < queryPage {
+			log.Printf("indexed %d users under every geohash prefix\n", n)
+			return n, nil
+		}
+	}
+}
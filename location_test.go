@@ -0,0 +1,102 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mmcloughlin/geohash"
+)
+
+func TestUpdateLocation(t *testing.T) {
+	ctx := context.Background()
+	c := newTestServer(t)
+	docs := c.Firestore.(*MemoryDocs)
+	seedBoostUsers(docs)
+	update := func(uid string, lr locationRequest) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(lr)
+		w := httptest.NewRecorder()
+		c.HandleUpdateLocation(w, asUser(httptest.NewRequest("POST", "/location", bytes.NewReader(b)), uid))
+		return w
+	}
+
+	lr := locationRequest{UserID: "rimouski-america-0", Lat: 45.5019, Lon: -73.5674}
+	if w := update("rimouski", lr); w.Code != 200 {
+		t.Fatalf("unexpected response %d %s\n", w.Code, w.Body.String())
+	}
+	doc, _ := docs.Get(ctx, "users", "rimouski")
+	var user map[string]interface{}
+	doc.DataTo(&user)
+	for k, v := range geohashes(lr.Lat, lr.Lon) {
+		if user[k] != v {
+			t.Errorf("expected %s %v, got %v\n", k, v, user[k])
+		}
+	}
+	if user["latitude"] != lr.Lat || user["longitude"] != lr.Lon || user["gender"] != "male" {
+		t.Fatalf("unexpected user after the update %v\n", user)
+	}
+
+	for name, tc := range map[string]struct {
+		uid  string
+		lr   locationRequest
+		code int
+	}{
+		"someone else": {"bic", lr, 403},
+		"bad latitude": {"rimouski", locationRequest{UserID: lr.UserID, Lat: 91}, 400},
+		"no user":      {"nobody", locationRequest{UserID: "nobody-america-0", Lat: 1, Lon: 1}, 404},
+	} {
+		if w := update(tc.uid, tc.lr); w.Code != tc.code {
+			t.Errorf("%s: expected %d, got %d %s\n", name, tc.code, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestBackfillGeohashes(t *testing.T) {
+	ctx := context.Background()
+	c := newTestServer(t)
+	docs := c.Firestore.(*MemoryDocs)
+
+	// written by an older client, geohash is the only prefix
+	lat, lon := geohash.BoundingBox("f2xv").Center()
+	docs.Put("users", "legacy", map[string]interface{}{
+		"id": "legacy-america-0", "latitude": lat, "longitude": lon, "age": 25, "gender": "male",
+		"geohash": geohash.EncodeWithPrecision(lat, lon, precision),
+	})
+	br := &boostRequest2{MinAge: 18, MaxAge: 39, Genders: []string{"male"}, Limit: 10}
+
+	// found in cells of the legacy precision only
+	cell := geohash.BoundingBox("f2xv")
+	br.Areas = []area{{Type: areaBox, Box: &boundingBox{South: cell.MinLat, West: cell.MinLng, North: cell.MaxLat, East: cell.MaxLng}}}
+	if users, _, err := c.scanAreas(ctx, br); err != nil || len(users) != 1 {
+		t.Fatalf("expected the legacy user in a cell of precision %d, got %d: %v\n", precision, len(users), err)
+	}
+	br.Areas = []area{{Type: areaCircle, Center: latlon{Lat: lat, Lon: lon}, RadiusKm: 1}}
+	if users, _, err := c.scanAreas(ctx, br); err != nil || len(users) != 0 {
+		t.Fatalf("expected no legacy user in finer cells, got %d: %v\n", len(users), err)
+	}
+
+	seedBoostUsers(docs)
+	if n, err := c.BackfillGeohashes(ctx); err != nil || n != 1 {
+		t.Fatalf("expected a single user to index, got %d: %v\n", n, err)
+	}
+	if users, _, err := c.scanAreas(ctx, br); err != nil || len(users) != 1 || users[0].Id != "legacy-america-0" {
+		t.Fatalf("expected the legacy user once indexed, got %v: %v\n", users, err)
+	}
+	if n, err := c.BackfillGeohashes(ctx); err != nil || n != 0 {
+		t.Fatalf("expected nothing left to index, got %d: %v\n", n, err)
+	}
+
+	// an older client moved them, geohash6 is where they were
+	docs.Update(ctx, "users", "legacy", map[string]interface{}{"geohash6": "dr5reg"})
+	if users, _, err := c.scanAreas(ctx, br); err != nil || len(users) != 0 {
+		t.Fatalf("expected no user under stale prefixes, got %d: %v\n", len(users), err)
+	}
+	if n, err := c.BackfillGeohashes(ctx); err != nil || n != 1 {
+		t.Fatalf("expected the moved user to index again, got %d: %v\n", n, err)
+	}
+	if users, _, err := c.scanAreas(ctx, br); err != nil || len(users) != 1 {
+		t.Fatalf("expected the moved user once indexed again, got %d: %v\n", len(users), err)
+	}
+}
@@ -0,0 +1,605 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	rtdb "firebase.google.com/go/v4/db"
+	"firebase.google.com/go/v4/messaging"
+	"google.golang.org/api/iterator"
+)
+
+// In-memory implementations of the store.go interfaces, they behave close
+// enough to firebase for the handlers to run offline
+
+const memTxRetries = 25
+
+var errMemTxRetries = errors.New("memory transaction aborted after too many retries")
+
+// MemoryDB is a realtime database tree, values go through json like they
+// would over the wire, so numbers come back as float64
+type MemoryDB struct {
+	mu   sync.Mutex
+	root interface{}
+}
+
+func NewMemoryDB() *MemoryDB {
+	return &MemoryDB{}
+}
+
+func (m *MemoryDB) NewRef(path string) RealtimeRef {
+	return &memRef{db: m, path: splitPath(path)}
+}
+
+func splitPath(path string) []string {
+	return Filter(strings.Split(path, "/"), func(s string) bool {
+		return len(s) > 0
+	})
+}
+
+func normalize(v interface{}) (interface{}, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var n interface{}
+	err = json.Unmarshal(raw, &n)
+	return n, err
+}
+
+func (m *MemoryDB) get(path []string) interface{} {
+	cur := m.root
+	for _, k := range path {
+		node, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		cur = node[k]
+	}
+	return cur
+}
+
+func (m *MemoryDB) set(path []string, v interface{}) {
+	if len(path) == 0 {
+		m.root = v
+		return
+	}
+	node, ok := m.root.(map[string]interface{})
+	if !ok {
+		node = map[string]interface{}{}
+		m.root = node
+	}
+	for _, k := range path[:len(path)-1] {
+		next, ok := node[k].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			node[k] = next
+		}
+		node = next
+	}
+	if v == nil {
+		delete(node, path[len(path)-1])
+	} else {
+		node[path[len(path)-1]] = v
+	}
+}
+
+func (m *MemoryDB) snapshot(path []string) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	raw, _ := json.Marshal(m.get(path))
+	return raw
+}
+
+type memRef struct {
+	db   *MemoryDB
+	path []string
+}
+
+func (r *memRef) Child(path string) RealtimeRef {
+	p := append(append([]string{}, r.path...), splitPath(path)...)
+	return &memRef{db: r.db, path: p}
+}
+
+func (r *memRef) Get(ctx context.Context, v interface{}) error {
+	return json.Unmarshal(r.db.snapshot(r.path), v)
+}
+
+func (r *memRef) Set(ctx context.Context, v interface{}) error {
+	n, err := normalize(v)
+	if err != nil {
+		return err
+	}
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	r.db.set(r.path, n)
+	return nil
+}
+
+func (r *memRef) Push(ctx context.Context, v interface{}) (RealtimeRef, error) {
+	child := r.Child(MakePushKey())
+	if err := child.Set(ctx, v); err != nil {
+		return nil, err
+	}
+	return child, nil
+}
+
+// optimistic like firebase, fn can run more than once and can itself run
+// transactions on other refs
+func (r *memRef) Transaction(ctx context.Context, fn rtdb.UpdateFn) error {
+	for i := 0; i < memTxRetries; i++ {
+		before := r.db.snapshot(r.path)
+		v, err := fn(memTxNode(before))
+		if err != nil {
+			return err
+		}
+		n, err := normalize(v)
+		if err != nil {
+			return err
+		}
+
+		r.db.mu.Lock()
+		cur, _ := json.Marshal(r.db.get(r.path))
+		if bytes.Equal(cur, before) {
+			r.db.set(r.path, n)
+			r.db.mu.Unlock()
+			return nil
+		}
+		r.db.mu.Unlock()
+	}
+	return errMemTxRetries
+}
+
+type memTxNode []byte
+
+func (n memTxNode) Unmarshal(v interface{}) error {
+	return json.Unmarshal(n, v)
+}
+
+type memObject struct {
+	data     []byte
+	metadata map[string]string
+}
+
+type MemoryBucket struct {
+	mu      sync.Mutex
+	name    string
+	objects map[string]*memObject
+}
+
+func NewMemoryBucket(name string) *MemoryBucket {
+	return &MemoryBucket{name: name, objects: map[string]*memObject{}}
+}
+
+// Data returns the content of an object, nil when it doesn't exist
+func (b *MemoryBucket) Data(name string) []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if o, ok := b.objects[name]; ok {
+		return o.data
+	}
+	return nil
+}
+
+func (b *MemoryBucket) NewWriter(ctx context.Context, name string, metadata map[string]string) io.WriteCloser {
+	return &memWriter{b: b, name: name, metadata: metadata}
+}
+
+func (b *MemoryBucket) Attrs(ctx context.Context, name string) (*storage.ObjectAttrs, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	o, ok := b.objects[name]
+	if !ok {
+		return nil, storage.ErrObjectNotExist
+	}
+	return &storage.ObjectAttrs{
+		Bucket:   b.name,
+		Name:     name,
+		Size:     int64(len(o.data)),
+		Metadata: CopyMap_(o.metadata),
+	}, nil
+}
+
+func (b *MemoryBucket) SignedURL(name string, opts *storage.SignedURLOptions) (string, error) {
+	return "memory://" + b.name + "/" + name, nil
+}
+
+type memWriter struct {
+	bytes.Buffer
+	b        *MemoryBucket
+	name     string
+	metadata map[string]string
+}
+
+func (w *memWriter) Close() error {
+	w.b.mu.Lock()
+	defer w.b.mu.Unlock()
+	w.b.objects[w.name] = &memObject{
+		data:     append([]byte{}, w.Bytes()...),
+		metadata: CopyMap_(w.metadata),
+	}
+	return nil
+}
+
+var errDocNotFound = errors.New("document not found")
+
+// MemoryDocs is a document store, documents are maps keyed by their
+// firestore field names
+type MemoryDocs struct {
+	mu          sync.Mutex
+	collections map[string]map[string]map[string]interface{}
+}
+
+func NewMemoryDocs() *MemoryDocs {
+	return &MemoryDocs{collections: map[string]map[string]map[string]interface{}{}}
+}
+
+func (d *MemoryDocs) Put(collection, id string, data map[string]interface{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.collections[collection] == nil {
+		d.collections[collection] = map[string]map[string]interface{}{}
+	}
+	d.collections[collection][id] = CopyMap_(data)
+}
+
+func (d *MemoryDocs) Get(ctx context.Context, collection, id string) (Document, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	data, ok := d.collections[collection][id]
+	if !ok {
+		return nil, fmt.Errorf("%s/%s: %w", collection, id, errDocNotFound)
+	}
+	return memDoc(CopyMap_(data)), nil
+}
+
+func (d *MemoryDocs) Update(ctx context.Context, collection, id string, data map[string]interface{}) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	doc, ok := d.collections[collection][id]
+	if !ok {
+		return fmt.Errorf("%s/%s: %w", collection, id, errDocNotFound)
+	}
+	for k, v := range CopyMap_(data) {
+		doc[k] = v
+	}
+	return nil
+}
+
+func (d *MemoryDocs) Query(ctx context.Context, q *DocQuery) DocumentIterator {
+	ins := 0
+	for _, f := range q.Filters {
+		if f.Op == "in" {
+			ins++
+		}
+	}
+	if ins > 1 {
+		return &memIter{err: fmt.Errorf("query on %s has %d in filters, only one is allowed", q.Collection, ins)}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	coll := d.collections[q.Collection]
+	ids := make([]string, 0, len(coll))
+	for id := range coll {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	matches := make([]map[string]interface{}, 0)
+	for _, id := range ids {
+		data := coll[id]
+		match := Every(q.Filters, func(f DocFilter) bool {
+			return matchFilter(data[f.Path], f)
+		}) && Every(q.OrderBy, func(path string) bool {
+			return data[path] != nil
+		})
+		if match && (len(q.StartAfter) == 0 || compareOrder(data, q.OrderBy, q.StartAfter) > 0) {
+			matches = append(matches, data)
+		}
+	}
+	// stable, documents the order doesn't tell apart stay sorted by id
+	sort.SliceStable(matches, func(i, j int) bool {
+		return compareOrder(matches[i], q.OrderBy, orderValues(matches[j], q.OrderBy)) < 0
+	})
+	if q.Limit > 0 && len(matches) > q.Limit {
+		matches = matches[:q.Limit]
+	}
+	docs := make([]Document, len(matches))
+	for i, data := range matches {
+		docs[i] = memDoc(CopyMap_(data))
+	}
+	return &memIter{docs: docs}
+}
+
+func orderValues(data map[string]interface{}, orderBy []string) []interface{} {
+	vals := make([]interface{}, len(orderBy))
+	for i, path := range orderBy {
+		vals[i] = data[path]
+	}
+	return vals
+}
+
+// compareOrder compares data to the values of a cursor field by field
+func compareOrder(data map[string]interface{}, orderBy []string, vals []interface{}) int {
+	for i, path := range orderBy {
+		if i >= len(vals) {
+			break
+		}
+		if c, ok := compareValues(data[path], vals[i]); ok && c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func matchFilter(v interface{}, f DocFilter) bool {
+	if v == nil {
+		return false
+	}
+	if f.Op == "in" {
+		rv := reflect.ValueOf(f.Value)
+		if rv.Kind() != reflect.Slice {
+			return false
+		}
+		for i := 0; i < rv.Len(); i++ {
+			if c, ok := compareValues(v, rv.Index(i).Interface()); ok && c == 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	c, ok := compareValues(v, f.Value)
+	if !ok {
+		return false
+	}
+	switch f.Op {
+	case "==":
+		return c == 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+func compareValues(a, b interface{}) (int, bool) {
+	if as, ok := a.(string); ok {
+		bs, ok := b.(string)
+		return strings.Compare(as, bs), ok
+	}
+	af, ok := toFloat(a)
+	if !ok {
+		return 0, false
+	}
+	bf, ok := toFloat(b)
+	if !ok {
+		return 0, false
+	}
+	if af < bf {
+		return -1, true
+	} else if af > bf {
+		return 1, true
+	}
+	return 0, true
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
+
+type memIter struct {
+	docs []Document
+	i    int
+	err  error
+}
+
+func (it *memIter) Next() (Document, error) {
+	if it.err != nil {
+		return nil, it.err
+	}
+	if it.i >= len(it.docs) {
+		return nil, iterator.Done
+	}
+	it.i++
+	return it.docs[it.i-1], nil
+}
+
+func (it *memIter) Stop() {
+	it.i = len(it.docs)
+}
+
+type memDoc map[string]interface{}
+
+func (d memDoc) DataAt(path string) (interface{}, error) {
+	v, ok := d[path]
+	if !ok {
+		return nil, fmt.Errorf("no field %q", path)
+	}
+	return v, nil
+}
+
+// DataTo fills *map[string]interface{} or a struct pointer, fields are
+// matched with their firestore tag like the firestore client does
+func (d memDoc) DataTo(v interface{}) error {
+	if m, ok := v.(*map[string]interface{}); ok {
+		*m = CopyMap_(d)
+		return nil
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("cannot decode document into %T", v)
+	}
+	st := rv.Elem()
+	for i := 0; i < st.NumField(); i++ {
+		field := st.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("firestore"), ",")[0]
+		if name == "-" {
+			continue
+		} else if len(name) == 0 {
+			name = field.Name
+		}
+		val, ok := d[name]
+		if !ok || val == nil {
+			continue
+		}
+		fv, ft := reflect.ValueOf(val), field.Type
+		if ft.Kind() == reflect.String && fv.Kind() != reflect.String {
+			return fmt.Errorf("cannot decode %v into string field %s", val, field.Name)
+		} else if !fv.Type().ConvertibleTo(ft) {
+			return fmt.Errorf("cannot decode %T into field %s of type %v", val, field.Name, ft)
+		}
+		st.Field(i).Set(fv.Convert(ft))
+	}
+	return nil
+}
+
+// MemoryMessenger keeps what would have been sent to firebase messaging
+type MemoryMessenger struct {
+	mu   sync.Mutex
+	Sent []*messaging.Message
+}
+
+func NewMemoryMessenger() *MemoryMessenger {
+	return &MemoryMessenger{}
+}
+
+func (m *MemoryMessenger) Send(ctx context.Context, msg *messaging.Message) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Sent = append(m.Sent, msg)
+	return "projects/memory/messages/" + strconv.Itoa(len(m.Sent)), nil
+}
+
+func (m *MemoryMessenger) SendEach(ctx context.Context, msgs []*messaging.Message) (*messaging.BatchResponse, error) {
+	rsps := make([]*messaging.SendResponse, 0, len(msgs))
+	for _, msg := range msgs {
+		id, _ := m.Send(ctx, msg)
+		rsps = append(rsps, &messaging.SendResponse{Success: true, MessageID: id})
+	}
+	return &messaging.BatchResponse{SuccessCount: len(rsps), Responses: rsps}, nil
+}
+
+// MemoryUTXOs is a fixed set of prevouts, like the outputs of the txs
+// in a fixture file, see LoadUTXOFile
+type MemoryUTXOs struct {
+	mu       sync.Mutex
+	prevouts map[string]*Prevout
+}
+
+func NewMemoryUTXOs() *MemoryUTXOs {
+	return &MemoryUTXOs{prevouts: map[string]*Prevout{}}
+}
+
+func outpoint(txid []byte, index uint32) string {
+	return explorerTxid(txid) + ":" + strconv.FormatUint(uint64(index), 10)
+}
+
+func (m *MemoryUTXOs) Add(txid []byte, index uint32, p *Prevout) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prevouts[outpoint(txid, index)] = p
+}
+
+// AddTx makes every output of the raw tx spendable
+func (m *MemoryUTXOs) AddTx(raw []byte) error {
+	tx, err := ParseTx(raw)
+	if err != nil {
+		return err
+	}
+	txid := Txid(raw)
+	for i, out := range tx.txouts {
+		m.Add(txid, uint32(i), &Prevout{Sats: out.sats, Script: out.script})
+	}
+	return nil
+}
+
+func (m *MemoryUTXOs) Prevout(ctx context.Context, txid []byte, index uint32) (*Prevout, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.prevouts[outpoint(txid, index)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errUnknownUTXO, outpoint(txid, index))
+	}
+	return p, nil
+}
+
+// LoadUTXOFile reads a json list of raw tx hex, their outputs are the utxos
+func LoadUTXOFile(path string) (*MemoryUTXOs, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading utxo file %s: %v", path, err)
+	}
+	var txs []string
+	if err := json.Unmarshal(raw, &txs); err != nil {
+		return nil, fmt.Errorf("error decoding utxo file %s: %v", path, err)
+	}
+	m := NewMemoryUTXOs()
+	for i, txHex := range txs {
+		rawTx, err := hex.DecodeString(txHex)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding tx %d of %s: %v", i, path, err)
+		}
+		if err := m.AddTx(rawTx); err != nil {
+			return nil, fmt.Errorf("error parsing tx %d of %s: %v", i, path, err)
+		}
+	}
+	return m, nil
+}
+
+// NewMemoryServer mirrors the shard topology of cfg with in-memory backends
+func NewMemoryServer(cfg *Config) *Server {
+	shards := make(map[string][]ServerShard, len(cfg.Regions))
+	for reg, scfgs := range cfg.Regions {
+		shards[reg] = make([]ServerShard, len(scfgs))
+		for i, scfg := range scfgs {
+			shards[reg][i] = ServerShard{
+				RealtimeDB:   NewMemoryDB(),
+				TempBucket:   NewMemoryBucket(scfg.TempBucket),
+				StaticBucket: NewMemoryBucket(scfg.StaticBucket),
+			}
+		}
+	}
+	return &Server{
+		Shards:      shards,
+		Messager:    NewMemoryMessenger(),
+		Firestore:   NewMemoryDocs(),
+		SignedOpts:  &storage.SignedURLOptions{Method: "GET"},
+		Network:     cfg.Net(),
+		Fees:        cfg.FeePolicy(),
+		BoostTTL:    cfg.BoostTTL(),
+		Broadcaster: NewMockBroadcaster(),
+		UTXOs:       NewMemoryUTXOs(),
+	}
+}
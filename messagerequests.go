@@ -43,15 +43,14 @@ type Replay struct {
 	DeviceId string `json:"dev"`
 }
 
-func init() {
-	ctx := context.Background()
-	ServerInit(ctx)
-}
-
-func PushData(ctx context.Context, userId, deviceId, payload string) *Replay {
+func (s *Server) PushData(ctx context.Context, userId, deviceId, payload string) *Replay {
 	id := ParseRoot(userId)[0]
-	db := id.ServerShard().RealtimeDB
-	ref := db.NewRef("roots/" + id.Unik + "/queues/" + deviceId)
+	shrd, err := s.ServerShard(id)
+	if err != nil {
+		NonFatal(err, "error pushing data")
+		return &Replay{UserId: userId, DeviceId: deviceId}
+	}
+	ref := shrd.RealtimeDB.NewRef("roots/" + id.Unik + "/queues/" + deviceId)
 	if _, err := ref.Push(ctx, payload); err != nil {
 		return &Replay{UserId: userId, DeviceId: deviceId}
 	}
@@ -81,7 +80,7 @@ func (mr *MessageRequest) makeNotifications(rps []*Replay) []*messaging.Message
 	return msgs
 }
 
-func PushNotification(ctx context.Context, token, body, header, rootId, senderId string) error {
+func (s *Server) PushNotification(ctx context.Context, token, body, header, rootId, senderId string) error {
 	m := &messaging.Message{
 		Token: token,
 		Data: map[string]string{
@@ -91,7 +90,7 @@ func PushNotification(ctx context.Context, token, body, header, rootId, senderId
 			"s": senderId,
 		},
 	}
-	_, err := Client.Messager.Send(ctx, m)
+	_, err := s.Messager.Send(ctx, m)
 	return err
 }
 
@@ -100,12 +99,12 @@ func prettyPrint(i interface{}) string {
 	return string(s)
 }
 
-func pushRequest(ctx context.Context, targets []*MessageTarget, push string) []*Replay {
+func (s *Server) pushRequest(ctx context.Context, targets []*MessageTarget, push string) []*Replay {
 	nt := len(targets)
 	rpChan, replays := make(chan *Replay, nt), make([]*Replay, 0, nt)
 	handlePush_ := func(p string, mt *MessageTarget, ch chan *Replay) {
 		if mt.DoPush {
-			ch <- PushData(ctx, mt.UserId, mt.DeviceId, p)
+			ch <- s.PushData(ctx, mt.UserId, mt.DeviceId, p)
 		}
 	}
 
@@ -124,11 +123,14 @@ func pushRequest(ctx context.Context, targets []*MessageTarget, push string) []*
 
 var errorMessageAlreadyExists = errors.New("message already exists")
 
-func snipTransaction(ctx context.Context, mr *MessageRequest) (int, string, error) {
+func (s *Server) snipTransaction(ctx context.Context, mr *MessageRequest) (int, string, error) {
 	msgId := mr.Msg["id"]
 	_, rootStr, unikRoot, composedIds := ParseMessageId(msgId)
-	db := composedIds[0].ServerShard().RealtimeDB
-	rootRef := db.NewRef("roots/" + unikRoot)
+	shrd, err := s.ServerShard(composedIds[0])
+	if err != nil {
+		return 0, "", err
+	}
+	rootRef := shrd.RealtimeDB.NewRef("roots/" + unikRoot)
 	txRef := rootRef.Child("connection/upperSnip")
 	var k int
 	var upperSnip interface{}
@@ -164,15 +166,18 @@ func snipTransaction(ctx context.Context, mr *MessageRequest) (int, string, erro
 		return k, nil
 	}
 
-	err := txRef.Transaction(ctx, snipTx)
+	err = txRef.Transaction(ctx, snipTx)
 	return k, newMsgId, err
 }
 
-func messageTransaction(ctx context.Context, mr *MessageRequest) (int, string, error) {
+func (s *Server) messageTransaction(ctx context.Context, mr *MessageRequest) (int, string, error) {
 	msgId := mr.Msg["id"]
 	_, rootStr, unikRoot, composedIds := ParseMessageId(msgId)
-	db := composedIds[0].ServerShard().RealtimeDB
-	rootRef := db.NewRef("roots/" + unikRoot)
+	shrd, err := s.ServerShard(composedIds[0])
+	if err != nil {
+		return 0, "", err
+	}
+	rootRef := shrd.RealtimeDB.NewRef("roots/" + unikRoot)
 	txRef := rootRef.Child("connection/upperChat")
 	var k int
 	var upperChat interface{}
@@ -210,7 +215,7 @@ func messageTransaction(ctx context.Context, mr *MessageRequest) (int, string, e
 		return k, nil
 	}
 
-	err := txRef.Transaction(ctx, chatTxFunc)
+	err = txRef.Transaction(ctx, chatTxFunc)
 	return k, newMsgIdStr, err
 }
 
@@ -238,20 +243,27 @@ func makeChatNumUnik(chatNum int) string {
 
 var chatUpdateError error = errors.New("current chat update is more recent")
 
-func reactionTransaction(ctx context.Context, mr *MessageRequest) error {
+func (s *Server) reactionTransaction(ctx context.Context, mr *MessageRequest) error {
 	userPushKey := mr.Msg["id"]
 	chatNum, _, unikRoot, composedIds := ParseMessageId(mr.Msg["messageId"])
-	db := composedIds[0].ServerShard().RealtimeDB
-	rootRef := db.NewRef("roots/" + unikRoot)
+	shrd, err := s.ServerShard(composedIds[0])
+	if err != nil {
+		return err
+	}
+	rootRef := shrd.RealtimeDB.NewRef("roots/" + unikRoot)
 
 	msg := CopyMap__(mr.Msg)
 	msg["reactors"] = map[string]string{mr.Msg["senderId"]: ""}
 	chatRef := rootRef.Child("chats/" + chatNum + "/reactions/" + userPushKey)
-	Fatal(chatRef.Set(ctx, msg), "Error setting reaction")
+	if err := chatRef.Set(ctx, msg); err != nil {
+		return fmt.Errorf("error setting reaction: %w", err)
+	}
 
 	genKey := MakePushKey()
 	cuRef := rootRef.Child("chatUpdates/" + genKey)
-	Fatal(cuRef.Set(ctx, "r "+chatNum+" "+userPushKey), "Error pushing reaction chat update")
+	if err := cuRef.Set(ctx, "r "+chatNum+" "+userPushKey); err != nil {
+		return fmt.Errorf("error pushing reaction chat update: %w", err)
+	}
 
 	txFun := func(tn rtdb.TransactionNode) (interface{}, error) {
 		var curChatUpdate string
@@ -266,19 +278,26 @@ func reactionTransaction(ctx context.Context, mr *MessageRequest) error {
 	return txRef.Transaction(ctx, txFun)
 }
 
-func reactionIncrement(ctx context.Context, mr *MessageRequest) {
+func (s *Server) reactionIncrement(ctx context.Context, mr *MessageRequest) error {
 	reactionId := mr.Msg["reactionId"]
 	reactorId := mr.Msg["senderId"]
 	chatNum, _, unikRoot, composedIds := ParseMessageId(mr.Msg["messageId"])
-	db := composedIds[0].ServerShard().RealtimeDB
-	rootRef := db.NewRef("roots/" + unikRoot)
+	shrd, err := s.ServerShard(composedIds[0])
+	if err != nil {
+		return err
+	}
+	rootRef := shrd.RealtimeDB.NewRef("roots/" + unikRoot)
 	txRef := rootRef.Child("connection/chatUpdate")
 	chatRef := rootRef.Child("chats/" + chatNum + "/reactions/" + reactionId + "/reactors")
 	pushKey := MakePushKey()
 	cuRef := rootRef.Child("chatUpdates/" + pushKey)
-	Fatal(chatRef.Child(reactorId).Set(ctx, ""), "Error adding reactor to chat")
+	if err := chatRef.Child(reactorId).Set(ctx, ""); err != nil {
+		return fmt.Errorf("error adding reactor to chat: %w", err)
+	}
 	pushUpdate := "i " + reactorId + " " + chatNum + " " + reactionId
-	Fatal(cuRef.Set(ctx, pushUpdate), "Error pushing increment chat udpate")
+	if err := cuRef.Set(ctx, pushUpdate); err != nil {
+		return fmt.Errorf("error pushing increment chat update: %w", err)
+	}
 	txChatUpdate := func(tn rtdb.TransactionNode) (interface{}, error) {
 		var curPush string
 		tn.Unmarshal(&curPush)
@@ -289,30 +308,109 @@ func reactionIncrement(ctx context.Context, mr *MessageRequest) {
 			return nil, chatUpdateError
 		}
 	}
-	txRef.Transaction(ctx, txChatUpdate)
+	return txRef.Transaction(ctx, txChatUpdate)
 }
 
 // I think we can have one function for all
-func ProcessMessage(w http.ResponseWriter, r *http.Request) {
-	const retry = 4
-	var rtrErr error = fmt.Errorf("Exhausted %v retries\n", retry)
-
+func (s *Server) ProcessMessage(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
 	var mrs []*MessageRequest
 
-	Fatal(json.NewDecoder(r.Body).Decode(&mrs), "Error decoding requests")
+	if err := json.NewDecoder(r.Body).Decode(&mrs); err != nil {
+		WriteError(w, bodyError(codeInvalidJson, "error decoding requests", err))
+		return
+	}
 
-	var prs []*PushRes
-	onDone := func(err error) {
-		if len(prs) > 0 {
-			b, _ := json.Marshal(prs)
-			w.Write(b)
+	id, err := identityFrom(r.Context())
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	if err := s.authorizeMessages(ctx, id, mrs); err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	prs, err := s.processMessages(ctx, mrs)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+
+	if len(prs) > 0 {
+		b, _ := json.Marshal(prs)
+		w.Write(b)
+	}
+}
+
+// authorizeMessages checks every request before anything is written, the
+// caller has to be the sender and a member of every root it writes to.
+// Pushes and new chats and snips go to the queues of their targets, the
+// targets have to be members of the root too
+func (s *Server) authorizeMessages(ctx context.Context, id *Identity, mrs []*MessageRequest) error {
+	for _, mr := range mrs {
+		if !id.is(mr.Sender) {
+			return forbidden("sender " + mr.Sender + " is not the caller")
+		}
+		targets := make([]*ComposedId, len(mr.Targets))
+		for i, t := range mr.Targets {
+			cp, err := parseUserId(t.UserId)
+			if err != nil {
+				return badRequest(codeInvalidRequest, "invalid target", err)
+			}
+			targets[i] = cp
 		}
+
+		var roots []*ComposedId
+		var err error
+		pushes := false
+		if len(mr.Push) > 0 {
+			if roots, err = parseRoots(mr.Root); err != nil {
+				return badRequest(codeInvalidRequest, "invalid push root", err)
+			}
+			pushes = true
+		} else if len(mr.Msg) > 0 {
+			var msgId string
+			switch mr.Msg["type"] {
+			case "chat", "snip":
+				msgId, pushes = mr.Msg["id"], true
+			case "reaction", "increment":
+				msgId = mr.Msg["messageId"]
+			default:
+				continue
+			}
+			if !id.is(mr.Msg["senderId"]) {
+				return forbidden("message sender " + mr.Msg["senderId"] + " is not the caller")
+			}
+			if roots, err = parseMessageRoots(msgId); err != nil {
+				return badRequest(codeInvalidRequest, "invalid message id", err)
+			}
+		} else {
+			continue
+		}
+
+		members, err := s.rootMembers(ctx, roots)
 		if err != nil {
-			log.Fatalf("Fatal error: %v\n", err)
+			return internal(codeInternal, "error checking root membership", err)
+		}
+		root := RootOfComposedIds(roots)
+		if !members[id.UID] {
+			return forbidden("caller is not a member of " + root)
+		}
+		for i, cp := range targets {
+			if pushes && mr.Targets[i].DoPush && !members[cp.Unik] {
+				return forbidden("target " + mr.Targets[i].UserId + " is not a member of " + root)
+			}
 		}
 	}
+	return nil
+}
+
+func (s *Server) processMessages(ctx context.Context, mrs []*MessageRequest) ([]*PushRes, error) {
+	const retry = 4
+	var rtrErr error = fmt.Errorf("exhausted %v retries", retry)
 
+	var prs []*PushRes
 	for _, mr := range mrs {
 		var (
 			k       int
@@ -324,92 +422,80 @@ func ProcessMessage(w http.ResponseWriter, r *http.Request) {
 
 		if len(mr.Push) > 0 {
 			psh = mr.Push
-			replays = pushRequest(ctx, mr.Targets, mr.Push)
+			replays = s.pushRequest(ctx, mr.Targets, mr.Push)
 			// handlePushErrors(errs, "Error pushing push")
 		} else if len(mr.Msg) > 0 {
 			switch mr.Msg["type"] {
 			case "chat":
 				for i := 0; i < retry; i++ {
 					log.Printf("Attempt #%v for %v\n", i, mr.Msg["id"])
-					k, msgid, err = messageTransaction(ctx, mr)
+					k, msgid, err = s.messageTransaction(ctx, mr)
 					if err == errorMessageAlreadyExists {
 						if i == retry-1 {
-							onDone(fmt.Errorf("Chat error: %v\n", rtrErr))
-						} else {
-							// set it to null and try again via looping
-							err = nil
-							continue
+							return nil, conflict("chat error", rtrErr)
 						}
+						// try again via looping
+						continue
 					} else if err != nil {
-						// this is a fatal error
-						onDone(fmt.Errorf("Message error: %v\n", err))
-					} else {
-						// success
-						if k == 0 {
-							psh = "m" + msgid
-							replays = pushRequest(ctx, mr.Targets, psh)
-							break
-						}
+						return nil, internal(codeWriteFailed, "message error", err)
+					}
+					// success
+					if k == 0 {
+						psh = "m" + msgid
+						replays = s.pushRequest(ctx, mr.Targets, psh)
 					}
+					break
 				}
-				break
 			case "snip":
 				for i := 0; i < retry; i++ {
 					log.Printf("Attempt #%v for %v\n", i, mr.Msg["id"])
-					k, msgid, err = messageTransaction(ctx, mr)
+					k, msgid, err = s.messageTransaction(ctx, mr)
 					if err == errorMessageAlreadyExists {
 						if i == retry-1 {
-							onDone(fmt.Errorf("Snip error: %v\n", rtrErr))
-						} else {
-							// set it to null and try again via looping
-							err = nil
-							continue
+							return nil, conflict("snip error", rtrErr)
 						}
+						// try again via looping
+						continue
 					} else if err != nil {
-						// this is a fatal error
-						onDone(fmt.Errorf("Snip error: %v\n", err))
-
-					} else {
-						// success
-						if k == 0 {
-							psh = "m" + msgid
-							replays = pushRequest(ctx, mr.Targets, psh)
-							break
-						}
+						return nil, internal(codeWriteFailed, "snip error", err)
+					}
+					// success
+					if k == 0 {
+						psh = "m" + msgid
+						replays = s.pushRequest(ctx, mr.Targets, psh)
 					}
+					break
 				}
-				break
 			case "reaction":
 				for i := 0; i < retry; i++ {
-					err = reactionTransaction(ctx, mr)
+					err = s.reactionTransaction(ctx, mr)
 					if err == chatUpdateError {
 						if i == retry-1 {
-							onDone(fmt.Errorf("React error: %v\n", rtrErr))
-						} else {
-							err = nil
-							continue
+							return nil, conflict("react error", rtrErr)
 						}
+						continue
 					} else if err != nil {
-						onDone(fmt.Errorf("Reaction error: %v\n", err))
-						return
-					} else {
-						// success
-						break
+						return nil, internal(codeWriteFailed, "reaction error", err)
 					}
+					// success
+					break
 				}
-				break
 			case "increment":
-				reactionIncrement(ctx, mr)
-				break
+				if err = s.reactionIncrement(ctx, mr); err != nil {
+					return nil, internal(codeWriteFailed, "increment error", err)
+				}
 			}
 		}
 
 		if len(mr.Header) > 0 {
 			ntfs := mr.makeNotifications(replays)
-			br, err := Client.Messager.SendEach(ctx, ntfs)
-			NonFatal(err, "Error sending notifications")
-			for _, x := range br.Responses {
-				NonFatal(x.Error, "Error sending a notification")
+			br, err := s.Messager.SendEach(ctx, ntfs)
+			if err != nil {
+				NonFatal(err, "Error sending notifications")
+			} else {
+				for _, x := range br.Responses {
+					NonFatal(x.Error, "Error sending a notification")
+				}
 			}
 		}
 
@@ -417,8 +503,8 @@ func ProcessMessage(w http.ResponseWriter, r *http.Request) {
 			prs = append(prs, &PushRes{Push: psh, Replays: replays})
 		}
 	}
-	
-	onDone(nil)
+
+	return prs, nil
 }
 
 // func handlePush(ctx context.Context, doPush bool, q *MessageRequest, mt MessageTarget, ec chan *error, ac chan bool, mc chan *messaging.Message, rootID, senderID, push string) {
@@ -0,0 +1,121 @@
+package backend
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcutil/base58"
+)
+
+// Network is the BSV network a deployment runs on, staging is on testnet
+// and production on mainnet, addresses and providers of one are refused on
+// the other
+type Network string
+
+const (
+	Mainnet Network = "mainnet"
+	Testnet Network = "testnet"
+
+	// what deployments without a network setting have always run on
+	defaultNetwork = Testnet
+)
+
+type networkParams struct {
+	pubKeyHashAddrID byte
+	scriptHashAddrID byte
+	whatsOnChainURL  string
+	arcURL           string
+	fees             FeePolicy
+}
+
+// nodes relay at 1 sat/kB and take outputs down to 1 sat
+var defaultFees = FeePolicy{SatsPerKB: 1, Dust: 1}
+
+var networks = map[Network]networkParams{
+	Mainnet: {
+		pubKeyHashAddrID: 0x00,
+		scriptHashAddrID: 0x05,
+		whatsOnChainURL:  "https://api.whatsonchain.com/v1/bsv/main",
+		arcURL:           "https://arc.taal.com",
+		fees:             defaultFees,
+	},
+	Testnet: {
+		pubKeyHashAddrID: 0x6f,
+		scriptHashAddrID: 0xc4,
+		whatsOnChainURL:  "https://api.whatsonchain.com/v1/bsv/test",
+		arcURL:           "https://arc-test.taal.com",
+		fees:             defaultFees,
+	},
+}
+
+func (n Network) Validate() error {
+	if _, ok := networks[n]; !ok {
+		return fmt.Errorf("unknown network %q", n)
+	}
+	return nil
+}
+
+// params panics on an unknown network, configs are validated way before
+func (n Network) params() networkParams {
+	p, ok := networks[n]
+	if !ok {
+		panic(fmt.Sprintf("unknown network %q", n))
+	}
+	return p
+}
+
+func (n Network) WhatsOnChainURL() string {
+	return n.params().whatsOnChainURL
+}
+
+func (n Network) ARCURL() string {
+	return n.params().arcURL
+}
+
+// FeePolicy is what the nodes of the network relay, see Config.FeePolicy
+func (n Network) FeePolicy() FeePolicy {
+	return n.params().fees
+}
+
+// networkOf finds which network an address version byte belongs to
+func networkOf(version byte) (Network, bool) {
+	for net, p := range networks {
+		if p.pubKeyHashAddrID == version || p.scriptHashAddrID == version {
+			return net, true
+		}
+	}
+	return "", false
+}
+
+// EncodeAddress is the base58check p2pkh address of pkh
+func (n Network) EncodeAddress(pkh []byte) string {
+	return base58.CheckEncode(pkh, n.params().pubKeyHashAddrID)
+}
+
+// DecodeAddress gives the pubkey hash of a p2pkh address of the network.
+// Older clients send the bare pubkey hash as base64, they only ran on
+// testnet, the default network, so it is refused on any other
+func (n Network) DecodeAddress(addr string) ([]byte, error) {
+	pkh, version, err := base58.CheckDecode(addr)
+	if err != nil {
+		if legacy, lerr := base64.StdEncoding.DecodeString(addr); lerr == nil && len(legacy) == 20 {
+			if n != defaultNetwork {
+				return nil, fmt.Errorf("bare pubkey hash %s is for %s, we are on %s", addr, defaultNetwork, n)
+			}
+			return legacy, nil
+		}
+		return nil, fmt.Errorf("invalid address %s: %v", addr, err)
+	}
+	p := n.params()
+	switch {
+	case version == p.pubKeyHashAddrID && len(pkh) == 20:
+		return pkh, nil
+	case version == p.scriptHashAddrID:
+		return nil, errors.New("p2sh addresses are not supported")
+	}
+	if other, ok := networkOf(version); ok && other != n {
+		return nil, fmt.Errorf("address %s is for %s, we are on %s", addr, other, n)
+	}
+	return nil, fmt.Errorf("invalid address %s: unknown version %02x", addr, version)
+}
@@ -0,0 +1,74 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestDecodeAddress(t *testing.T) {
+	pkh := RandomBytes(20)
+	for _, net := range []Network{Mainnet, Testnet} {
+		got, err := net.DecodeAddress(net.EncodeAddress(pkh))
+		if err != nil || !bytes.Equal(got, pkh) {
+			t.Fatalf("%s: unexpected pkh %x: %v\n", net, got, err)
+		}
+	}
+	// the change address of older clients, on deployments without a network
+	legacy := testBoostRequest().ChangeAddress
+	want, _ := base64.StdEncoding.DecodeString(legacy)
+	if got, err := defaultNetwork.DecodeAddress(legacy); err != nil || len(got) != 20 || !bytes.Equal(got, want) {
+		t.Fatalf("unexpected legacy pkh %x: %v\n", got, err)
+	}
+	if _, err := Mainnet.DecodeAddress(legacy); err == nil || !strings.Contains(err.Error(), "testnet") {
+		t.Fatalf("expected a bare pubkey hash to be refused on mainnet, got %v\n", err)
+	}
+
+	// 1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa is the genesis block address
+	if _, err := Testnet.DecodeAddress("1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa"); err == nil || !strings.Contains(err.Error(), "mainnet") {
+		t.Fatalf("expected a mainnet address to be refused on testnet, got %v\n", err)
+	}
+	if _, err := Mainnet.DecodeAddress(Testnet.EncodeAddress(pkh)); err == nil || !strings.Contains(err.Error(), "testnet") {
+		t.Fatalf("expected a testnet address to be refused on mainnet, got %v\n", err)
+	}
+
+	addr, last := Mainnet.EncodeAddress(pkh), "1"
+	if strings.HasSuffix(addr, last) {
+		last = "2"
+	}
+	invalids := map[string]string{
+		"bad checksum": addr[:len(addr)-1] + last,
+		"p2sh":         "3J98t1WpEZ73CNmQviecrnyiWrnqRhWNLy",
+		"short pkh":    base64.StdEncoding.EncodeToString(pkh[:19]),
+		"empty":        "",
+	}
+	for name, a := range invalids {
+		if _, err := Mainnet.DecodeAddress(a); err == nil {
+			t.Errorf("%s: expected an error for %q\n", name, a)
+		}
+	}
+}
+
+func TestNetworkConfig(t *testing.T) {
+	cfg, err := ParseConfig(defaultConfig)
+	if err != nil {
+		t.Fatalf("error parsing default config: %v\n", err)
+	}
+	if cfg.Net() != Testnet {
+		t.Fatalf("expected %s by default, got %s\n", Testnet, cfg.Net())
+	}
+	if s := NewMemoryServer(cfg); s.Network != Testnet {
+		t.Fatalf("expected a %s server, got %s\n", Testnet, s.Network)
+	}
+
+	cfg.Network = "regtest"
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected an error for an unknown network")
+	}
+	cfg.Network = Mainnet
+	cfg.Broadcast.Providers = []ProviderConfig{{Kind: "whatsonchain", URL: Testnet.WhatsOnChainURL() + "/"}}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected an error for a testnet provider on mainnet")
+	}
+}
@@ -1,41 +1,14 @@
 package backend
 
-import (
-	"bytes"
-	"encoding/binary"
-)
-
-func op_push_data(data []byte) []byte {
-	l := len(data)
-	var psh []byte
-	var err error
-	if l >= 1 && l <= 75 {
-		psh = append([]byte{byte(l)}, data...)
-	} else if l >= 76 && l <= 255 {
-		psh = append([]byte{0x4c, byte(l)}, data...)
-	} else if l >= 256 && l <= 65535 {
-		buf := new(bytes.Buffer)
-		err = binary.Write(buf, binary.LittleEndian, uint16(l))
-		psh = append([]byte{0x4d}, append(buf.Bytes(), data...)...)
-	} else if l >= 65536 && l <= 4294967295 {
-		buf := new(bytes.Buffer)
-		err = binary.Write(buf, binary.LittleEndian, uint32(l))
-		psh = append([]byte{0x4d}, append(buf.Bytes(), data...)...)
-	} else {
-		panic("invalid datalen for push")
-	}
-
-	if err != nil {
-		panic("error writing binary to buffer")
-	}
-
-	return psh
-}
-
 const (
 	op_false                  = byte(0x00)
+	op_pushdata1              = byte(0x4c)
+	op_pushdata2              = byte(0x4d)
+	op_pushdata4              = byte(0x4e)
 	op_one_negate             = byte(0x4f)
+	op_reserved               = byte(0x50)
 	op_true                   = byte(0x51)
+	op_16                     = byte(0x60)
 	op_nop                    = byte(0x61)
 	op_if                     = byte(0x63)
 	op_notif                  = byte(0x64)
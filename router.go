@@ -0,0 +1,109 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+const (
+	DefaultMaxBodyBytes = 32 << 20 // boosts carry their media as base64
+	healthTimeout       = 5 * time.Second
+)
+
+// Handler mounts every endpoint, bodies over maxBody bytes are refused and
+// everything but /healthz and the ARC callbacks needs an id token, see
+// RequireAuth
+func (s *Server) Handler(maxBody int64) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/nodes", post(maxBody, RequireAuth(s.Verifier, s.GetNodes)))
+	mux.Handle("/messages", post(maxBody, RequireAuth(s.Verifier, s.ProcessMessage)))
+	mux.Handle("/boost", post(maxBody, RequireAuth(s.Verifier, s.HandleBoostRequest)))
+	mux.Handle("/boost/fee", post(maxBody, RequireAuth(s.Verifier, s.HandleBoostFee)))
+	mux.Handle("/boost/dryrun", post(maxBody, RequireAuth(s.Verifier, s.HandleBoostDryRun)))
+	mux.Handle("/boost/claim", post(maxBody, RequireAuth(s.Verifier, s.HandleClaimBoost)))
+	mux.Handle("/campaigns", post(maxBody, RequireAuth(s.Verifier, s.HandleListCampaigns)))
+	mux.Handle("/campaigns/inspect", post(maxBody, RequireAuth(s.Verifier, s.HandleInspectCampaign)))
+	mux.Handle("/location", post(maxBody, RequireAuth(s.Verifier, s.HandleUpdateLocation)))
+	mux.Handle("/broadcast/callback", post(maxBody, s.HandleBroadcastCallback))
+	mux.HandleFunc("/healthz", s.Healthz)
+	return mux
+}
+
+func post(maxBody int64, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			WriteError(w, &Error{Status: http.StatusMethodNotAllowed, Code: codeBadMethod, Message: r.Method + " not allowed"})
+			return
+		}
+		if maxBody > 0 {
+			if r.ContentLength > maxBody {
+				WriteError(w, bodyError(codeBodyTooLarge, "request body too large", &http.MaxBytesError{Limit: maxBody}))
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+		}
+		h(w, r)
+	}
+}
+
+type health struct {
+	Status string            `json:"status"`
+	Shards map[string]string `json:"shards"`
+}
+
+// Healthz reaches every realtime db and bucket, a missing object still
+// means the bucket answered
+func (s *Server) Healthz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthTimeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	h := &health{Status: "ok", Shards: map[string]string{}}
+	for reg, shards := range s.Shards {
+		for i, shrd := range shards {
+			wg.Add(1)
+			go func(name string, shrd ServerShard) {
+				defer wg.Done()
+				status := "ok"
+				if err := checkShard(ctx, shrd); err != nil {
+					status = err.Error()
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				h.Shards[name] = status
+				if status != "ok" {
+					h.Status = "degraded"
+				}
+			}(reg+"-"+strconv.Itoa(i), shrd)
+		}
+	}
+	wg.Wait()
+
+	if h.Status != "ok" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJson(w, h)
+}
+
+func checkShard(ctx context.Context, shrd ServerShard) error {
+	var v interface{}
+	if err := shrd.RealtimeDB.NewRef("healthz").Get(ctx, &v); err != nil {
+		return err
+	}
+	for _, b := range []ObjectStore{shrd.TempBucket, shrd.StaticBucket} {
+		_, err := b.Attrs(ctx, "healthz")
+		if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			return err
+		}
+	}
+	return nil
+}
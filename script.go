@@ -0,0 +1,333 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// ScriptBuilder appends ops and minimal pushes to a script, the first
+// error sticks and every later call is a no-op, Script returns it
+type ScriptBuilder struct {
+	buf bytes.Buffer
+	err error
+}
+
+func NewScriptBuilder() *ScriptBuilder {
+	return &ScriptBuilder{}
+}
+
+func (b *ScriptBuilder) AddOp(ops ...byte) *ScriptBuilder {
+	if b.err == nil {
+		b.buf.Write(ops)
+	}
+	return b
+}
+
+// AddData pushes data with the smallest encoding a node accepts
+func (b *ScriptBuilder) AddData(data []byte) *ScriptBuilder {
+	if b.err != nil {
+		return b
+	}
+	psh, err := pushData(data)
+	if err != nil {
+		b.err = err
+		return b
+	}
+	b.buf.Write(psh)
+	return b
+}
+
+// AddInt64 pushes n as a script number, OP_1NEGATE and OP_0..16 included
+func (b *ScriptBuilder) AddInt64(n int64) *ScriptBuilder {
+	return b.AddData(scriptNum(n))
+}
+
+func (b *ScriptBuilder) Script() ([]byte, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	return bytes.Clone(b.buf.Bytes()), nil
+}
+
+func (b *ScriptBuilder) Reset() *ScriptBuilder {
+	b.buf.Reset()
+	b.err = nil
+	return b
+}
+
+// pushData is the minimal push of data
+// 0 bytes              -> OP_0
+// 1 byte of 1..16      -> OP_1..OP_16
+// 1 byte of 0x81 (-1)  -> OP_1NEGATE
+// 1..75 bytes          -> len + data
+// 76..255 bytes        -> OP_PUSHDATA1 + uint8 len + data
+// 256..65535 bytes     -> OP_PUSHDATA2 + LE uint16 len + data
+// up to 4294967295     -> OP_PUSHDATA4 + LE uint32 len + data
+func pushData(data []byte) ([]byte, error) {
+	l := len(data)
+	switch {
+	case l == 0:
+		return []byte{op_false}, nil
+	case l == 1 && data[0] >= 1 && data[0] <= 16:
+		return []byte{op_true - 1 + data[0]}, nil
+	case l == 1 && data[0] == 0x81:
+		return []byte{op_one_negate}, nil
+	case l < int(op_pushdata1):
+		return append([]byte{byte(l)}, data...), nil
+	case l <= math.MaxUint8:
+		return append([]byte{op_pushdata1, byte(l)}, data...), nil
+	case l <= math.MaxUint16:
+		psh := binary.LittleEndian.AppendUint16([]byte{op_pushdata2}, uint16(l))
+		return append(psh, data...), nil
+	case uint64(l) <= math.MaxUint32:
+		psh := binary.LittleEndian.AppendUint32([]byte{op_pushdata4}, uint32(l))
+		return append(psh, data...), nil
+	default:
+		return nil, fmt.Errorf("invalid datalen for push: %d", l)
+	}
+}
+
+// scriptNum is the minimal little endian sign-magnitude encoding of n
+func scriptNum(n int64) []byte {
+	if n == 0 {
+		return nil
+	}
+	neg := n < 0
+	abs := uint64(n)
+	if neg {
+		abs = uint64(-n)
+	}
+	var num []byte
+	for ; abs > 0; abs >>= 8 {
+		num = append(num, byte(abs))
+	}
+	if num[len(num)-1]&0x80 != 0 {
+		num = append(num, 0)
+	}
+	if neg {
+		num[len(num)-1] |= 0x80
+	}
+	return num
+}
+
+// Chunk is one op of a script, pushes keep the op they were encoded with
+// (a length, OP_PUSHDATA1/2/4) so Bytes gives back the exact script
+type Chunk struct {
+	Op   byte
+	Data []byte
+}
+
+type Script []Chunk
+
+var opNames = func() map[byte]string {
+	names := map[byte]string{
+		op_false:                  "0",
+		op_pushdata1:              "OP_PUSHDATA1",
+		op_pushdata2:              "OP_PUSHDATA2",
+		op_pushdata4:              "OP_PUSHDATA4",
+		op_one_negate:             "-1",
+		op_reserved:               "OP_RESERVED",
+		op_nop:                    "OP_NOP",
+		op_if:                     "OP_IF",
+		op_notif:                  "OP_NOTIF",
+		op_else:                   "OP_ELSE",
+		op_endif:                  "OP_ENDIF",
+		op_verify:                 "OP_VERIFY",
+		op_return:                 "OP_RETURN",
+		op_to_alt_stack:           "OP_TOALTSTACK",
+		op_from_alt_stack:         "OP_FROMALTSTACK",
+		op_drop2:                  "OP_2DROP",
+		op_dup2:                   "OP_2DUP",
+		op_dup3:                   "OP_3DUP",
+		op_over2:                  "OP_2OVER",
+		op_rot2:                   "OP_2ROT",
+		op_swap2:                  "OP_2SWAP",
+		op_ifdup:                  "OP_IFDUP",
+		op_depth:                  "OP_DEPTH",
+		op_drop:                   "OP_DROP",
+		op_dup:                    "OP_DUP",
+		op_nip:                    "OP_NIP",
+		op_over:                   "OP_OVER",
+		op_pick:                   "OP_PICK",
+		op_roll:                   "OP_ROLL",
+		op_rot:                    "OP_ROT",
+		op_swap:                   "OP_SWAP",
+		op_tuck:                   "OP_TUCK",
+		op_cat:                    "OP_CAT",
+		op_split:                  "OP_SPLIT",
+		op_num2bin:                "OP_NUM2BIN",
+		op_bin2num:                "OP_BIN2NUM",
+		op_size:                   "OP_SIZE",
+		op_invert:                 "OP_INVERT",
+		op_and:                    "OP_AND",
+		op_or:                     "OP_OR",
+		op_xor:                    "OP_XOR",
+		op_equal:                  "OP_EQUAL",
+		op_equal_verify:           "OP_EQUALVERIFY",
+		op_add1:                   "OP_1ADD",
+		op_sub1:                   "OP_1SUB",
+		op_negate:                 "OP_NEGATE",
+		op_abs:                    "OP_ABS",
+		op_not:                    "OP_NOT",
+		op_zero_notequal:          "OP_0NOTEQUAL",
+		op_add:                    "OP_ADD",
+		op_sub:                    "OP_SUB",
+		op_mul:                    "OP_MUL",
+		op_div:                    "OP_DIV",
+		op_mod:                    "OP_MOD",
+		op_lshift:                 "OP_LSHIFT",
+		op_rshift:                 "OP_RSHIFT",
+		op_bool_and:               "OP_BOOLAND",
+		op_bool_or:                "OP_BOOLOR",
+		op_num_equal:              "OP_NUMEQUAL",
+		op_num_equal_verify:       "OP_NUMEQUALVERIFY",
+		op_num_not_equal:          "OP_NUMNOTEQUAL",
+		op_less_than:              "OP_LESSTHAN",
+		op_greater_than:           "OP_GREATERTHAN",
+		op_less_than_or_equal:     "OP_LESSTHANOREQUAL",
+		op_greater_than_or_equal:  "OP_GREATERTHANOREQUAL",
+		op_min:                    "OP_MIN",
+		op_max:                    "OP_MAX",
+		op_within:                 "OP_WITHIN",
+		op_ripemd160:              "OP_RIPEMD160",
+		op_sha1:                   "OP_SHA1",
+		op_sha256:                 "OP_SHA256",
+		op_hash160:                "OP_HASH160",
+		op_hash256:                "OP_HASH256",
+		op_code_separator:         "OP_CODESEPARATOR",
+		op_check_sig:              "OP_CHECKSIG",
+		op_check_sig_verify:       "OP_CHECKSIGVERIFY",
+		op_check_multi_sig:        "OP_CHECKMULTISIG",
+		op_check_multi_sig_verify: "OP_CHECKMULTISIGVERIFY",
+	}
+	for op := op_true; op <= op_16; op++ {
+		names[op] = fmt.Sprintf("OP_%d", op-op_true+1)
+	}
+	return names
+}()
+
+var opCodes = func() map[string]byte {
+	codes := make(map[string]byte, len(opNames)+3)
+	for op, name := range opNames {
+		codes[name] = op
+	}
+	codes["OP_0"], codes["OP_FALSE"], codes["OP_TRUE"], codes["OP_1NEGATE"] = op_false, op_false, op_true, op_one_negate
+	return codes
+}()
+
+func opName(op byte) string {
+	if name, ok := opNames[op]; ok {
+		return name
+	}
+	return fmt.Sprintf("OP_UNKNOWN_%02x", op)
+}
+
+// ParseScript splits a raw script in chunks, a push running past the end
+// of the script is an error
+func ParseScript(b []byte) (Script, error) {
+	var sc Script
+	for i := 0; i < len(b); {
+		op := b[i]
+		i++
+		var n int
+		switch {
+		case op > 0 && op < op_pushdata1:
+			n = int(op)
+		case op == op_pushdata1 && i+1 <= len(b):
+			n, i = int(b[i]), i+1
+		case op == op_pushdata2 && i+2 <= len(b):
+			n, i = int(binary.LittleEndian.Uint16(b[i:])), i+2
+		case op == op_pushdata4 && i+4 <= len(b):
+			n, i = int(binary.LittleEndian.Uint32(b[i:])), i+4
+		case op >= op_pushdata1 && op <= op_pushdata4:
+			return nil, fmt.Errorf("truncated %s length at byte %d", opName(op), i-1)
+		default:
+			sc = append(sc, Chunk{Op: op})
+			continue
+		}
+		if n < 0 || n > len(b)-i {
+			return nil, fmt.Errorf("push of %d bytes at byte %d runs past the script", n, i)
+		}
+		sc = append(sc, Chunk{Op: op, Data: b[i : i+n]})
+		i += n
+	}
+	return sc, nil
+}
+
+func (c Chunk) isPush() bool {
+	return c.Op > op_false && c.Op <= op_pushdata4
+}
+
+// Bytes serializes the chunks back with the push ops they were parsed with
+func (s Script) Bytes() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	for _, c := range s {
+		buf.WriteByte(c.Op)
+		if !c.isPush() {
+			continue
+		}
+		l := len(c.Data)
+		switch {
+		case c.Op < op_pushdata1 && l == int(c.Op):
+		case c.Op == op_pushdata1 && l <= math.MaxUint8:
+			buf.WriteByte(byte(l))
+		case c.Op == op_pushdata2 && l <= math.MaxUint16:
+			binary.Write(buf, binary.LittleEndian, uint16(l))
+		case c.Op == op_pushdata4 && uint64(l) <= math.MaxUint32:
+			binary.Write(buf, binary.LittleEndian, uint32(l))
+		default:
+			return nil, fmt.Errorf("%d bytes don't fit a %s push", l, opName(c.Op))
+		}
+		buf.Write(c.Data)
+	}
+	return buf.Bytes(), nil
+}
+
+// String is the ASM of the script, pushes are hex, OP_0 and OP_1NEGATE
+// are 0 and -1 and everything else is its OP_ name
+func (s Script) String() string {
+	asm := make([]string, len(s))
+	for i, c := range s {
+		if c.isPush() {
+			asm[i] = hex.EncodeToString(c.Data)
+		} else {
+			asm[i] = opName(c.Op)
+		}
+	}
+	return strings.Join(asm, " ")
+}
+
+// Assemble is the reverse of Script.String, pushes are re-encoded minimally
+// so only minimal scripts round trip byte for byte
+func Assemble(asm string) ([]byte, error) {
+	sb := NewScriptBuilder()
+	for _, tok := range strings.Fields(asm) {
+		if op, ok := opCodes[tok]; ok {
+			sb.AddOp(op)
+		} else if u, ok := strings.CutPrefix(tok, "OP_UNKNOWN_"); ok {
+			op, err := hex.DecodeString(u)
+			if err != nil || len(op) != 1 {
+				return nil, fmt.Errorf("invalid opcode %s", tok)
+			}
+			sb.AddOp(op[0])
+		} else if data, err := hex.DecodeString(tok); err == nil {
+			sb.AddData(data)
+		} else {
+			return nil, fmt.Errorf("invalid asm token %q", tok)
+		}
+	}
+	return sb.Script()
+}
+
+// scriptAsm is for logs, scripts that don't parse are printed as hex
+func scriptAsm(b []byte) string {
+	sc, err := ParseScript(b)
+	if err != nil {
+		return hex.EncodeToString(b)
+	}
+	return sc.String()
+}
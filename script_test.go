@@ -0,0 +1,150 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestPushData(t *testing.T) {
+	cases := []struct {
+		size   int
+		fill   byte
+		header string
+	}{
+		{0, 0, "00"},
+		{1, 0, "01"},
+		{1, 1, "51"},
+		{1, 16, "60"},
+		{1, 17, "01"},
+		{1, 0x81, "4f"},
+		{2, 1, "02"},
+		{75, 0xaa, "4b"},
+		{76, 0xaa, "4c4c"},
+		{255, 0xaa, "4cff"},
+		{256, 0xaa, "4d0001"},
+		{65535, 0xaa, "4dffff"},
+		{65536, 0xaa, "4e00000100"},
+	}
+	for _, c := range cases {
+		data := bytes.Repeat([]byte{c.fill}, c.size)
+		psh, err := pushData(data)
+		if err != nil {
+			t.Fatalf("%d bytes of %x: %v\n", c.size, c.fill, err)
+		}
+		header, _ := hex.DecodeString(c.header)
+		small := len(psh) == 1 && c.size <= 1
+		if !bytes.HasPrefix(psh, header) || (!small && !bytes.Equal(psh[len(header):], data)) {
+			t.Errorf("%d bytes of %x: expected header %s, got %x\n", c.size, c.fill, c.header, psh[:min(len(psh), 5)])
+		}
+	}
+}
+
+func TestScriptBuilder(t *testing.T) {
+	pkh := bytes.Repeat([]byte{0x11}, 20)
+	sc, err := p2pkh(pkh)
+	if err != nil {
+		t.Fatalf("error building p2pkh: %v\n", err)
+	}
+	if hex.EncodeToString(sc) != "76a914"+hex.EncodeToString(pkh)+"88ac" {
+		t.Fatalf("unexpected p2pkh: %x\n", sc)
+	}
+	if _, err := p2pkh(pkh[:19]); err == nil {
+		t.Fatal("expected an error for a short pubkey hash")
+	}
+
+	nums := map[int64]string{0: "00", 1: "51", 16: "60", -1: "4f", 17: "0111", 127: "017f",
+		128: "028000", 255: "02ff00", -255: "02ff80", 1 << 16: "03000001"}
+	for n, want := range nums {
+		sc, err := NewScriptBuilder().AddInt64(n).Script()
+		if err != nil || hex.EncodeToString(sc) != want {
+			t.Errorf("%d: expected %s, got %x: %v\n", n, want, sc, err)
+		}
+	}
+}
+
+func TestScriptAsm(t *testing.T) {
+	br := testBoostRequest()
+	tx, _ := ParseTx(testPartialTx(t))
+	s1, _ := base64.StdEncoding.DecodeString(br.S1)
+	addr, _ := Testnet.DecodeAddress(br.ChangeAddress)
+	tx, err := BoostScript(tx, s1, 2, 100, br.InputSats, addr, defaultFees)
+	if err != nil {
+		t.Fatalf("error building boost tx: %v\n", err)
+	}
+
+	// s3 = sha1(sha1(s1 || BE uint32 i))
+	s3 := func(i uint32) string {
+		return hex.EncodeToString(sha1Of(sha1Of(binary.BigEndian.AppendUint32(bytes.Clone(s1), i))))
+	}
+	asms := []string{
+		"OP_SHA1 " + s3(0) + " OP_EQUAL",
+		"OP_SHA1 " + s3(1) + " OP_EQUAL",
+		"OP_DUP OP_HASH160 " + hex.EncodeToString(addr) + " OP_EQUALVERIFY OP_CHECKSIG",
+	}
+	for i, tout := range tx.txouts {
+		sc, err := ParseScript(tout.script)
+		if err != nil {
+			t.Fatalf("error parsing output %d: %v\n", i, err)
+		}
+		if sc.String() != asms[i] {
+			t.Errorf("output %d: expected %s, got %s\n", i, asms[i], sc)
+		}
+		raw, err := Assemble(asms[i])
+		if err != nil || !bytes.Equal(raw, tout.script) {
+			t.Errorf("output %d: assembled %x, expected %x: %v\n", i, raw, tout.script, err)
+		}
+	}
+
+	// the partial tx input is a signature and a pubkey
+	sc, err := ParseScript(tx.txins[0].script)
+	if err != nil || len(sc) != 2 || len(sc[0].Data) != 72 || len(sc[1].Data) != 33 {
+		t.Fatalf("unexpected unlocking script %s: %v\n", sc, err)
+	}
+	if !strings.Contains(tx.Formatted(), "script="+sc.String()) {
+		t.Fatalf("expected asm in formatted tx\n%s", tx.Formatted())
+	}
+
+	asm := "0 -1 OP_1 OP_16 OP_IF OP_RETURN OP_ENDIF OP_UNKNOWN_ba " + strings.Repeat("ab", 80)
+	raw, err := Assemble(asm)
+	if err != nil {
+		t.Fatalf("error assembling: %v\n", err)
+	}
+	if sc, err := ParseScript(raw); err != nil || sc.String() != asm {
+		t.Fatalf("expected %s, got %s: %v\n", asm, sc, err)
+	}
+	for _, bad := range []string{"OP_NOPE", "abc", "0x00"} {
+		if _, err := Assemble(bad); err == nil {
+			t.Errorf("%s: expected an error\n", bad)
+		}
+	}
+}
+
+func TestParseScript(t *testing.T) {
+	// non minimal pushes are kept as they are
+	for _, h := range []string{"4c0101", "4d0100ff", "4e01000000ff", "0000", "ab"} {
+		raw, _ := hex.DecodeString(h)
+		sc, err := ParseScript(raw)
+		if err != nil {
+			t.Fatalf("%s: %v\n", h, err)
+		}
+		if b, err := sc.Bytes(); err != nil || !bytes.Equal(b, raw) {
+			t.Errorf("%s: round tripped to %x: %v\n", h, b, err)
+		}
+	}
+	for _, h := range []string{"01", "4c", "4c02ff", "4d01", "4dffff00", "4e010000"} {
+		raw, _ := hex.DecodeString(h)
+		if _, err := ParseScript(raw); err == nil {
+			t.Errorf("%s: expected an error\n", h)
+		}
+	}
+}
+
+func sha1Of(b []byte) []byte {
+	h := sha1.Sum(b)
+	return h[:]
+}
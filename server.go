@@ -2,61 +2,90 @@ package backend
 
 import (
 	"context"
-	"os"
-	"time"
-
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
+	"sync"
+	"time"
 
-	"cloud.google.com/go/firestore"
 	"cloud.google.com/go/storage"
 	firebase "firebase.google.com/go/v4"
-	"firebase.google.com/go/v4/db"
-	"firebase.google.com/go/v4/messaging"
 	"google.golang.org/api/option"
 )
 
 type ServerShard struct {
-	RealtimeDB   *db.Client
-	TempBucket   *storage.BucketHandle
-	StaticBucket *storage.BucketHandle
+	RealtimeDB   RealtimeDB
+	TempBucket   ObjectStore
+	StaticBucket ObjectStore
 }
 
-const (
-	N_SHARD  = 2
-	N_REGION = 3
-)
-
-type server struct {
-	Shards     map[string]([N_SHARD]ServerShard)
-	Messager   *messaging.Client
-	Firestore  *firestore.Client
-	SignedOpts *storage.SignedURLOptions
+// Server owns every client the handlers need, build one with NewServer,
+// or NewMemoryServer for tests and local runs
+type Server struct {
+	Shards        map[string][]ServerShard
+	Messager      Messenger
+	Firestore     DocumentStore
+	SignedOpts    *storage.SignedURLOptions
+	Network       Network
+	Fees          FeePolicy
+	BoostTTL      time.Duration
+	Broadcaster   Broadcaster
+	CallbackToken string
+	Verifier      TokenVerifier
+	UTXOs         UTXOSource
 }
 
-var Client *server
-
+func NewServer(ctx context.Context, cfg *Config) (*Server, error) {
+	if cfg == nil {
+		return nil, errors.New("error initializing server: nil config")
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
 
-func ServerInit(ctx context.Context) {
-	servAcc := os.Getenv("FIREBASE_CONFIG")
-	opt := option.WithCredentialsFile(servAcc)
-	app, err := firebase.NewApp(ctx, nil, opt)
+	var opts []option.ClientOption
+	if len(cfg.CredentialsFile) > 0 {
+		opts = append(opts, option.WithCredentialsFile(cfg.CredentialsFile))
+	}
+	app, err := firebase.NewApp(ctx, nil, opts...)
 	if err != nil {
-		log.Fatalf("error initializing app: %v\n", err)
+		return nil, fmt.Errorf("error initializing app: %v", err)
 	}
 
 	msgr, err := app.Messaging(ctx)
 	if err != nil {
-		log.Fatalf("error initializing messager: %v\n", err)
+		return nil, fmt.Errorf("error initializing messager: %v", err)
 	}
 
 	fs, err := app.Firestore(ctx)
 	if err != nil {
-		log.Fatalf("error initializing db: %v\n", err)
+		return nil, fmt.Errorf("error initializing db: %v", err)
 	}
 
 	stor, err := app.Storage(ctx)
 	if err != nil {
-		log.Fatalf("error initializing storage: %v\n", err)
+		return nil, fmt.Errorf("error initializing storage: %v", err)
+	}
+
+	var verifier TokenVerifier
+	if ks, err := cfg.Auth.KeySet(); err != nil {
+		return nil, err
+	} else if ks != nil {
+		verifier = ks
+	} else {
+		ac, err := app.Auth(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error initializing auth: %v", err)
+		}
+		verifier = firebaseVerifier{ac}
+	}
+
+	var utxos UTXOSource = &WhatsOnChainUTXOs{BaseURL: cfg.Net().WhatsOnChainURL()}
+	if len(cfg.UTXOFile) > 0 {
+		if utxos, err = LoadUTXOFile(cfg.UTXOFile); err != nil {
+			return nil, err
+		}
 	}
 
 	sUrls := &storage.SignedURLOptions{
@@ -64,68 +93,138 @@ func ServerInit(ctx context.Context) {
 		Expires: time.Now().Add(time.Hour * 24 * 4),
 	}
 
-	db_am_1, _ := app.DatabaseWithURL(ctx, "https://down4-26ee1-fd90e-us1.firebaseio.com/")
-	db_am_2, _ := app.DatabaseWithURL(ctx, "https://down4-26ee1-c65d2-us2.firebaseio.com/")
-	db_eu_1, _ := app.DatabaseWithURL(ctx, "https://down4-26ee1-30b1c-eu1.europe-west1.firebasedatabase.app/")
-	db_eu_2, _ := app.DatabaseWithURL(ctx, "https://down4-26ee1-e487b-eu2.europe-west1.firebasedatabase.app/")
-	db_as_1, _ := app.DatabaseWithURL(ctx, "https://down4-26ee1-8511f-sea1.asia-southeast1.firebasedatabase.app/")
-	db_as_2, _ := app.DatabaseWithURL(ctx, "https://down4-26ee1-d98a8-sea2.asia-southeast1.firebasedatabase.app/")
-
-	tmp_am_1, _ := stor.Bucket("down4-26ee1-us1-tmp")
-	tmp_am_2, _ := stor.Bucket("down4-26ee1-us2-tmp")
-	tmp_eu_1, _ := stor.Bucket("down4-26ee1-eu1-tmp")
-	tmp_eu_2, _ := stor.Bucket("down4-26ee1-eu2-tmp")
-	tmp_as_1, _ := stor.Bucket("down4-26ee1-sea1-tmp")
-	tmp_as_2, _ := stor.Bucket("down4-26ee1-sea2-tmp")
-
-	st_am_1, _ := stor.Bucket("down4-26ee1-us1")
-	st_am_2, _ := stor.Bucket("down4-26ee1-us2")
-	st_eu_1, _ := stor.Bucket("down4-26ee1-eu1")
-	st_eu_2, _ := stor.Bucket("down4-26ee1-eu2")
-	st_as_1, _ := stor.Bucket("down4-26ee1-sea1")
-	st_as_2, _ := stor.Bucket("down4-26ee1-sea2")
-
-	Client = &server{
-		SignedOpts: sUrls,
-		Firestore:  fs,
-		Messager:   msgr,
-		Shards: map[string][N_SHARD]ServerShard{
-			"america": {
-				ServerShard{
-					RealtimeDB:   db_am_1,
-					TempBucket:   tmp_am_1,
-					StaticBucket: st_am_1,
-				},
-				ServerShard{
-					RealtimeDB:   db_am_2,
-					TempBucket:   tmp_am_2,
-					StaticBucket: st_am_2,
-				},
-			},
-			"asia": {
-				ServerShard{
-					RealtimeDB:   db_as_1,
-					TempBucket:   tmp_as_1,
-					StaticBucket: st_as_1,
-				},
-				ServerShard{
-					RealtimeDB:   db_as_2,
-					TempBucket:   tmp_as_2,
-					StaticBucket: st_as_2,
-				},
-			},
-			"europe": {
-				ServerShard{
-					RealtimeDB:   db_eu_1,
-					TempBucket:   tmp_eu_1,
-					StaticBucket: st_eu_1,
-				},
-				ServerShard{
-					RealtimeDB:   db_eu_2,
-					TempBucket:   tmp_eu_2,
-					StaticBucket: st_eu_2,
-				},
-			},
-		},
+	shards := make(map[string][]ServerShard, len(cfg.Regions))
+	for reg, scfgs := range cfg.Regions {
+		shards[reg] = make([]ServerShard, len(scfgs))
+		for i, scfg := range scfgs {
+			rtdb, err := app.DatabaseWithURL(ctx, scfg.DatabaseURL)
+			if err != nil {
+				return nil, fmt.Errorf("error initializing db %s[%d]: %v", reg, i, err)
+			}
+			tmp, err := stor.Bucket(scfg.TempBucket)
+			if err != nil {
+				return nil, fmt.Errorf("error initializing temp bucket %s[%d]: %v", reg, i, err)
+			}
+			st, err := stor.Bucket(scfg.StaticBucket)
+			if err != nil {
+				return nil, fmt.Errorf("error initializing static bucket %s[%d]: %v", reg, i, err)
+			}
+			shards[reg][i] = ServerShard{
+				RealtimeDB:   firebaseDB{rtdb},
+				TempBucket:   firebaseBucket{tmp},
+				StaticBucket: firebaseBucket{st},
+			}
+		}
+	}
+
+	return &Server{
+		SignedOpts:    sUrls,
+		Firestore:     firestoreDocs{fs},
+		Messager:      msgr,
+		Shards:        shards,
+		Network:       cfg.Net(),
+		Fees:          cfg.FeePolicy(),
+		BoostTTL:      cfg.BoostTTL(),
+		Broadcaster:   cfg.Broadcast.Broadcaster(cfg.Net()),
+		CallbackToken: cfg.Broadcast.CallbackToken(),
+		Verifier:      verifier,
+		UTXOs:         utxos,
+	}, nil
+}
+
+func (s *Server) ServerShard(c *ComposedId) (ServerShard, error) {
+	shards, ok := s.Shards[c.Region]
+	if !ok || c.Shard < 0 || c.Shard >= len(shards) {
+		return ServerShard{}, fmt.Errorf("no shard %d in region %q", c.Shard, c.Region)
+	}
+	return shards[c.Shard], nil
+}
+
+// Cloud Functions entry points, they share a server built from the
+// environment on first use, see LoadConfig, and all need an id token
+
+var (
+	defaultMu     sync.Mutex
+	defaultServer *Server
+)
+
+func DefaultServer() (*Server, error) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	if defaultServer != nil {
+		return defaultServer, nil
+	}
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	srv, err := NewServer(context.Background(), cfg)
+	if err != nil {
+		return nil, err
+	}
+	defaultServer = srv
+	return srv, nil
+}
+
+func withDefaultServer(h func(*Server, http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		srv, err := DefaultServer()
+		if err != nil {
+			log.Printf("error initializing default server: %v\n", err)
+			http.Error(w, "server unavailable", http.StatusInternalServerError)
+			return
+		}
+		RequireAuth(srv.Verifier, func(w http.ResponseWriter, r *http.Request) {
+			h(srv, w, r)
+		})(w, r)
+	}
+}
+
+func GetNodes(w http.ResponseWriter, r *http.Request) {
+	withDefaultServer((*Server).GetNodes)(w, r)
+}
+
+func ProcessMessage(w http.ResponseWriter, r *http.Request) {
+	withDefaultServer((*Server).ProcessMessage)(w, r)
+}
+
+func HandleBoostRequest(w http.ResponseWriter, r *http.Request) {
+	withDefaultServer((*Server).HandleBoostRequest)(w, r)
+}
+
+func BoostFee(w http.ResponseWriter, r *http.Request) {
+	withDefaultServer((*Server).HandleBoostFee)(w, r)
+}
+
+func BoostDryRun(w http.ResponseWriter, r *http.Request) {
+	withDefaultServer((*Server).HandleBoostDryRun)(w, r)
+}
+
+func ClaimBoost(w http.ResponseWriter, r *http.Request) {
+	withDefaultServer((*Server).HandleClaimBoost)(w, r)
+}
+
+func ListCampaigns(w http.ResponseWriter, r *http.Request) {
+	withDefaultServer((*Server).HandleListCampaigns)(w, r)
+}
+
+func InspectCampaign(w http.ResponseWriter, r *http.Request) {
+	withDefaultServer((*Server).HandleInspectCampaign)(w, r)
+}
+
+func UpdateLocation(w http.ResponseWriter, r *http.Request) {
+	withDefaultServer((*Server).HandleUpdateLocation)(w, r)
+}
+
+// BroadcastCallback has no id token, ARC authenticates with the callback
+// token instead, see HandleBroadcastCallback
+func BroadcastCallback(w http.ResponseWriter, r *http.Request) {
+	srv, err := DefaultServer()
+	if err != nil {
+		log.Printf("error initializing default server: %v\n", err)
+		http.Error(w, "server unavailable", http.StatusInternalServerError)
+		return
 	}
+	srv.HandleBroadcastCallback(w, r)
 }
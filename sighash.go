@@ -0,0 +1,140 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+)
+
+// sig_all..sig_single_anyone_can_pay are these flags with forkid set
+const (
+	sigHashForkID       = byte(0x40)
+	sigHashAnyoneCanPay = byte(0x80)
+	sigHashBaseMask     = byte(0x1f)
+
+	sigHashAll    = sig_all & sigHashBaseMask
+	sigHashNone   = sig_none & sigHashBaseMask
+	sigHashSingle = sig_single & sigHashBaseMask
+)
+
+// SigHashPreimage is what input i signs with hashType, BIP143 like BSV does
+// since the fork. subscript is the locking script of the spent output from
+// its last OP_CODESEPARATOR on, and sats is its amount
+//
+// version | hashPrevouts | hashSequence | outpoint | subscript | sats |
+// sequence | hashOutputs | nLockTime | hashType as uint32, all LITTLE ENDIAN
+func (t *Tx) SigHashPreimage(i int, subscript []byte, sats uint64, hashType byte) ([]byte, error) {
+	if i < 0 || i >= len(t.txins) {
+		return nil, fmt.Errorf("no input %d in a tx of %d inputs", i, len(t.txins))
+	}
+	if hashType&sigHashForkID == 0 {
+		return nil, fmt.Errorf("sighash type %02x is missing forkid", hashType)
+	}
+	base, anyoneCanPay := hashType&sigHashBaseMask, hashType&sigHashAnyoneCanPay != 0
+	if base < sigHashAll || base > sigHashSingle || hashType&^(sigHashBaseMask|sigHashForkID|sigHashAnyoneCanPay) != 0 {
+		return nil, fmt.Errorf("invalid sighash type %02x", hashType)
+	}
+
+	var hashPrevouts, hashSequence, hashOutputs [32]byte
+	if !anyoneCanPay {
+		buf := new(bytes.Buffer)
+		for _, tin := range t.txins {
+			buf.Write(tin.txid)
+			binary.Write(buf, binary.LittleEndian, tin.utxoIndex)
+		}
+		copy(hashPrevouts[:], Txid(buf.Bytes()))
+	}
+	if !anyoneCanPay && base == sigHashAll {
+		buf := new(bytes.Buffer)
+		for _, tin := range t.txins {
+			binary.Write(buf, binary.LittleEndian, tin.sequenceNo)
+		}
+		copy(hashSequence[:], Txid(buf.Bytes()))
+	}
+	if base == sigHashAll {
+		buf := new(bytes.Buffer)
+		for _, tout := range t.txouts {
+			buf.Write(tout.raw())
+		}
+		copy(hashOutputs[:], Txid(buf.Bytes()))
+	} else if base == sigHashSingle && i < len(t.txouts) {
+		copy(hashOutputs[:], Txid(t.txouts[i].raw()))
+	}
+
+	tin, buf := t.txins[i], new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, t.versionNo)
+	buf.Write(hashPrevouts[:])
+	buf.Write(hashSequence[:])
+	buf.Write(tin.txid)
+	binary.Write(buf, binary.LittleEndian, tin.utxoIndex)
+	buf.Write(makeVarInt(uint64(len(subscript))).data)
+	buf.Write(subscript)
+	binary.Write(buf, binary.LittleEndian, sats)
+	binary.Write(buf, binary.LittleEndian, tin.sequenceNo)
+	buf.Write(hashOutputs[:])
+	binary.Write(buf, binary.LittleEndian, t.nLockTime)
+	binary.Write(buf, binary.LittleEndian, uint32(hashType))
+	return buf.Bytes(), nil
+}
+
+// SigHash is the double sha256 of the preimage, what the ECDSA signature is of
+func (t *Tx) SigHash(i int, subscript []byte, sats uint64, hashType byte) ([]byte, error) {
+	preimage, err := t.SigHashPreimage(i, subscript, sats, hashType)
+	if err != nil {
+		return nil, err
+	}
+	return Txid(preimage), nil
+}
+
+// TxSigChecker checks OP_CHECKSIG for input Index of Tx spending Sats.
+// Badly encoded signatures or pubkeys are errors, like STRICTENC
+type TxSigChecker struct {
+	Tx    *Tx
+	Index int
+	Sats  uint64
+}
+
+func (c *TxSigChecker) CheckSig(sig, pubKey, subscript []byte) (bool, error) {
+	if len(sig) < 2 {
+		return false, errors.New("signature too short")
+	}
+	der, hashType := sig[:len(sig)-1], sig[len(sig)-1]
+	signature, err := ecdsa.ParseDERSignature(der)
+	if err != nil {
+		return false, fmt.Errorf("error parsing signature: %v", err)
+	}
+	pub, err := btcec.ParsePubKey(pubKey)
+	if err != nil {
+		return false, fmt.Errorf("error parsing pubkey: %v", err)
+	}
+	hash, err := c.Tx.SigHash(c.Index, subscript, c.Sats, hashType)
+	if err != nil {
+		return false, err
+	}
+	return signature.Verify(hash, pub), nil
+}
+
+// Prevout is the output an input spends
+type Prevout struct {
+	Sats   uint64
+	Script []byte
+}
+
+// VerifyInputs runs the unlocking script of every input against the
+// output it spends, prevouts are in the same order as the inputs
+func (t *Tx) VerifyInputs(prevouts []*Prevout) error {
+	if len(prevouts) != len(t.txins) {
+		return fmt.Errorf("expected %d prevouts, got %d", len(t.txins), len(prevouts))
+	}
+	for i, tin := range t.txins {
+		chk := &TxSigChecker{Tx: t, Index: i, Sats: prevouts[i].Sats}
+		if err := VerifyScript(tin.script, prevouts[i].Script, chk); err != nil {
+			return fmt.Errorf("error verifying input %d: %v", i, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/btcutil"
+)
+
+// signedPartialTx is a one input tx spending sats from the p2pkh of key,
+// signed with hashType
+func signedPartialTx(t testing.TB, key *btcec.PrivateKey, sats uint64, hashType byte) *Tx {
+	tx := &Tx{
+		versionNo: 1,
+		nIns:      makeVarInt(1),
+		nOuts:     makeVarInt(0),
+		txins: []*Txin{{
+			txid:       RandomBytes(32),
+			utxoIndex:  1,
+			scriptLen:  makeVarInt(0),
+			sequenceNo: 0xffffffff,
+		}},
+	}
+	pub := key.PubKey().SerializeCompressed()
+	subscript, _ := p2pkh(btcutil.Hash160(pub))
+	hash, err := tx.SigHash(0, subscript, sats, hashType)
+	if err != nil {
+		t.Fatalf("error computing sighash: %v\n", err)
+	}
+	sig := append(ecdsa.Sign(key, hash).Serialize(), hashType)
+	script, _ := NewScriptBuilder().AddData(sig).AddData(pub).Script()
+	tx.txins[0].script, tx.txins[0].scriptLen = script, makeVarInt(uint64(len(script)))
+	return tx
+}
+
+// p2pkhPrevout rebuilds the p2pkh output of sats an input unlocking with
+// <sig> <pubkey> spends
+func p2pkhPrevout(t testing.TB, tin *Txin, sats uint64) *Prevout {
+	sc, err := ParseScript(tin.script)
+	if err != nil || len(sc) != 2 {
+		t.Fatalf("expected a p2pkh unlocking script, got %x: %v\n", tin.script, err)
+	}
+	script, _ := p2pkh(btcutil.Hash160(sc[1].Data))
+	return &Prevout{Sats: sats, Script: script}
+}
+
+func verifyFunding(t testing.TB, tx *Tx, sats uint64) error {
+	return tx.VerifyInputs([]*Prevout{p2pkhPrevout(t, tx.txins[0], sats)})
+}
+
+func TestSigHash(t *testing.T) {
+	// the partial tx of the test boost request is a real testnet spend
+	// signed with sighash none|forkid
+	tx, err := ParseTx(testPartialTx(t))
+	if err != nil {
+		t.Fatalf("error parsing partial tx: %v\n", err)
+	}
+	if err := verifyFunding(t, tx, 49049); err != nil {
+		t.Fatalf("expected the partial tx to spend 49049 sats, got %v\n", err)
+	}
+	if err := verifyFunding(t, tx, 49048); err == nil {
+		t.Fatal("expected an error claiming another amount")
+	}
+
+	subscript, _ := p2pkh(bytes.Repeat([]byte{1}, 20))
+	for _, ht := range []byte{0x01, 0x02, 0x44, 0x60, 0x41 | 0x20} {
+		if _, err := tx.SigHash(0, subscript, 1, ht); err == nil {
+			t.Errorf("%02x: expected an error\n", ht)
+		}
+	}
+	if _, err := tx.SigHash(1, subscript, 1, sig_all); err == nil {
+		t.Error("expected an error for a missing input")
+	}
+
+	key, _ := btcec.NewPrivateKey()
+	addr := bytes.Repeat([]byte{7}, 20)
+	for _, ht := range []byte{sig_all, sig_none, sig_single, sig_all_anyone_can_pay, sig_none_anyone_can_pay} {
+		partial := signedPartialTx(t, key, 5000, ht)
+		if err := verifyFunding(t, partial, 5000); err != nil {
+			t.Fatalf("%02x: expected the partial tx to verify, got %v\n", ht, err)
+		}
+		if err := verifyFunding(t, partial, 5001); err == nil {
+			t.Fatalf("%02x: expected an error claiming another amount\n", ht)
+		}
+
+		// adding outputs only keeps signatures that don't commit to them
+		boostTx, err := BoostScript(partial, bytes.Repeat([]byte{1}, 20), 3, 100, 5000, addr, defaultFees)
+		if err != nil {
+			t.Fatalf("%02x: error building boost tx: %v\n", ht, err)
+		}
+		err = verifyFunding(t, boostTx, 5000)
+		if covers := ht&sigHashBaseMask != sigHashNone; covers == (err == nil) {
+			t.Fatalf("%02x: unexpected verification result: %v\n", ht, err)
+		}
+	}
+
+	// the same signature from another key
+	partial := signedPartialTx(t, key, 5000, sig_all)
+	other, _ := btcec.NewPrivateKey()
+	sc, _ := ParseScript(partial.txins[0].script)
+	forged, _ := NewScriptBuilder().AddData(sc[0].Data).AddData(other.PubKey().SerializeCompressed()).Script()
+	partial.txins[0].script, partial.txins[0].scriptLen = forged, makeVarInt(uint64(len(forged)))
+	prevout := p2pkhPrevout(t, signedPartialTx(t, key, 5000, sig_all).txins[0], 5000)
+	if err := partial.VerifyInputs([]*Prevout{prevout}); err == nil {
+		t.Fatal("expected an error for a signature of another key")
+	}
+}
+
+func TestBoostFunding(t *testing.T) {
+	c := newTestServer(t)
+	seedBoostUsers(c.Firestore.(*MemoryDocs))
+	key, _ := btcec.NewPrivateKey()
+	utxos := c.UTXOs.(*MemoryUTXOs)
+
+	// funds a tx of key spending sats, the 3 seeded users are boosted with
+	// 100 sats each for 1 sat of fees
+	partial := func(sats uint64, hashType byte) string {
+		tx := signedPartialTx(t, key, sats, hashType)
+		utxos.Add(tx.txins[0].txid, tx.txins[0].utxoIndex, p2pkhPrevout(t, tx.txins[0], sats))
+		return base64.StdEncoding.EncodeToString(tx.Raw())
+	}
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	cases := []struct {
+		name   string
+		f      func(br *boostRequest2)
+		status int
+		code   string
+	}{
+		{"more input sats", func(br *boostRequest2) { br.InputSats++ }, 400, codeInvalidTx},
+		{"no input sats", func(br *boostRequest2) { br.InputSats = 0 }, 400, codeInvalidTx},
+		{"unknown utxo", func(br *boostRequest2) {
+			tx := signedPartialTx(t, key, 49049, sig_none)
+			br.PartialTx = base64.StdEncoding.EncodeToString(tx.Raw())
+		}, 400, codeInvalidTx},
+		{"signed with sighash all", func(br *boostRequest2) {
+			br.PartialTx = partial(49049, sig_all)
+		}, 400, codeInvalidTx},
+		{"unsigned", func(br *boostRequest2) {
+			tx, _ := ParseTx(testPartialTx(t))
+			tx.txins[0].script, tx.txins[0].scriptLen = nil, makeVarInt(0)
+			br.PartialTx = base64.StdEncoding.EncodeToString(tx.Raw())
+		}, 400, codeInvalidTx},
+		{"change under dust", func(br *boostRequest2) {
+			sats := 300 + 1 + defaultFees.Dust - 1
+			br.PartialTx, br.InputSats = partial(sats, sig_none), int(sats)
+		}, 400, codeUnderfunded},
+		{"underfunded", func(br *boostRequest2) {
+			br.PartialTx, br.InputSats = partial(250, sig_none), 250
+		}, 400, codeUnderfunded},
+		{"negative price", func(br *boostRequest2) { br.PricePerHead = -100 }, 400, codeInvalidRequest},
+		{"utxo source down", func(*boostRequest2) {
+			c.UTXOs = &WhatsOnChainUTXOs{BaseURL: down.URL}
+		}, 502, codeUTXOLookupFailed},
+	}
+	for _, tc := range cases {
+		br := testBoostRequest()
+		tc.f(br)
+		b, _ := json.Marshal(br)
+		w := httptest.NewRecorder()
+		c.HandleBoostRequest(w, asUser(httptest.NewRequest("POST", "/", bytes.NewReader(b)), "jones"))
+		if w.Code != tc.status || !bytes.Contains(w.Body.Bytes(), []byte(tc.code)) {
+			t.Errorf("%s: expected %d %s, got %d %s\n", tc.name, tc.status, tc.code, w.Code, w.Body.String())
+		}
+	}
+}
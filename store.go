@@ -0,0 +1,187 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/storage"
+	rtdb "firebase.google.com/go/v4/db"
+	"firebase.google.com/go/v4/messaging"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The handlers only talk to these interfaces, firebase backs them in
+// production (see NewServer) and memstore.go backs them in tests
+
+type RealtimeDB interface {
+	NewRef(path string) RealtimeRef
+}
+
+type RealtimeRef interface {
+	Child(path string) RealtimeRef
+	Get(ctx context.Context, v interface{}) error
+	Set(ctx context.Context, v interface{}) error
+	Push(ctx context.Context, v interface{}) (RealtimeRef, error)
+	Transaction(ctx context.Context, fn rtdb.UpdateFn) error
+}
+
+type ObjectStore interface {
+	NewWriter(ctx context.Context, name string, metadata map[string]string) io.WriteCloser
+	Attrs(ctx context.Context, name string) (*storage.ObjectAttrs, error)
+	SignedURL(name string, opts *storage.SignedURLOptions) (string, error)
+}
+
+type Document interface {
+	DataTo(v interface{}) error
+	DataAt(path string) (interface{}, error)
+}
+
+// iteration ends with iterator.Done, like firestore
+type DocumentIterator interface {
+	Next() (Document, error)
+	Stop()
+}
+
+type DocFilter struct {
+	Path  string
+	Op    string // "==", "<", "<=", ">", ">=", "in"
+	Value interface{}
+}
+
+// DocQuery takes a single "in" filter like firestore does. Documents come
+// ordered by the fields of OrderBy, the ones without them are left out, and
+// from after the values of StartAfter, a cursor in OrderBy
+type DocQuery struct {
+	Collection string
+	Filters    []DocFilter
+	OrderBy    []string
+	StartAfter []interface{}
+	Limit      int
+}
+
+type DocumentStore interface {
+	Get(ctx context.Context, collection, id string) (Document, error)
+	Query(ctx context.Context, q *DocQuery) DocumentIterator
+	// Update sets the fields of data on an existing document, it fails
+	// with errDocNotFound when there's none
+	Update(ctx context.Context, collection, id string, data map[string]interface{}) error
+}
+
+type Messenger interface {
+	Send(ctx context.Context, m *messaging.Message) (string, error)
+	SendEach(ctx context.Context, ms []*messaging.Message) (*messaging.BatchResponse, error)
+}
+
+type firebaseDB struct {
+	c *rtdb.Client
+}
+
+func (f firebaseDB) NewRef(path string) RealtimeRef {
+	return firebaseRef{f.c.NewRef(path)}
+}
+
+type firebaseRef struct {
+	r *rtdb.Ref
+}
+
+func (f firebaseRef) Child(path string) RealtimeRef {
+	return firebaseRef{f.r.Child(path)}
+}
+
+func (f firebaseRef) Get(ctx context.Context, v interface{}) error {
+	return f.r.Get(ctx, v)
+}
+
+func (f firebaseRef) Set(ctx context.Context, v interface{}) error {
+	return f.r.Set(ctx, v)
+}
+
+func (f firebaseRef) Push(ctx context.Context, v interface{}) (RealtimeRef, error) {
+	r, err := f.r.Push(ctx, v)
+	if err != nil {
+		return nil, err
+	}
+	return firebaseRef{r}, nil
+}
+
+func (f firebaseRef) Transaction(ctx context.Context, fn rtdb.UpdateFn) error {
+	return f.r.Transaction(ctx, fn)
+}
+
+type firebaseBucket struct {
+	b *storage.BucketHandle
+}
+
+func (f firebaseBucket) NewWriter(ctx context.Context, name string, metadata map[string]string) io.WriteCloser {
+	w := f.b.Object(name).NewWriter(ctx)
+	w.Metadata = metadata
+	return w
+}
+
+func (f firebaseBucket) Attrs(ctx context.Context, name string) (*storage.ObjectAttrs, error) {
+	return f.b.Object(name).Attrs(ctx)
+}
+
+func (f firebaseBucket) SignedURL(name string, opts *storage.SignedURLOptions) (string, error) {
+	return f.b.SignedURL(name, opts)
+}
+
+type firestoreDocs struct {
+	c *firestore.Client
+}
+
+func (f firestoreDocs) Get(ctx context.Context, collection, id string) (Document, error) {
+	doc, err := f.c.Collection(collection).Doc(id).Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (f firestoreDocs) Update(ctx context.Context, collection, id string, data map[string]interface{}) error {
+	ups := make([]firestore.Update, 0, len(data))
+	for k, v := range data {
+		ups = append(ups, firestore.Update{Path: k, Value: v})
+	}
+	_, err := f.c.Collection(collection).Doc(id).Update(ctx, ups)
+	if status.Code(err) == codes.NotFound {
+		return fmt.Errorf("%s/%s: %w", collection, id, errDocNotFound)
+	}
+	return err
+}
+
+func (f firestoreDocs) Query(ctx context.Context, dq *DocQuery) DocumentIterator {
+	q := f.c.Collection(dq.Collection).Query
+	for _, flt := range dq.Filters {
+		q = q.Where(flt.Path, flt.Op, flt.Value)
+	}
+	for _, path := range dq.OrderBy {
+		q = q.OrderBy(path, firestore.Asc)
+	}
+	if len(dq.StartAfter) > 0 {
+		q = q.StartAfter(dq.StartAfter...)
+	}
+	if dq.Limit > 0 {
+		q = q.Limit(dq.Limit)
+	}
+	return firestoreIter{q.Documents(ctx)}
+}
+
+type firestoreIter struct {
+	it *firestore.DocumentIterator
+}
+
+func (f firestoreIter) Next() (Document, error) {
+	doc, err := f.it.Next()
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (f firestoreIter) Stop() {
+	f.it.Stop()
+}
@@ -0,0 +1,211 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	rtdb "firebase.google.com/go/v4/db"
+)
+
+// campaignExpiry indexes a campaign by expiry on the shard of its sender,
+// under expiries/<campaign id>, so sweeps don't read every root
+type campaignExpiry struct {
+	Sender    string `json:"sender"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+// campaigns in these are done, there is nothing to refund
+var errCampaignDone = errors.New("campaign has nothing left to refund")
+
+// SweepExpired refunds the outputs nobody claimed of every campaign expired
+// at now, in one tx per campaign to the change address of its sender. It
+// returns the refunded campaigns, a campaign that fails to refund stays
+// expired and is tried again on the next sweep. Nothing in the package
+// schedules it, only cmd/down4d does with -sweep-every, a deployment
+// running without it never refunds
+func (s *Server) SweepExpired(ctx context.Context, now time.Time) ([]*Campaign, error) {
+	regions := make([]string, 0, len(s.Shards))
+	for reg := range s.Shards {
+		regions = append(regions, reg)
+	}
+	sort.Strings(regions)
+
+	var refunded []*Campaign
+	var errs []error
+	for _, reg := range regions {
+		for i, shrd := range s.Shards[reg] {
+			var exps map[string]*campaignExpiry
+			if err := shrd.RealtimeDB.NewRef("expiries").Get(ctx, &exps); err != nil {
+				errs = append(errs, fmt.Errorf("error reading expiries of %s[%d]: %v", reg, i, err))
+				continue
+			}
+			for id, exp := range exps {
+				if exp == nil || exp.ExpiresAt > now.UnixMilli() {
+					continue
+				}
+				c, err := s.refundCampaign(ctx, exp.Sender, id)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("error refunding campaign %s: %v", id, err))
+					continue
+				}
+				NonFatal(shrd.RealtimeDB.NewRef("expiries/"+id).Set(ctx, nil), "error removing expiry of "+id)
+				if c != nil {
+					refunded = append(refunded, c)
+				}
+			}
+		}
+	}
+	return refunded, errors.Join(errs...)
+}
+
+// refundCampaign expires the campaign and broadcasts the refund of its
+// unclaimed outputs, it is nil when there was nothing to refund
+func (s *Server) refundCampaign(ctx context.Context, sender, id string) (*Campaign, error) {
+	if c, err := s.campaign(ctx, sender, id); err != nil {
+		return nil, err
+	} else if c == nil {
+		return nil, nil
+	}
+	// claims check the status, none starts once it's expired
+	c, err := s.updateCampaign(ctx, sender, id, func(c *Campaign) error {
+		switch c.Status {
+		case CampaignExpired:
+			return nil
+		case CampaignBroadcast, CampaignDelivered, CampaignPartiallyClaimed:
+			return c.advance(CampaignExpired)
+		}
+		return errCampaignDone
+	})
+	if errors.Is(err, errCampaignDone) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// outputs are marked refunded with the transaction claims mark theirs
+	// with, an output a claim marked first is left to it even when its
+	// broadcast is still on the way
+	claims := make([]RealtimeRef, c.Targets)
+	for _, p := range c.Packs {
+		if p.BoostId == "" {
+			continue
+		}
+		cp, err := parseUserId(p.BoostId)
+		if err != nil {
+			return nil, err
+		}
+		shrd, err := s.ServerShard(cp)
+		if err != nil {
+			return nil, err
+		}
+		ref := shrd.RealtimeDB.NewRef("boosts/" + cp.Unik + "/claims")
+		for i := p.Start; i < p.End && i < c.Targets; i++ {
+			claims[i] = ref
+		}
+	}
+	outs, marked := make([]uint32, 0, c.Targets), make([]RealtimeRef, 0, c.Targets)
+	release := func() {
+		for _, ref := range marked {
+			NonFatal(ref.Set(ctx, nil), "error releasing refund mark of campaign "+id)
+		}
+	}
+	now := time.Now().UnixMilli()
+	for i := 0; i < c.Targets; i++ {
+		// outputs of no written pack were never queued, nobody can claim them
+		if claims[i] == nil {
+			outs = append(outs, uint32(i))
+			continue
+		}
+		ref := claims[i].Child(strconv.Itoa(i))
+		err := ref.Transaction(ctx, func(tn rtdb.TransactionNode) (interface{}, error) {
+			var cur map[string]interface{}
+			if err := tn.Unmarshal(&cur); err != nil {
+				return nil, err
+			}
+			if cur != nil && cur["refund"] != true {
+				return nil, errAlreadyClaimed
+			}
+			return map[string]interface{}{"refund": true, "campaign": id, "claimedAt": now}, nil
+		})
+		if errors.Is(err, errAlreadyClaimed) {
+			continue
+		} else if err != nil {
+			release()
+			return nil, fmt.Errorf("error marking output %d refunded: %v", i, err)
+		}
+		outs, marked = append(outs, uint32(i)), append(marked, ref)
+	}
+	if len(outs) == 0 {
+		_, err := s.updateCampaign(ctx, sender, id, func(c *Campaign) error { return c.advance(CampaignRefunded) })
+		return nil, err
+	}
+
+	sweep, err := s.sweepScript(ctx, c, outs)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	bres, err := s.Broadcaster.Broadcast(ctx, sweep.Raw())
+	if err != nil {
+		// nothing was spent, the next sweep marks them again
+		release()
+		return nil, err
+	}
+	extra := map[string]interface{}{"sender": sender, "campaign": id, "refund": true}
+	if err := s.recordTxStatus(ctx, bres, extra); err != nil {
+		NonFatal(err, "error recording refund tx status")
+	}
+	c, err = s.updateCampaign(ctx, sender, id, func(c *Campaign) error {
+		c.RefundTxid, c.Refunded = bres.Txid, sweep.txouts[0].sats
+		return c.advance(CampaignRefunded)
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("refunded %d sats of %d outputs of campaign %s in %s\n", c.Refunded, len(outs), id, c.RefundTxid)
+	return c, nil
+}
+
+// sweepScript builds and verifies the refund of outs to the change address
+func (s *Server) sweepScript(ctx context.Context, c *Campaign, outs []uint32) (*Tx, error) {
+	addr, err := s.Network.DecodeAddress(c.ChangeAddress)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding change address: %v", err)
+	}
+	s1, err := base64.StdEncoding.DecodeString(c.S1)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding s1: %v", err)
+	}
+	txid, err := txidOf(c.Txid)
+	if err != nil {
+		return nil, err
+	}
+	sweep, err := SweepScript(txid, outs, s1, uint64(c.PricePerHead), addr, s.FeePolicy(ctx))
+	if err != nil {
+		return nil, err
+	}
+	// the puzzles are rebuilt from s1, looking up every output would fetch
+	// the whole boost tx as many times
+	if err := sweep.VerifyInputs(puzzlePrevouts(s1, outs, uint64(c.PricePerHead))); err != nil {
+		return nil, err
+	}
+	return sweep, nil
+}
+
+func puzzlePrevouts(s1 []byte, outs []uint32, pph uint64) []*Prevout {
+	buf, h, sb := new(bytes.Buffer), sha1.New(), NewScriptBuilder()
+	prevouts := make([]*Prevout, len(outs))
+	for j, i := range outs {
+		script, _ := simpleBoostHashPuzzle(s1, i, sb, buf, h)
+		prevouts[j] = &Prevout{Sats: pph, Script: script}
+	}
+	return prevouts
+}
@@ -0,0 +1,101 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSweepExpired(t *testing.T) {
+	ctx := context.Background()
+	c := newTestServer(t)
+	boostTx, camp, targets, outputs := testCampaign(t, c)
+	mock := c.Broadcaster.(*MockBroadcaster)
+
+	claimed := outputs[targets[0]]
+	cr := claimRequest{UserID: targets[0], BoostID: camp.Packs[0].BoostId, Index: claimed, Address: c.Network.EncodeAddress(RandomBytes(20))}
+	if w := testClaim(c, "rimouski", cr); w.Code != 200 {
+		t.Fatalf("unexpected claim response %d %s\n", w.Code, w.Body.String())
+	}
+
+	// no claim past the expiry, before the sweep expires the campaign
+	c.updateCampaign(ctx, camp.Sender, camp.Id, func(cp *Campaign) error {
+		cp.ExpiresAt = time.Now().Add(-time.Minute).UnixMilli()
+		return nil
+	})
+	if w := testClaim(c, "bic", claimRequest{UserID: targets[1], BoostID: cr.BoostID, Index: outputs[targets[1]], Address: cr.Address}); w.Code != 400 {
+		t.Fatalf("expected no claim past the expiry, got %d %s\n", w.Code, w.Body.String())
+	}
+	c.updateCampaign(ctx, camp.Sender, camp.Id, func(cp *Campaign) error {
+		cp.ExpiresAt = camp.ExpiresAt
+		return nil
+	})
+
+	// a claim marked its output but its broadcast is still on the way
+	bid, _ := parseUserId(cr.BoostID)
+	shrd, _ := c.ServerShard(bid)
+	pending := outputs[targets[2]]
+	pendingRef := shrd.RealtimeDB.NewRef("boosts/" + bid.Unik + "/claims/" + strconv.Itoa(pending))
+	pendingRef.Set(ctx, map[string]interface{}{"claimer": targets[2], "claimedAt": time.Now().UnixMilli()})
+
+	if refunded, err := c.SweepExpired(ctx, time.Now()); err != nil || len(refunded) != 0 {
+		t.Fatalf("expected nothing to refund before the ttl, got %v: %v\n", refunded, err)
+	}
+	later := time.Now().Add(c.BoostTTL + time.Minute)
+
+	// a refund nobody takes is tried again
+	mock.Err = &BroadcastError{Provider: providerMock, Message: "rejected"}
+	if refunded, err := c.SweepExpired(ctx, later); err == nil || len(refunded) != 0 {
+		t.Fatalf("expected the sweep to fail, got %v\n", refunded)
+	}
+	if camp, _ = c.campaign(ctx, camp.Sender, camp.Id); camp.Status != CampaignExpired {
+		t.Fatalf("expected an expired campaign, got %s\n", camp.Status)
+	}
+	if w := testClaim(c, "bic", claimRequest{UserID: targets[1], BoostID: cr.BoostID, Index: outputs[targets[1]], Address: cr.Address}); w.Code != 400 {
+		t.Fatalf("expected no claim after expiry, got %d %s\n", w.Code, w.Body.String())
+	}
+	mock.Err = nil
+	var mark map[string]interface{}
+	if pendingRef.Get(ctx, &mark); mark["claimer"] != targets[2] {
+		t.Fatalf("expected the failed sweep to leave the pending claim, got %v\n", mark)
+	}
+
+	refunded, err := c.SweepExpired(ctx, later)
+	if err != nil || len(refunded) != 1 || refunded[0].Id != camp.Id || refunded[0].Status != CampaignRefunded {
+		t.Fatalf("expected the campaign refunded, got %v: %v\n", refunded, err)
+	}
+	sweep, err := ParseTx(mock.Sent[len(mock.Sent)-1])
+	if err != nil {
+		t.Fatalf("error parsing refund tx: %v\n", err)
+	}
+	if len(sweep.txins) != len(targets)-2 {
+		t.Fatalf("expected %d inputs, got %d\n", len(targets)-2, len(sweep.txins))
+	}
+	prevouts := make([]*Prevout, len(sweep.txins))
+	for i, tin := range sweep.txins {
+		if tin.utxoIndex == uint32(claimed) || tin.utxoIndex == uint32(pending) || !bytes.Equal(tin.txid, Txid(boostTx)) {
+			t.Fatalf("refund spends %s:%d\n", explorerTxid(tin.txid), tin.utxoIndex)
+		}
+		prevouts[i], _ = c.UTXOs.Prevout(ctx, tin.txid, tin.utxoIndex)
+	}
+	if err := sweep.VerifyInputs(prevouts); err != nil {
+		t.Fatalf("refund doesn't spend the boost outputs: %v\n", err)
+	}
+	change, _ := c.Network.DecodeAddress(testBoostRequest().ChangeAddress)
+	lock, _ := p2pkh(change)
+	fee := c.FeePolicy(ctx).Fee(len(sweep.Raw()))
+	if out := sweep.txouts[0]; len(sweep.txouts) != 1 || !bytes.Equal(out.script, lock) || out.sats != uint64(len(targets)-2)*100-fee {
+		t.Fatalf("unexpected refund output of %d sats\n", out.sats)
+	}
+	if r := refunded[0]; r.RefundTxid != explorerTxid(sweep.Txid()) || r.Refunded != sweep.txouts[0].sats {
+		t.Fatalf("unexpected refund record %+v\n", r)
+	}
+
+	// the campaign is out of the index once refunded
+	n := len(mock.Sent)
+	if refunded, err := c.SweepExpired(ctx, later); err != nil || len(refunded) != 0 || len(mock.Sent) != n {
+		t.Fatalf("expected nothing left to sweep, got %v: %v\n", refunded, err)
+	}
+}
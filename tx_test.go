@@ -0,0 +1,140 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"math"
+	"testing"
+)
+
+func testPartialTx(t testing.TB) []byte {
+	raw, err := base64.StdEncoding.DecodeString(testBoostRequest().PartialTx)
+	if err != nil {
+		t.Fatalf("error decoding partial tx: %v\n", err)
+	}
+	return raw
+}
+
+func TestParseTx(t *testing.T) {
+	raw := testPartialTx(t)
+	tx, err := ParseTx(raw)
+	if err != nil {
+		t.Fatalf("error parsing partial tx: %v\n", err)
+	}
+	if len(tx.txins) != 1 || len(tx.txouts) != 0 || tx.versionNo != 1 {
+		t.Fatalf("unexpected partial tx\n%s", tx.Formatted())
+	}
+	if !bytes.Equal(tx.Raw(), raw) {
+		t.Fatal("partial tx doesn't round trip")
+	}
+
+	for i := 0; i < len(raw); i++ {
+		if _, err := ParseTx(raw[:i]); err == nil {
+			t.Fatalf("expected an error for a tx truncated at %d bytes\n", i)
+		}
+	}
+	if _, err := ParseTx(append(raw, 0)); err == nil {
+		t.Fatal("expected an error for trailing bytes")
+	}
+
+	invalids := map[string][]byte{
+		// version, 0xffffffff inputs
+		"huge input count": {1, 0, 0, 0, 0xfe, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0},
+		// version, no inputs, 0xffff outputs
+		"huge output count": {1, 0, 0, 0, 0, 0xfd, 0xff, 0xff, 0, 0, 0, 0},
+		// version, no inputs, 1 output of 0 sats with a 0xffff bytes script
+		"huge script": {1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0xfd, 0xff, 0xff, 0, 0, 0, 0},
+	}
+	for name, b := range invalids {
+		if _, err := ParseTx(b); err == nil {
+			t.Errorf("%s: expected an error\n", name)
+		}
+	}
+}
+
+func FuzzParseTx(f *testing.F) {
+	f.Add(testPartialTx(f))
+	f.Add([]byte{1, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	f.Add([]byte{1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		tx, err := ParseTx(b)
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(tx.Raw(), b) {
+			t.Fatalf("tx doesn't round trip\n%x\n%x", b, tx.Raw())
+		}
+	})
+}
+
+func TestVarInt(t *testing.T) {
+	vectors := map[uint64]string{
+		0:                  "00",
+		0xfc:               "fc",
+		0xfd:               "fdfd00",
+		0x12c:              "fd2c01",
+		0xffff:             "fdffff",
+		0x10000:            "fe00000100",
+		0xffffffff:         "feffffffff",
+		0x100000000:        "ff0000000001000000",
+		0xffffffffffffffff: "ffffffffffffffffff",
+	}
+	for n, want := range vectors {
+		vi := makeVarInt(n)
+		if hex.EncodeToString(vi.data) != want {
+			t.Errorf("%d: expected %s, got %x\n", n, want, vi.data)
+		}
+		raw, _ := hex.DecodeString(want)
+		rdr := bytes.NewReader(raw)
+		read, err := varIntFromRdr(rdr)
+		if err != nil || read.uint != n || !bytes.Equal(read.data, raw) || rdr.Len() != 0 {
+			t.Errorf("%s: expected %d, got %d: %v\n", want, n, read.uint, err)
+		}
+	}
+
+	for _, invalid := range []string{"", "fd", "fd01", "fdfc00", "fe", "feffff0000", "ff", "ffffffffff00000000"} {
+		raw, _ := hex.DecodeString(invalid)
+		if _, err := varIntFromRdr(bytes.NewReader(raw)); err == nil {
+			t.Errorf("%s: expected an error\n", invalid)
+		}
+	}
+}
+
+func TestBoostScriptManyOutputs(t *testing.T) {
+	const nOuts, pph, inSats = 300, 100, 49049
+	br := testBoostRequest()
+	s1, _ := base64.StdEncoding.DecodeString(br.S1)
+	addr, _ := Testnet.DecodeAddress(br.ChangeAddress)
+	tx, err := ParseTx(testPartialTx(t))
+	if err != nil {
+		t.Fatalf("error parsing partial tx: %v\n", err)
+	}
+
+	boostTx, err := BoostScript(tx, s1, nOuts, pph, inSats, addr, defaultFees)
+	if err != nil {
+		t.Fatalf("error building boost tx: %v\n", err)
+	}
+	raw := boostTx.Raw()
+	parsed, err := ParseTx(raw)
+	if err != nil {
+		t.Fatalf("error parsing boost tx: %v\n", err)
+	}
+	if len(parsed.txouts) != nOuts+1 || hex.EncodeToString(parsed.nOuts.data) != "fd2d01" {
+		t.Fatalf("expected %d outputs encoded as fd2d01, got %d as %x\n",
+			nOuts+1, len(parsed.txouts), parsed.nOuts.data)
+	}
+
+	// the size estimate has to account for the 3 byte output count
+	var out uint64
+	for _, tout := range parsed.txouts {
+		out += tout.sats
+	}
+	fees := inSats - out
+	if want := uint64(math.Ceil(float64(len(raw)) / 1000)); fees != want {
+		t.Fatalf("expected %d sats of fees for %d bytes, got %d\n", want, len(raw), fees)
+	}
+	if parsed.txouts[nOuts].sats != inSats-nOuts*pph-fees {
+		t.Fatalf("unexpected change: %d\n", parsed.txouts[nOuts].sats)
+	}
+}
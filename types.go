@@ -6,12 +6,13 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"io"
 )
 
 // Rules for encoding bsv transaction
 // 4 byte int (uint32) -> LITTLE ENDIAN // versionNo, nLockTime
 // 8 byte int (uint64) -> LITTLE ENDIAN // Satoshis
-// VarInt              -> BIG ENDIAN
+// VarInt              -> LITTLE ENDIAN // CompactSize, see makeVarInt
 
 
 type Txin struct {
@@ -40,17 +41,29 @@ type VarInt struct {
 	uint uint64
 }
 
-func txinFromRdr(rdr *bytes.Reader) *Txin {
+// smallest encodings, they bound the counts a reader can claim
+const (
+	minTxinSize  = 32 + 4 + 1 + 4 // txid, index, empty script, sequence
+	minTxoutSize = 8 + 1          // sats, empty script
+)
+
+func txinFromRdr(rdr *bytes.Reader) (*Txin, error) {
 	txidbuf := make([]byte, 32)
 	var utxoi, seqno uint32
 
-	rdr.Read(txidbuf)
-	// binary.Read(rdr, binary.LittleEndian, txidbuf)
-	binary.Read(rdr, binary.LittleEndian, &utxoi)
-	scriptLen := varIntFromRdr(rdr)
-	scriptBuf := make([]byte, scriptLen.uint)
-	rdr.Read(scriptBuf)
-	binary.Read(rdr, binary.LittleEndian, &seqno)
+	if _, err := io.ReadFull(rdr, txidbuf); err != nil {
+		return nil, fmt.Errorf("error reading txid: %v", err)
+	}
+	if err := binary.Read(rdr, binary.LittleEndian, &utxoi); err != nil {
+		return nil, fmt.Errorf("error reading utxo index: %v", err)
+	}
+	scriptLen, scriptBuf, err := scriptFromRdr(rdr)
+	if err != nil {
+		return nil, err
+	}
+	if err := binary.Read(rdr, binary.LittleEndian, &seqno); err != nil {
+		return nil, fmt.Errorf("error reading sequence number: %v", err)
+	}
 
 	return &Txin{
 		txid:       txidbuf,
@@ -58,8 +71,22 @@ func txinFromRdr(rdr *bytes.Reader) *Txin {
 		scriptLen:  scriptLen,
 		script:     scriptBuf,
 		sequenceNo: seqno,
-	}
+	}, nil
+}
 
+func scriptFromRdr(rdr *bytes.Reader) (VarInt, []byte, error) {
+	scriptLen, err := varIntFromRdr(rdr)
+	if err != nil {
+		return VarInt{}, nil, fmt.Errorf("error reading script length: %v", err)
+	}
+	if scriptLen.uint > uint64(rdr.Len()) {
+		return VarInt{}, nil, fmt.Errorf("script length %d exceeds the %d bytes left", scriptLen.uint, rdr.Len())
+	}
+	scriptBuf := make([]byte, scriptLen.uint)
+	if _, err := io.ReadFull(rdr, scriptBuf); err != nil {
+		return VarInt{}, nil, fmt.Errorf("error reading script: %v", err)
+	}
+	return scriptLen, scriptBuf, nil
 }
 
 func (tin *Txin) raw() []byte {
@@ -72,18 +99,20 @@ func (tin *Txin) raw() []byte {
 	return buf.Bytes()
 }
 
-func txoutFromRdr(rdr *bytes.Reader) *Txout {
+func txoutFromRdr(rdr *bytes.Reader) (*Txout, error) {
 	var sats uint64
-	binary.Read(rdr, binary.LittleEndian, &sats)
-	scriptLen := varIntFromRdr(rdr)
-	scriptBuf := make([]byte, scriptLen.uint)
-	rdr.Read(scriptBuf)
+	if err := binary.Read(rdr, binary.LittleEndian, &sats); err != nil {
+		return nil, fmt.Errorf("error reading sats: %v", err)
+	}
+	scriptLen, scriptBuf, err := scriptFromRdr(rdr)
+	if err != nil {
+		return nil, err
+	}
 	return &Txout{
 		sats:      sats,
 		scriptLen: scriptLen,
 		script:    scriptBuf,
-	}
-
+	}, nil
 }
 
 func (tout *Txout) raw() []byte {
@@ -94,21 +123,60 @@ func (tout *Txout) raw() []byte {
 	return buf.Bytes()
 }
 
-func TxFromRdr(rdr *bytes.Reader) *Tx {
+// ParseTx parses a whole serialized tx, trailing bytes are an error
+func ParseTx(b []byte) (*Tx, error) {
+	rdr := bytes.NewReader(b)
+	tx, err := TxFromRdr(rdr)
+	if err != nil {
+		return nil, err
+	}
+	if rdr.Len() > 0 {
+		return nil, fmt.Errorf("error parsing tx: %d trailing bytes", rdr.Len())
+	}
+	return tx, nil
+}
+
+// TxFromRdr reads one tx from rdr, counts and script lengths can't claim
+// more than what is left to read
+func TxFromRdr(rdr *bytes.Reader) (*Tx, error) {
 	var vNo, nLock uint32
 
-	binary.Read(rdr, binary.LittleEndian, &vNo)
-	nIns := varIntFromRdr(rdr)
+	if err := binary.Read(rdr, binary.LittleEndian, &vNo); err != nil {
+		return nil, fmt.Errorf("error reading version: %v", err)
+	}
+	nIns, err := varIntFromRdr(rdr)
+	if err != nil {
+		return nil, fmt.Errorf("error reading input count: %v", err)
+	}
+	if nIns.uint > uint64(rdr.Len()/minTxinSize) {
+		return nil, fmt.Errorf("input count %d exceeds the %d bytes left", nIns.uint, rdr.Len())
+	}
 	ins := make([]*Txin, 0, nIns.uint)
 	for i := 0; i < int(nIns.uint); i++ {
-		ins = append(ins, txinFromRdr(rdr))
+		tin, err := txinFromRdr(rdr)
+		if err != nil {
+			return nil, fmt.Errorf("error reading input %d: %v", i, err)
+		}
+		ins = append(ins, tin)
+	}
+	nOuts, err := varIntFromRdr(rdr)
+	if err != nil {
+		return nil, fmt.Errorf("error reading output count: %v", err)
+	}
+	if nOuts.uint > uint64(rdr.Len()/minTxoutSize) {
+		return nil, fmt.Errorf("output count %d exceeds the %d bytes left", nOuts.uint, rdr.Len())
 	}
-	nOuts := varIntFromRdr(rdr)
 	outs := make([]*Txout, 0, nOuts.uint)
 	for i := 0; i < int(nOuts.uint); i++ {
-		outs = append(outs, txoutFromRdr(rdr))
+		tout, err := txoutFromRdr(rdr)
+		if err != nil {
+			return nil, fmt.Errorf("error reading output %d: %v", i, err)
+		}
+		outs = append(outs, tout)
+	}
+	if err := binary.Read(rdr, binary.LittleEndian, &nLock); err != nil {
+		return nil, fmt.Errorf("error reading lock time: %v", err)
 	}
-	binary.Read(rdr, binary.LittleEndian, &nLock)
 
 	return &Tx{
 		versionNo: vNo,
@@ -117,7 +185,7 @@ func TxFromRdr(rdr *bytes.Reader) *Tx {
 		nOuts:     nOuts,
 		txouts:    outs,
 		nLockTime: nLock,
-	}
+	}, nil
 }
 
 func (t *Tx) Raw() []byte {
@@ -156,58 +224,68 @@ func (t *Tx) TxidHex() string {
 	return hex.EncodeToString(t.Txid())
 }
 
-func varIntFromRdr(rdr *bytes.Reader) VarInt {
-	var uint uint64
-	firstByte, _ := rdr.ReadByte()
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.BigEndian, firstByte)
-
-	if firstByte == 0xFF {
-		var d uint64
-		binary.Read(rdr, binary.BigEndian, &d)
-		binary.Write(buf, binary.BigEndian, d)
-		uint = d
-	} else if firstByte == 0xFE {
-		var d uint32
-		binary.Read(rdr, binary.BigEndian, &d)
-		binary.Write(buf, binary.BigEndian, d)
-		uint = uint64(d)
-	} else if firstByte == 0xFD {
-		var d uint16
-		binary.Read(rdr, binary.BigEndian, &d)
-		binary.Write(buf, binary.BigEndian, d)
-		uint = uint64(d)
-	} else {
-		uint = uint64(firstByte)
-	}
-
-	return VarInt{uint: uint, data: buf.Bytes()}
-}
-
-func makeVarInt(n int) VarInt {
-	buf := new(bytes.Buffer)
-	if n >= 0 && n <= 252 {
-		binary.Write(buf, binary.BigEndian, uint8(n))
-	} else if n >= 253 && n <= 65535 {
-		binary.Write(buf, binary.BigEndian, uint8(0xFD))
-		binary.Write(buf, binary.BigEndian, uint8(n))
-	} else if n >= 65536 && n <= 4294967295 {
-		binary.Write(buf, binary.BigEndian, uint8(0xFE))
-		binary.Write(buf, binary.BigEndian, uint32(n))
-	} else {
-		binary.Write(buf, binary.BigEndian, uint8(0xFF))
-		binary.Write(buf, binary.BigEndian, uint64(n))
+// varIntFromRdr reads a CompactSize, values that fit a shorter encoding
+// are rejected like a node would, so Raw() is always canonical
+func varIntFromRdr(rdr *bytes.Reader) (VarInt, error) {
+	firstByte, err := rdr.ReadByte()
+	if err != nil {
+		return VarInt{}, err
+	}
+
+	var n, min uint64
+	var size int
+	switch firstByte {
+	case 0xFF:
+		size, min = 8, 0x100000000
+	case 0xFE:
+		size, min = 4, 0x10000
+	case 0xFD:
+		size, min = 2, 0xFD
+	default:
+		return VarInt{uint: uint64(firstByte), data: []byte{firstByte}}, nil
+	}
+
+	data := make([]byte, 1+size)
+	data[0] = firstByte
+	if _, err := io.ReadFull(rdr, data[1:]); err != nil {
+		return VarInt{}, err
+	}
+	for i := size; i > 0; i-- {
+		n = n<<8 | uint64(data[i])
+	}
+	if n < min {
+		return VarInt{}, fmt.Errorf("non canonical varint %x", data)
+	}
+	return VarInt{uint: n, data: data}, nil
+}
+
+// makeVarInt encodes n as a CompactSize
+// n <= 0xFC        -> 1 byte
+// n <= 0xFFFF      -> 0xFD + uint16
+// n <= 0xFFFFFFFF  -> 0xFE + uint32
+// otherwise        -> 0xFF + uint64
+func makeVarInt(n uint64) VarInt {
+	var data []byte
+	switch {
+	case n <= 0xFC:
+		data = []byte{byte(n)}
+	case n <= 0xFFFF:
+		data = binary.LittleEndian.AppendUint16([]byte{0xFD}, uint16(n))
+	case n <= 0xFFFFFFFF:
+		data = binary.LittleEndian.AppendUint32([]byte{0xFE}, uint32(n))
+	default:
+		data = binary.LittleEndian.AppendUint64([]byte{0xFF}, n)
 	}
-	return VarInt{data: buf.Bytes(), uint: uint64(n)}
+	return VarInt{data: data, uint: n}
 }
 
 func (tin *Txin) Formatted() string {
-	txid, script := hex.EncodeToString(tin.txid), hex.EncodeToString(tin.script)
+	txid, script := hex.EncodeToString(tin.txid), scriptAsm(tin.script)
 	return fmt.Sprintf("==TXIN==\nutxoTxid=%v\nutxoIndex=%v\nscriptLen=%v\nscript=%v\nseqNo=%v\n====\n", txid, tin.utxoIndex, tin.scriptLen.uint, script, tin.sequenceNo)
 }
 
 func (tout *Txout) Formatted() string {
-	script := hex.EncodeToString(tout.script)
+	script := scriptAsm(tout.script)
 	return fmt.Sprintf("==TXOUT==\nsats=%v\nscriptLen=%v\nscript=%v\n====\n", tout.sats, tout.scriptLen.uint, script)
 }
 
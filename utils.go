@@ -4,7 +4,7 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	//	"errors"
-	//	"fmt"
+	"fmt"
 	"log"
 	"strconv"
 	"strings"
@@ -13,12 +13,6 @@ import (
 	"github.com/btcsuite/btcd/btcutil/base58"
 )
 
-func Fatal(err error, errMsg string) {
-	if err != nil {
-		log.Fatalf(errMsg+": %v\n", err)
-	}
-}
-
 func NonFatal(err error, errMsg string) {
 	if err != nil {
 		log.Printf(errMsg+": %v\n", err)
@@ -44,6 +38,49 @@ func makeCp(u, r, s string) *ComposedId {
 	return &ComposedId{Unik: u, Region: r, Shard: shard}
 }
 
+// parseUserId and parseMessageRoots are the checked versions of makeCp and
+// ParseMessageId, for ids coming straight from requests
+func parseUserId(s string) (*ComposedId, error) {
+	vals := strings.Split(s, "-")
+	if len(vals) != 3 {
+		return nil, fmt.Errorf("invalid id %q", s)
+	}
+	return checkedCp(vals[0], vals[1], vals[2])
+}
+
+func parseMessageRoots(s string) ([]*ComposedId, error) {
+	vals := strings.Split(s, "-")
+	if len(vals) != 6 && len(vals) != 9 {
+		return nil, fmt.Errorf("invalid message id %q", s)
+	}
+	return parseRoots(strings.Join(vals[1:len(vals)-1], "-"))
+}
+
+// parseRoots checks a root, unik-region-shard-r or a dual root
+func parseRoots(s string) ([]*ComposedId, error) {
+	vals := strings.Split(s, "-")
+	if (len(vals) != 4 && len(vals) != 7) || vals[len(vals)-1] != "r" {
+		return nil, fmt.Errorf("invalid root %q", s)
+	}
+	roots := make([]*ComposedId, 0, 2)
+	for i := 0; i+2 < len(vals)-1; i += 3 {
+		cp, err := checkedCp(vals[i], vals[i+1], vals[i+2])
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, cp)
+	}
+	return roots, nil
+}
+
+func checkedCp(u, r, s string) (*ComposedId, error) {
+	shard, err := strconv.Atoi(s)
+	if len(u) == 0 || len(r) == 0 || err != nil || shard < 0 {
+		return nil, fmt.Errorf("invalid composed id %s-%s-%s", u, r, s)
+	}
+	return &ComposedId{Unik: u, Region: r, Shard: shard}, nil
+}
+
 // Root // unik-region-shard-r (4)
 // DualRoot // unik-region-shard-unik-shard-r (6)
 func ParseRoot(s string) []*ComposedId {
@@ -80,10 +117,6 @@ func ParseMessageId(s string) (string, string, string, []*ComposedId) {
 	return vals[0], RootOfComposedIds(roots), UnikRoot(roots), roots
 }
 
-func (c *ComposedId) ServerShard() ServerShard {
-	return Client.Shards[c.Region][c.Shard]
-}
-
 func UnixMilli() int64 {
 	return time.Now().UnixMilli()
 }
@@ -145,7 +178,7 @@ func MaxKey[T comparable](m map[T]int) string {
 }
 
 func RandomBytes(n int) []byte {
-	buf := make([]byte, 0, n)
+	buf := make([]byte, n)
 	if _, err := rand.Read(buf); err != nil {
 		panic(err)
 	}
@@ -0,0 +1,134 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// UTXOSource finds the outputs that tx inputs spend. txid is in tx order,
+// the reverse of the hex explorers show
+type UTXOSource interface {
+	Prevout(ctx context.Context, txid []byte, index uint32) (*Prevout, error)
+}
+
+var errUnknownUTXO = errors.New("unknown utxo")
+
+// an outpoint spent twice would count its sats twice
+var errDuplicateInput = errors.New("outpoint spent twice")
+
+// WhatsOnChainUTXOs reads the raw tx of a prevout from whatsonchain and
+// takes the output from it, that way sats are exact and not a float of bsv
+type WhatsOnChainUTXOs struct {
+	BaseURL string // like https://api.whatsonchain.com/v1/bsv/main
+	Client  *http.Client
+}
+
+// explorerTxid is the hex of txid as explorers and apis print it
+func explorerTxid(txid []byte) string {
+	rev := slices.Clone(txid)
+	slices.Reverse(rev)
+	return hex.EncodeToString(rev)
+}
+
+// txidOf is the txid in tx order of its explorer hex
+func txidOf(explorer string) ([]byte, error) {
+	txid, err := hex.DecodeString(explorer)
+	if err != nil {
+		return nil, err
+	}
+	if len(txid) != 32 {
+		return nil, fmt.Errorf("invalid txid length: %d", len(txid))
+	}
+	slices.Reverse(txid)
+	return txid, nil
+}
+
+func (w *WhatsOnChainUTXOs) Prevout(ctx context.Context, txid []byte, index uint32) (*Prevout, error) {
+	url := strings.TrimSuffix(w.BaseURL, "/") + "/tx/" + explorerTxid(txid) + "/hex"
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error building utxo request: %v", err)
+	}
+	c := w.Client
+	if c == nil {
+		c = http.DefaultClient
+	}
+	rsp, err := c.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching tx %s: %v", explorerTxid(txid), err)
+	}
+	defer rsp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(rsp.Body, maxTxHexSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("error reading tx %s: %v", explorerTxid(txid), err)
+	}
+	if rsp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: tx %s not found", errUnknownUTXO, explorerTxid(txid))
+	}
+	if rsp.StatusCode != 200 {
+		return nil, fmt.Errorf("error fetching tx %s: %d %s", explorerTxid(txid), rsp.StatusCode, string(body))
+	}
+	if len(body) > maxTxHexSize {
+		return nil, fmt.Errorf("tx %s is over %d bytes of hex", explorerTxid(txid), maxTxHexSize)
+	}
+
+	raw, err := hex.DecodeString(strings.TrimSpace(string(body)))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding tx %s: %v", explorerTxid(txid), err)
+	}
+	// don't take the api's word for it, the tx has to hash to txid
+	if !bytes.Equal(Txid(raw), txid) {
+		return nil, fmt.Errorf("tx %s doesn't hash to its txid", explorerTxid(txid))
+	}
+	return prevoutOf(raw, txid, index)
+}
+
+// maxTxHexSize bounds what we read back for a prevout, boost funding txs
+// are tiny so this is plenty
+const maxTxHexSize = 2 << 20
+
+func prevoutOf(raw, txid []byte, index uint32) (*Prevout, error) {
+	tx, err := ParseTx(raw)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing tx %s: %v", explorerTxid(txid), err)
+	}
+	if int(index) >= len(tx.txouts) {
+		return nil, fmt.Errorf("%w: tx %s has no output %d", errUnknownUTXO, explorerTxid(txid), index)
+	}
+	out := tx.txouts[index]
+	return &Prevout{Sats: out.sats, Script: out.script}, nil
+}
+
+// resolvePrevouts finds the outputs every input of tx spends and their total
+func resolvePrevouts(ctx context.Context, src UTXOSource, tx *Tx) ([]*Prevout, uint64, error) {
+	if src == nil {
+		return nil, 0, errors.New("no utxo source configured")
+	}
+	spent := make(map[string]bool, len(tx.txins))
+	for _, tin := range tx.txins {
+		op := outpoint(tin.txid, tin.utxoIndex)
+		if spent[op] {
+			return nil, 0, fmt.Errorf("%w: %s", errDuplicateInput, op)
+		}
+		spent[op] = true
+	}
+	prevouts, total := make([]*Prevout, len(tx.txins)), uint64(0)
+	for i, tin := range tx.txins {
+		p, err := src.Prevout(ctx, tin.txid, tin.utxoIndex)
+		if err != nil {
+			return nil, 0, err
+		}
+		if total+p.Sats < total {
+			return nil, 0, errors.New("input sats overflow")
+		}
+		prevouts[i], total = p, total+p.Sats
+	}
+	return prevouts, total, nil
+}
@@ -0,0 +1,102 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// testFundingTx is a signed tx with 2 boost outputs of 700 and its change
+func testFundingTx(t *testing.T) *Tx {
+	key, _ := btcec.NewPrivateKey()
+	tx, err := BoostScript(signedPartialTx(t, key, 5000, sig_none), RandomBytes(20), 2, 700, 5000, RandomBytes(20), defaultFees)
+	if err != nil {
+		t.Fatalf("error building funding tx: %v\n", err)
+	}
+	return tx
+}
+
+func TestWhatsOnChainUTXOs(t *testing.T) {
+	ctx := context.Background()
+	funding := testFundingTx(t)
+	raw, txid, liar := funding.Raw(), funding.Txid(), RandomBytes(32)
+
+	woc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/tx/" + explorerTxid(txid) + "/hex", "/tx/" + explorerTxid(liar) + "/hex":
+			w.Write([]byte(hex.EncodeToString(raw) + "\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer woc.Close()
+	src := &WhatsOnChainUTXOs{BaseURL: woc.URL + "/"}
+
+	p, err := src.Prevout(ctx, txid, 1)
+	if err != nil || p.Sats != 700 || !bytes.Equal(p.Script, funding.txouts[1].script) {
+		t.Fatalf("unexpected prevout %+v: %v\n", p, err)
+	}
+	if _, err := src.Prevout(ctx, txid, 3); !errors.Is(err, errUnknownUTXO) {
+		t.Fatalf("expected %v for a missing output, got %v\n", errUnknownUTXO, err)
+	}
+	if _, err := src.Prevout(ctx, RandomBytes(32), 0); !errors.Is(err, errUnknownUTXO) {
+		t.Fatalf("expected %v for a missing tx, got %v\n", errUnknownUTXO, err)
+	}
+	// a tx that doesn't hash to the txid is an error, but not an unknown utxo
+	if _, err := src.Prevout(ctx, liar, 0); err == nil || errors.Is(err, errUnknownUTXO) {
+		t.Fatalf("expected an error for a tx of another txid, got %v\n", err)
+	}
+}
+
+func TestResolvePrevouts(t *testing.T) {
+	ctx := context.Background()
+	funding := testFundingTx(t)
+	utxos := NewMemoryUTXOs()
+	utxos.AddTx(funding.Raw())
+
+	txin := func(i uint32) *Txin {
+		return &Txin{txid: funding.Txid(), utxoIndex: i, scriptLen: makeVarInt(0), sequenceNo: 0xffffffff}
+	}
+	tx := &Tx{versionNo: 1, nIns: makeVarInt(2), nOuts: makeVarInt(0), txins: []*Txin{txin(0), txin(1)}}
+	if prevouts, total, err := resolvePrevouts(ctx, utxos, tx); err != nil || len(prevouts) != 2 || total != 1400 {
+		t.Fatalf("unexpected prevouts %v of %d sats: %v\n", prevouts, total, err)
+	}
+	tx.txins[1] = txin(0)
+	if _, total, err := resolvePrevouts(ctx, utxos, tx); !errors.Is(err, errDuplicateInput) {
+		t.Fatalf("expected %v, got %d sats: %v\n", errDuplicateInput, total, err)
+	}
+}
+
+func TestLoadUTXOFile(t *testing.T) {
+	ctx := context.Background()
+	funding := testFundingTx(t)
+	path := filepath.Join(t.TempDir(), "utxos.json")
+	os.WriteFile(path, []byte(`["`+hex.EncodeToString(funding.Raw())+`"]`), 0600)
+
+	utxos, err := LoadUTXOFile(path)
+	if err != nil {
+		t.Fatalf("error loading utxo file: %v\n", err)
+	}
+	for i, out := range funding.txouts {
+		p, err := utxos.Prevout(ctx, funding.Txid(), uint32(i))
+		if err != nil || p.Sats != out.sats || !bytes.Equal(p.Script, out.script) {
+			t.Fatalf("unexpected prevout %d %+v: %v\n", i, p, err)
+		}
+	}
+	if _, err := utxos.Prevout(ctx, funding.Txid(), 3); !errors.Is(err, errUnknownUTXO) {
+		t.Fatalf("expected %v, got %v\n", errUnknownUTXO, err)
+	}
+
+	os.WriteFile(path, []byte(`["nothex"]`), 0600)
+	if _, err := LoadUTXOFile(path); err == nil {
+		t.Fatal("expected an error for a bad tx")
+	}
+}